@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrUnknownUser is returned by an Authenticator that has no user by
+	// the name given, so the next one can be tried
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrInvalidCredentials is returned when the user exists but the
+	// password is wrong or they are not allowed to log in
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// Identity is who an Authenticator found the person logging in to be
+type Identity struct {
+	// Username names the local user to log in as
+	Username string
+	// DN is the user's directory entry, empty for users kept by this
+	// server
+	DN string
+	// ID identifies the directory entry even when it is moved or renamed
+	ID string
+	// Groups are the distinguished names of the directory groups the user
+	// is in
+	Groups []string
+}
+
+// InGroup reports whether the user is in the group with this
+// distinguished name or common name, ignoring case
+func (id Identity) InGroup(name string) bool {
+	for _, group := range id.Groups {
+		if strings.EqualFold(group, name) || strings.EqualFold(commonName(group), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks passwords against a store of users
+type Authenticator interface {
+	// Name identifies the authenticator in logs
+	Name() string
+	// Authenticate checks a username and password. It returns
+	// ErrUnknownUser if the store has no such user and
+	// ErrInvalidCredentials if the password is wrong.
+	Authenticate(ctx context.Context, username, password string) (Identity, error)
+}
+
+// Chain tries each authenticator in turn, logging in with the first that
+// accepts the password
+type Chain []Authenticator
+
+// Authenticate returns the identity from the first authenticator that
+// accepts the password. Otherwise it returns ErrInvalidCredentials if any
+// of them knew the user, the first other error if one failed, and
+// ErrUnknownUser if none knew the user.
+func (c Chain) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	result := ErrUnknownUser
+	for _, a := range c {
+		identity, err := a.Authenticate(ctx, username, password)
+		switch {
+		case err == nil:
+			return identity, nil
+		case errors.Is(err, ErrUnknownUser):
+		case errors.Is(err, ErrInvalidCredentials):
+			result = err
+		case errors.Is(result, ErrUnknownUser):
+			result = fmt.Errorf("%s: %w", a.Name(), err)
+		}
+	}
+	return Identity{}, result
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapTimeout limits connecting to the directory and each request to it
+const ldapTimeout = 10 * time.Second
+
+// LDAP checks passwords against an LDAP directory or Active Directory. It
+// finds the user's entry with a search, binding as BindDN if set, then
+// binds as that entry with the password.
+type LDAP struct {
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	BindDN       string
+	BindPassword string
+
+	// UserFilter is searched for under BaseDN with {username} replaced by
+	// the name typed in, and must match a single entry
+	BaseDN            string
+	UserFilter        string
+	UsernameAttribute string
+	// IDAttribute identifies entries for good, such as entryUUID or
+	// Active Directory's binary objectGUID
+	IDAttribute string
+
+	// GroupFilter is searched for under GroupBaseDN with {dn} and
+	// {username} replaced by the user's. When it is empty the user's
+	// memberOf attribute lists their groups.
+	GroupBaseDN string
+	GroupFilter string
+	// RequiredGroup, when set, is a group users must be in to log in
+	RequiredGroup string
+}
+
+// NewTLSConfig returns the TLS settings for connecting to host, trusting
+// the PEM certificates in caCert instead of the system's if given
+func NewTLSConfig(host string, caCert []byte, insecureSkipVerify bool) *tls.Config {
+	config := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if len(caCert) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(caCert)
+	}
+	return config
+}
+
+func (l *LDAP) Name() string { return "ldap" }
+
+// dial connects to the directory, upgrading the connection with StartTLS
+// if configured
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(l.TLSConfig))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s failed: %v", l.URL, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if l.StartTLS {
+		if err := conn.StartTLS(l.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindService binds as the search account, or stays anonymous without one
+func (l *LDAP) bindService(conn *ldap.Conn) error {
+	if l.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+		return fmt.Errorf("binding as %s failed: %v", l.BindDN, err)
+	}
+	return nil
+}
+
+// Authenticate looks the user up and checks their password by binding as
+// them. The local username is taken from UsernameAttribute, so it is
+// spelled the same however the name was typed.
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	// A simple bind with an empty password is an anonymous bind, which
+	// most directories allow
+	if username == "" || password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+	if err := l.bindService(conn); err != nil {
+		return Identity{}, err
+	}
+
+	filter := strings.ReplaceAll(l.UserFilter, "{username}", ldap.EscapeFilter(username))
+	attributes := []string{"memberOf", l.IDAttribute}
+	if l.UsernameAttribute != "" {
+		attributes = append(attributes, l.UsernameAttribute)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, filter, attributes, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(result.Entries) > 1) {
+		return Identity{}, fmt.Errorf("%s matches more than one entry", filter)
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("searching for %s failed: %v", filter, err)
+	}
+	if len(result.Entries) == 0 {
+		return Identity{}, ErrUnknownUser
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{}, fmt.Errorf("binding as %s failed: %v", entry.DN, err)
+	}
+
+	identity := Identity{Username: username, DN: entry.DN, ID: entryID(entry, l.IDAttribute)}
+	if identity.ID == "" {
+		return Identity{}, fmt.Errorf("%s has no %s", entry.DN, l.IDAttribute)
+	}
+	if name := entry.GetEqualFoldAttributeValue(l.UsernameAttribute); name != "" {
+		identity.Username = name
+	}
+	if l.GroupFilter == "" {
+		identity.Groups = entry.GetEqualFoldAttributeValues("memberOf")
+	} else {
+		// The user may not be allowed to search for groups themselves
+		if err := l.bindService(conn); err != nil {
+			return Identity{}, err
+		}
+		identity.Groups, err = l.groups(conn, entry.DN, identity.Username)
+		if err != nil {
+			return Identity{}, err
+		}
+	}
+
+	if l.RequiredGroup != "" && !identity.InGroup(l.RequiredGroup) {
+		return Identity{}, fmt.Errorf("%w: %s is not in %s", ErrInvalidCredentials, entry.DN, l.RequiredGroup)
+	}
+	return identity, nil
+}
+
+// entryID returns the value of the entry's ID attribute, with Active
+// Directory's binary objectGUID hex encoded
+func entryID(entry *ldap.Entry, attribute string) string {
+	if strings.EqualFold(attribute, "objectGUID") {
+		return hex.EncodeToString(entry.GetEqualFoldRawAttributeValue(attribute))
+	}
+	return entry.GetEqualFoldAttributeValue(attribute)
+}
+
+// groups searches for the groups the user is a member of
+func (l *LDAP) groups(conn *ldap.Conn, dn, username string) ([]string, error) {
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(dn),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(l.GroupFilter)
+	// "1.1" asks for no attributes, only the entries' names
+	result, err := conn.Search(ldap.NewSearchRequest(l.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(ldapTimeout.Seconds()), false, filter, []string{"1.1"}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("searching for groups with %s failed: %v", filter, err)
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// commonName returns the value of the first attribute of a distinguished
+// name, such as "admins" for "cn=admins,ou=groups,dc=example,dc=org"
+func commonName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
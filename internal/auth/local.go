@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"webserver/internal/database"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Local checks passwords against the bcrypt hashes in the users table
+type Local struct{}
+
+func (Local) Name() string { return "local" }
+
+// Authenticate checks the password of a local user. Users without a
+// password, such as those created by single sign-on or a directory, are
+// unknown to it.
+func (Local) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	user, err := database.GetUser(username)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.PasswordHash == "") {
+		return Identity{}, ErrUnknownUser
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Username: username}, nil
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"database/sql"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// FolderTree lists a folder the user can access and everything in it
+// outside the trash. Paths start with the folder's own name and use / as
+// separator; folders come before the files inside them.
+func FolderTree(folderId int64, user_id int) ([]models.TreeEntry, error) {
+	ownerId, _, err := FolderRole(folderId, user_id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const tree = `
+	WITH RECURSIVE tree(id, path) AS (
+		SELECT id, folder_name FROM folders
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL
+		UNION ALL
+		SELECT f.id, t.path || '/' || f.folder_name
+		FROM folders f
+		JOIN tree t ON f.parent_folder_id = t.id
+		WHERE f.deleted_at IS NULL
+	)`
+
+	rows, err := db.Query(tree+"SELECT path FROM tree ORDER BY path", folderId, ownerId)
+	if err != nil {
+		logger.LogError("Error listing folder tree: %v", err)
+		return nil, err
+	}
+	var entries []models.TreeEntry
+	for rows.Next() {
+		entry := models.TreeEntry{IsDir: true}
+		if err := rows.Scan(&entry.Path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(tree+`
+	SELECT
+	t.path || '/' || f.file_name,
+	f.id,
+	f.file_name,
+	f.size,
+	f.blob_id,
+	b.storage_key,
+	b.sha256,
+	b.encoding,
+	COALESCE(b.key_user_id, 0),
+	f.created_at
+	FROM tree t
+	JOIN files f ON f.folder_id = t.id AND f.deleted_at IS NULL
+	JOIN blobs b ON b.id = f.blob_id
+	ORDER BY 1`, folderId, ownerId)
+	if err != nil {
+		logger.LogError("Error listing folder files: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry models.TreeEntry
+		file := &entry.File
+		err := rows.Scan(&entry.Path, &file.Id, &file.FileName, &file.Size, &file.BlobId, &file.StorageKey,
+			&file.Hash, &file.Encoding, &file.KeyUserId, &file.CreatedAt)
+		if err != nil {
+			logger.LogError("Error scanning file: %v", err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// linkBlob adds a reference to the blob holding the file's contents,
+// matched by hash and by the user whose data key encrypted them. If the
+// contents are new a blob row is created from the file's storage key.
+// reused reports whether an existing blob was found, in which case the
+// data stored under file.StorageKey is a duplicate.
+func linkBlob(tx *sql.Tx, file models.UploadFile) (blobId int64, reused bool, err error) {
+	var keyUserId any
+	if file.KeyUserId != 0 {
+		keyUserId = file.KeyUserId
+	}
+
+	err = tx.QueryRow("SELECT id FROM blobs WHERE sha256 = ? AND key_user_id IS ?", file.Hash, keyUserId).
+		Scan(&blobId)
+	switch {
+	case err == nil:
+		if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE id = ?", blobId); err != nil {
+			return 0, false, err
+		}
+		return blobId, true, nil
+	case err != sql.ErrNoRows:
+		return 0, false, err
+	}
+
+	result, err := tx.Exec(`
+	INSERT INTO blobs (sha256, storage_key, size, encoding, key_user_id, ref_count, created_at)
+	VALUES (?, ?, ?, ?, ?, 1, ?)`,
+		file.Hash, file.StorageKey, file.Size, file.Encoding, keyUserId, time.Now())
+	if err != nil {
+		return 0, false, err
+	}
+	blobId, err = result.LastInsertId()
+	if err != nil {
+		return 0, false, err
+	}
+	return blobId, false, nil
+}
+
+// releaseBlob drops one reference to a blob. When the last reference is
+// gone the row is deleted and its storage key returned so the caller can
+// remove the data from the blob store once the transaction commits.
+func releaseBlob(tx *sql.Tx, blobId int64) (orphanKey string, err error) {
+	var refCount int
+	var storageKey string
+	err = tx.QueryRow("SELECT ref_count, storage_key FROM blobs WHERE id = ?", blobId).
+		Scan(&refCount, &storageKey)
+	if err != nil {
+		return "", err
+	}
+
+	if refCount > 1 {
+		_, err = tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE id = ?", blobId)
+		return "", err
+	}
+	if _, err = tx.Exec("DELETE FROM blobs WHERE id = ?", blobId); err != nil {
+		return "", err
+	}
+	return storageKey, nil
+}
+
+// deleteFile removes a file record, all its versions and the grants and
+// share links on it. Foreign keys are not enforced, so nothing cascades. Storage keys of
+// blobs that lost their last reference are returned for removal from the
+// blob store once the transaction commits.
+func deleteFile(tx *sql.Tx, fileId int64) (orphanKeys []string, err error) {
+	rows, err := tx.Query("SELECT blob_id FROM file_versions WHERE file_id = ?", fileId)
+	if err != nil {
+		logger.LogError("Error retrieving file versions: %v", err)
+		return nil, err
+	}
+	var blobIds []int64
+	for rows.Next() {
+		var blobId int64
+		if err := rows.Scan(&blobId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		blobIds = append(blobIds, blobId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec("DELETE FROM file_versions WHERE file_id = ?", fileId); err != nil {
+		logger.LogError("Error deleting file versions: %v", err)
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM grants WHERE file_id = ?", fileId); err != nil {
+		logger.LogError("Error deleting grants: %v", err)
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM share_links WHERE file_id = ?", fileId); err != nil {
+		logger.LogError("Error deleting share links: %v", err)
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM files WHERE id = ?", fileId); err != nil {
+		logger.LogError("Error deleting file: %v", err)
+		return nil, err
+	}
+	for _, blobId := range blobIds {
+		orphanKey, err := releaseBlob(tx, blobId)
+		if err != nil {
+			logger.LogError("Error releasing blob %d: %v", blobId, err)
+			return nil, err
+		}
+		if orphanKey != "" {
+			orphanKeys = append(orphanKeys, orphanKey)
+		}
+	}
+	return orphanKeys, nil
+}
+
+// StorageUsage reports how many bytes and files a user owns, including
+// files in the trash. Every version of a file counts towards the bytes,
+// each at its full size even when its contents are shared with other
+// files through deduplication.
+func StorageUsage(user_id int) (bytes int64, files int64, err error) {
+	err = db.QueryRow(`
+	SELECT
+	COALESCE((SELECT SUM(v.size) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.user_id = ?), 0),
+	COUNT(*)
+	FROM files
+	WHERE user_id = ?`, user_id, user_id).Scan(&bytes, &files)
+	if err != nil {
+		logger.LogError("Error calculating storage usage: %v", err)
+		return 0, 0, err
+	}
+	return bytes, files, nil
+}
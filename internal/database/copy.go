@@ -0,0 +1,226 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"webserver/internal/logger"
+)
+
+// copyName returns name, or if taken reports it is in use, the first free
+// variant of "name (copy)", "name (copy 2)" and so on. For files the
+// suffix goes before the extension.
+func copyName(name string, isFile bool, taken func(string) (bool, error)) (string, error) {
+	if t, err := taken(name); err != nil || !t {
+		return name, err
+	}
+	base, ext := name, ""
+	if isFile {
+		ext = filepath.Ext(name)
+		if ext == name {
+			ext = ""
+		}
+		base = strings.TrimSuffix(name, ext)
+	}
+	for n := 1; ; n++ {
+		candidate := base + " (copy)" + ext
+		if n > 1 {
+			candidate = fmt.Sprintf("%s (copy %d)%s", base, n, ext)
+		}
+		if t, err := taken(candidate); err != nil || !t {
+			return candidate, err
+		}
+	}
+}
+
+// copyFile adds a file with the current contents of fileId to folderId.
+// The copy shares the original's blob and starts a new version history.
+func copyFile(tx *sql.Tx, fileId int64, user_id int, folderId int64, name string) (int64, error) {
+	var blobId, size int64
+	err := tx.QueryRow("SELECT blob_id, size FROM files WHERE id = ?", fileId).Scan(&blobId, &size)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	result, err := tx.Exec(`
+	INSERT INTO files (user_id, file_name, folder_id, blob_id, size, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		user_id, name, folderId, blobId, size, now)
+	if err != nil {
+		return 0, err
+	}
+	newId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO file_versions (file_id, version, blob_id, size, created_at)
+	VALUES (?, 1, ?, ?, ?)`,
+		newId, blobId, size, now)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE id = ?", blobId); err != nil {
+		return 0, err
+	}
+	return newId, nil
+}
+
+// CopyFile copies a file into targetId. If the name is taken there the
+// copy is named "name (copy).ext".
+func CopyFile(fileId int64, user_id int, targetId int64) (newId int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow("SELECT file_name FROM files WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		fileId, user_id).Scan(&name)
+	if err != nil {
+		return 0, err
+	}
+	if err := activeFolder(tx, targetId, user_id); err != nil {
+		return 0, err
+	}
+	name, err = copyName(name, true, func(n string) (bool, error) {
+		return fileNameTaken(tx, targetId, n, 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if newId, err = copyFile(tx, fileId, user_id, targetId, name); err != nil {
+		logger.LogError("Error copying file %d: %v", fileId, err)
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	return newId, nil
+}
+
+// CopyFolder copies a folder and everything in it into targetId, which
+// must not be inside the folder. If the name is taken there the copy is
+// named "name (copy)". Files share their blobs with the originals.
+func CopyFolder(folderId int64, user_id int, targetId int64) (newId int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow(`
+	SELECT folder_name FROM folders
+	WHERE id = ? AND user_id = ? AND parent_folder_id IS NOT NULL AND deleted_at IS NULL`,
+		folderId, user_id).Scan(&name)
+	if err != nil {
+		return 0, err
+	}
+	if err := activeFolder(tx, targetId, user_id); err != nil {
+		return 0, err
+	}
+	if inside, err := insideFolder(tx, targetId, folderId); err != nil {
+		return 0, err
+	} else if inside {
+		return 0, ErrCycle
+	}
+	name, err = copyName(name, false, func(n string) (bool, error) {
+		return folderNameTaken(tx, targetId, n, 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Copy breadth first. Each step lists the source folder's children
+	// before writing, since the single connection cannot interleave them.
+	type pending struct {
+		sourceId, parentId int64
+		name               string
+	}
+	queue := []pending{{folderId, targetId, name}}
+	folders, files := 0, 0
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		result, err := tx.Exec("INSERT INTO folders (user_id, parent_folder_id, folder_name, created_at) VALUES (?, ?, ?, ?)",
+			user_id, next.parentId, next.name, time.Now())
+		if err != nil {
+			logger.LogError("Error copying folder %d: %v", next.sourceId, err)
+			return 0, err
+		}
+		copyId, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		if newId == 0 {
+			newId = copyId
+		}
+		folders++
+
+		fileIds, err := queryIds(tx, "SELECT id FROM files WHERE folder_id = ? AND deleted_at IS NULL", next.sourceId)
+		if err != nil {
+			return 0, err
+		}
+		for _, fileId := range fileIds {
+			var fileName string
+			if err := tx.QueryRow("SELECT file_name FROM files WHERE id = ?", fileId).Scan(&fileName); err != nil {
+				return 0, err
+			}
+			if _, err := copyFile(tx, fileId, user_id, copyId, fileName); err != nil {
+				logger.LogError("Error copying file %d: %v", fileId, err)
+				return 0, err
+			}
+			files++
+		}
+
+		childIds, err := queryIds(tx, "SELECT id FROM folders WHERE parent_folder_id = ? AND deleted_at IS NULL", next.sourceId)
+		if err != nil {
+			return 0, err
+		}
+		for _, childId := range childIds {
+			var childName string
+			if err := tx.QueryRow("SELECT folder_name FROM folders WHERE id = ?", childId).Scan(&childName); err != nil {
+				return 0, err
+			}
+			queue = append(queue, pending{childId, copyId, childName})
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	logger.LogInfo("Copied folder %d to %d (%d folders, %d files)", folderId, newId, folders, files)
+	return newId, nil
+}
+
+// FolderSize returns the total size and number of files outside the
+// trash in a folder and its subfolders, counting current versions only
+func FolderSize(folderId int64, user_id int) (bytes int64, files int64, err error) {
+	err = db.QueryRow(`
+	WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM folders WHERE id = ? AND user_id = ? AND deleted_at IS NULL
+		UNION
+		SELECT f.id FROM folders f JOIN subtree s ON f.parent_folder_id = s.id
+		WHERE f.deleted_at IS NULL
+	)
+	SELECT COALESCE(SUM(size), 0), COUNT(*)
+	FROM files
+	WHERE folder_id IN (SELECT id FROM subtree)
+	AND deleted_at IS NULL`, folderId, user_id).Scan(&bytes, &files)
+	if err != nil {
+		logger.LogError("Error calculating folder size: %v", err)
+		return 0, 0, err
+	}
+	return bytes, files, nil
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 	"webserver/internal/logger"
 	"webserver/internal/models"
@@ -14,11 +15,31 @@ import (
 
 var db *sql.DB
 
+// filesColumns defines the files table, both for new databases and for
+// rebuilding the table of upgraded ones
+const filesColumns = `
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            user_id INTEGER NOT NULL,
+            file_name TEXT NOT NULL,
+            folder_id INTEGER NOT NULL,
+            blob_id INTEGER NOT NULL,
+            size INTEGER NOT NULL,
+            created_at TIMESTAMP,
+            deleted_at TIMESTAMP,
+            FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+            FOREIGN KEY (blob_id) REFERENCES blobs(id),
+            FOREIGN KEY (user_id) REFERENCES users(id)
+`
+
 type UserData struct {
+	// Username is only set for session requests
+	Username     string
 	PasswordHash string
 	APIKey       string
-	UserId       int
-	FolderId     int64
+	// KeyId identifies the API key a request was made with
+	KeyId    int64
+	UserId   int
+	FolderId int64
 }
 
 func InitDB() error {
@@ -57,6 +78,20 @@ func InitDB() error {
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         username TEXT NOT NULL UNIQUE,
         password_hash TEXT NOT NULL,
+        quota_bytes INTEGER,
+        quota_files INTEGER,
+        is_group INTEGER NOT NULL DEFAULT 0,
+        totp_secret TEXT,
+        totp_enabled INTEGER NOT NULL DEFAULT 0,
+        totp_last_step INTEGER NOT NULL DEFAULT 0,
+        totp_failures INTEGER NOT NULL DEFAULT 0,
+        totp_locked_until DATETIME,
+        oidc_issuer TEXT,
+        oidc_subject TEXT,
+        ldap_dn TEXT,
+        ldap_id TEXT,
+        email TEXT,
+        email_verified INTEGER NOT NULL DEFAULT 0,
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP
     );`
 
@@ -70,8 +105,14 @@ func InitDB() error {
 	CREATE TABLE IF NOT EXISTS keys ( 
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER NOT NULL,
-		key TEXT NOT NULL,
+		prefix TEXT NOT NULL DEFAULT '',
+		key_hash TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL DEFAULT 'admin',
+		folder_id INTEGER REFERENCES folders(id),
+		expires_at DATETIME,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);`
 
@@ -88,6 +129,7 @@ func InitDB() error {
             parent_folder_id INTEGER,
             folder_name TEXT NOT NULL,
 			created_at TIMESTAMP,
+			deleted_at TIMESTAMP,
             FOREIGN KEY (user_id) REFERENCES user(id),
             FOREIGN KEY (parent_folder_id) REFERENCES folders(id) ON DELETE CASCADE
 			);`
@@ -97,28 +139,237 @@ func InitDB() error {
 		return err
 	}
 
-	createFilesTable := `
-	        CREATE TABLE IF NOT EXISTS files (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            user_id INTEGER NOT NULL,
-            file_name TEXT NOT NULL,
-            folder_id INTEGER NOT NULL,
-            contents BLOB NOT NULL,
-            size INTEGER NOT NULL,
-            created_at TIMESTAMP,
-            FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
-            FOREIGN KEY (user_id) REFERENCES users(id)
-			);`
+	createBlobsTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sha256 TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		encoding TEXT NOT NULL DEFAULT '',
+		key_user_id INTEGER,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP,
+		FOREIGN KEY (key_user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createBlobsTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createDataKeysTable := `
+	CREATE TABLE IF NOT EXISTS data_keys (
+		user_id INTEGER PRIMARY KEY,
+		wrapped_key BLOB NOT NULL,
+		master_key_id TEXT NOT NULL,
+		created_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createDataKeysTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createFilesTable := "CREATE TABLE IF NOT EXISTS files (" + filesColumns + ");"
 	_, err = db.Exec(createFilesTable)
 	if err != nil {
 		logger.LogError("Failed to create table: %v", err)
 		return err
 	}
 
+	createFileVersionsTable := `
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		blob_id INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		created_at TIMESTAMP,
+		UNIQUE (file_id, version),
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+		FOREIGN KEY (blob_id) REFERENCES blobs(id)
+	);`
+	_, err = db.Exec(createFileVersionsTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createUploadsTable := `
+	CREATE TABLE IF NOT EXISTS uploads (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		folder_id INTEGER NOT NULL,
+		file_name TEXT NOT NULL,
+		length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		metadata TEXT,
+		created_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+	);`
+	_, err = db.Exec(createUploadsTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createShareLinksTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		file_id INTEGER,
+		folder_id INTEGER,
+		password_hash TEXT,
+		expires_at TIMESTAMP,
+		max_downloads INTEGER,
+		downloads INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		created_by INTEGER,
+		password_failures INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+		FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createShareLinksTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createGrantsTable := `
+	CREATE TABLE IF NOT EXISTS grants (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER,
+		folder_id INTEGER,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		granted_by INTEGER NOT NULL,
+		created_at TIMESTAMP,
+		FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+		FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (granted_by) REFERENCES users(id)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_grants_folder ON grants(folder_id, user_id) WHERE folder_id IS NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_grants_file ON grants(file_id, user_id) WHERE file_id IS NOT NULL;`
+	_, err = db.Exec(createGrantsTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createGroupMembersTable := `
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP,
+		PRIMARY KEY (group_id, user_id),
+		FOREIGN KEY (group_id) REFERENCES users(id),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createGroupMembersTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createSessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		csrf_token TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createSessionsTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createRecoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createRecoveryCodesTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createLoginChallengesTable := `
+	CREATE TABLE IF NOT EXISTS login_challenges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createLoginChallengesTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createOIDCLoginsTable := `
+	CREATE TABLE IF NOT EXISTS oidc_logins (
+		state_hash TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		verifier TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+	_, err = db.Exec(createOIDCLoginsTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	createEmailTokensTable := `
+	CREATE TABLE IF NOT EXISTS email_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		purpose TEXT NOT NULL,
+		email TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createEmailTokensTable)
+	if err != nil {
+		logger.LogError("Failed to create table: %v", err)
+		return err
+	}
+
+	if err := migrateSchema(); err != nil {
+		logger.LogError("Failed to migrate schema: %v", err)
+		return err
+	}
+
 	logger.LogInfo("Database initialization complete")
 	return nil
 }
 
+// DB returns the shared database handle for packages that keep their own
+// tables in auth.db, such as the SQLite blob store
+func DB() *sql.DB {
+	return db
+}
+
 func generateAPIKey() string {
 	// Generate a random API key
 	bytes := make([]byte, 32)
@@ -129,43 +380,35 @@ func generateAPIKey() string {
 	return hex.EncodeToString(bytes)
 }
 
-func CreateUser(username, passwordHash string) error {
+// CreateUser adds a user with an unverified email address, returning
+// their id. The address is only the user's once verified, so others may
+// have it too until then.
+func CreateUser(username, passwordHash, email string) (int, error) {
 	// Start the transaction
 	tx, err := db.Begin()
 	if err != nil {
 		logger.LogError("Failed to begin transaction: ", err)
-		return err
+		return 0, err
 	}
 	defer tx.Rollback()
 
-	result, err := tx.Exec("INSERT INTO users(username, password_hash) VALUES(?, ?)", username, passwordHash)
+	result, err := tx.Exec("INSERT INTO users(username, password_hash, email) VALUES(?, ?, ?)", username, passwordHash, email)
 	if err != nil {
 		logger.LogError("Failed to insert user: ", err)
-		return err
-	}
-
-	// Get the user ID
-	userID, err := result.LastInsertId()
-	if err != nil {
-		logger.LogError("failed to get user ID: %v", err)
-		return err
+		return 0, err
 	}
-
-	// Generate and insert API key
-	apiKey := generateAPIKey()
-	_, err = tx.Exec("INSERT INTO keys(user_id, key) VALUES(?, ?)",
-		userID, apiKey)
+	id, err := result.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("failed to create API key: %v", err)
+		return 0, err
 	}
 
 	// Commit the transaction
 	if err = tx.Commit(); err != nil {
 		logger.LogError("failed to commit transaction: %v", err)
-		return err
+		return 0, err
 	}
 
-	return err
+	return int(id), nil
 }
 
 func GetUser(username string) (UserData, error) {
@@ -174,12 +417,9 @@ func GetUser(username string) (UserData, error) {
 	err := db.QueryRow(`
 		SELECT 
 		CAST(u.id AS TEXT), 
-		u.password_hash, 
-		k.key 
+		u.password_hash
 		FROM users u 
-		LEFT JOIN keys k 
-		ON u.id = k.user_id
-		WHERE u.username = ?`, username).Scan(&userData.UserId, &userData.PasswordHash, &userData.APIKey)
+		WHERE u.username = ? AND u.is_group = 0`, username).Scan(&userData.UserId, &userData.PasswordHash)
 	if err != nil {
 		logger.LogError("Error retrieving user data: %v", err)
 		return UserData{}, err
@@ -233,45 +473,115 @@ func UsernameExists(username string) bool {
 	return exists
 }
 
+// GetUsername returns the name of the user user_id
+func GetUsername(user_id int) (string, error) {
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE id = ?", user_id).Scan(&username)
+	return username, err
+}
+
+// FilePath returns the path of a folder. Owners see the path from their
+// root folder; users a folder was shared with see it from the highest
+// folder shared with them.
 func FilePath(folderId int64, user_id int) (string, error) {
-	var filePath string
-	err := db.QueryRow(`    
-	WITH RECURSIVE directory_path(id, folder_name, path) AS (
-			SELECT id, folder_name, folder_name AS path 
-			FROM folders 
-			WHERE parent_folder_id IS NULL AND user_id = ?
-			UNION ALL
-			SELECT d.id, d.folder_name, dp.path || '/' || d.folder_name
-			FROM folders d
-			JOIN directory_path dp ON dp.id = d.parent_folder_id
-			WHERE d.user_id = ?
-		)
-		SELECT path FROM directory_path
-		WHERE id = ?;`, user_id, user_id, folderId).Scan(&filePath)
+	ancestors, err := folderAncestors(db, folderId)
 	if err != nil {
 		logger.LogError("Error getting file path: ", err)
 		return "", err
 	}
-	return filePath, nil
+
+	top := len(ancestors) - 1
+	if ancestors[0].userId != user_id {
+		ids := make([]int64, len(ancestors))
+		for i, a := range ancestors {
+			ids[i] = a.id
+		}
+		roles, _, err := grantedRoles(db, user_id, ids, 0)
+		if err != nil {
+			logger.LogError("Error getting file path: ", err)
+			return "", err
+		}
+		top = -1
+		for i, a := range ancestors {
+			if roles[a.id] != "" {
+				top = i
+			}
+		}
+		if top < 0 {
+			return "", sql.ErrNoRows
+		}
+	}
+
+	names := make([]string, 0, top+1)
+	for i := top; i >= 0; i-- {
+		names = append(names, ancestors[i].name)
+	}
+	return strings.Join(names, "/"), nil
 }
 
-func GetUserByAPIKey(apiKey string) (UserData, error) {
-	var userData UserData
-	err := db.QueryRow(`
+// GetUserByAPIKey finds the user an API key belongs to, along with the
+// key's restrictions. Keys are looked up by prefix and then checked
+// against their stored hash. Expired keys are not found.
+func GetUserByAPIKey(apiKey string) (UserData, models.APIKey, error) {
+	if len(apiKey) < keyPrefixLength {
+		return UserData{}, models.APIKey{}, sql.ErrNoRows
+	}
+	rows, err := db.Query(`
         SELECT 
 		u.id, 
-		k.key
+		k.id,
+		k.key_hash,
+		k.name,
+		k.scope,
+		COALESCE(k.folder_id, 0),
+		k.expires_at
         FROM users u
         JOIN keys k ON u.id = k.user_id
-        WHERE k.key = ?`, apiKey).Scan(&userData.UserId, &userData.APIKey)
+        WHERE k.prefix = ?
+		AND (k.expires_at IS NULL OR k.expires_at > ?)`, apiKey[:keyPrefixLength], time.Now())
 	if err != nil {
 		logger.LogError("Error retrieving user by API key: %v", err)
-		return userData, err
+		return UserData{}, models.APIKey{}, err
 	}
-	return userData, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var userData UserData
+		var key models.APIKey
+		var stored string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&userData.UserId, &key.Id, &stored, &key.Name, &key.Scope, &key.FolderId, &expiresAt); err != nil {
+			logger.LogError("Error retrieving user by API key: %v", err)
+			return UserData{}, models.APIKey{}, err
+		}
+		if keyMatches(apiKey, stored) {
+			rows.Close()
+			userData.APIKey = apiKey
+			userData.KeyId = key.Id
+			key.Hint = apiKey[:keyPrefixLength]
+			key.ExpiresAt = expiresAt.Time
+			touchAPIKey(key.Id)
+			return userData, key, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return UserData{}, models.APIKey{}, err
+	}
+	return UserData{}, models.APIKey{}, sql.ErrNoRows
 }
 
+// GetFiles lists the files in a folder the user owns or that was shared
+// with them
 func GetFiles(folderId int64, user_id int) ([]models.File, error) {
+	ownerId, _, err := FolderRole(folderId, user_id)
+	if err == sql.ErrNoRows {
+		return []models.File{}, nil
+	}
+	if err != nil {
+		logger.LogError("Error checking folder access: ", err)
+		return []models.File{}, err
+	}
+
 	rows, err := db.Query(`
 	SELECT 
 	id,
@@ -280,8 +590,9 @@ func GetFiles(folderId int64, user_id int) ([]models.File, error) {
 	created_at 
 	FROM files 
 	WHERE folder_id = ? 
-	AND user_id = ?`,
-		folderId, user_id)
+	AND user_id = ?
+	AND deleted_at IS NULL`,
+		folderId, ownerId)
 
 	if err != nil {
 		logger.LogError("Error retrieving files: ", err)
@@ -308,7 +619,18 @@ func GetFiles(folderId int64, user_id int) ([]models.File, error) {
 	return files, nil
 }
 
+// GetFolders lists the subfolders of a folder the user owns or that was
+// shared with them
 func GetFolders(folderId int64, user_id int) ([]models.Folder, error) {
+	ownerId, _, err := FolderRole(folderId, user_id)
+	if err == sql.ErrNoRows {
+		return []models.Folder{}, nil
+	}
+	if err != nil {
+		logger.LogError("Error checking folder access: ", err)
+		return []models.Folder{}, err
+	}
+
 	rows, err := db.Query(`
 	SELECT 
 	id,
@@ -317,8 +639,9 @@ func GetFolders(folderId int64, user_id int) ([]models.Folder, error) {
 	parent_folder_id
 	FROM folders 
 	WHERE parent_folder_id = ? 
-	AND user_id = ?`,
-		folderId, user_id)
+	AND user_id = ?
+	AND deleted_at IS NULL`,
+		folderId, ownerId)
 
 	if err != nil {
 		logger.LogError("Error retrieving folders: ", err)
@@ -345,43 +668,126 @@ func GetFolders(folderId int64, user_id int) ([]models.Folder, error) {
 	return folders, nil
 }
 
-func SaveFile(file models.UploadFile) error {
-	_, err := db.Exec(`
-        INSERT OR REPLACE INTO files (
+// FileExists reports whether the user has a file named fileName in the
+// folder, which an upload of that name adds a version to instead of a new
+// file
+func FileExists(folderId int64, fileName string, user_id int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM files
+		WHERE folder_id = ? AND file_name = ? AND user_id = ? AND deleted_at IS NULL)`,
+		folderId, fileName, user_id).Scan(&exists)
+	if err != nil {
+		logger.LogError("Error looking up file: %v", err)
+	}
+	return exists, err
+}
+
+// SaveFile records an uploaded file. Contents are deduplicated by hash:
+// reused reports whether an existing blob was linked instead of the one
+// under file.StorageKey, which the caller should then delete. Uploading a
+// name that already exists in the folder adds a new version of that file;
+// version is 0 when the contents match the current version and nothing
+// was recorded.
+func SaveFile(file models.UploadFile) (fileId int64, version int, reused bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, 0, false, err
+	}
+	defer tx.Rollback()
+
+	blobId, reused, err := linkBlob(tx, file)
+	if err != nil {
+		logger.LogError("Error linking blob: %v", err)
+		return 0, 0, false, err
+	}
+
+	var currentBlobId int64
+	err = tx.QueryRow("SELECT id, blob_id FROM files WHERE folder_id = ? AND file_name = ? AND user_id = ? AND deleted_at IS NULL",
+		file.FolderId, file.FileName, file.UserId).Scan(&fileId, &currentBlobId)
+	switch {
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(`
+        INSERT INTO files (
             user_id,
 			file_name,
             folder_id,
-            contents,
+            blob_id,
             size,
             created_at
         ) VALUES (?, ?, ?, ?, ?, ?)`,
-		file.UserId,
-		file.FileName,
-		file.FolderId,
-		file.Content,
-		file.Size,
-		file.CreatedAt,
-	)
-	return err
-}
+			file.UserId,
+			file.FileName,
+			file.FolderId,
+			blobId,
+			file.Size,
+			file.CreatedAt,
+		)
+		if err != nil {
+			logger.LogError("Error inserting file: %v", err)
+			return 0, 0, false, err
+		}
+		if fileId, err = result.LastInsertId(); err != nil {
+			return 0, 0, false, err
+		}
+	case err != nil:
+		logger.LogError("Error looking up file: %v", err)
+		return 0, 0, false, err
+	case currentBlobId == blobId:
+		// Same contents as the current version, so there is nothing new
+		// to keep. The blob was already stored, so the reference can go.
+		if _, err := releaseBlob(tx, blobId); err != nil {
+			return 0, 0, false, err
+		}
+		if err = tx.Commit(); err != nil {
+			logger.LogError("failed to commit transaction: %v", err)
+			return 0, 0, false, err
+		}
+		return fileId, 0, true, nil
+	}
 
+	version, err = addVersion(tx, fileId, blobId, file.Size, file.CreatedAt)
+	if err != nil {
+		logger.LogError("Error adding file version: %v", err)
+		return 0, 0, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, 0, false, err
+	}
+	return fileId, version, reused, nil
+}
 
+// GetFile returns a file the user owns or that was shared with them
 func GetFile(fileId int64, user_id int) (models.File, error) {
+	ownerId, _, err := FileRole(fileId, user_id)
+	if err != nil {
+		return models.File{}, err
+	}
+
 	var file models.File
-	err := db.QueryRow(`
+	err = db.QueryRow(`
 	SELECT 
-	id,
-	file_name,
-	size,
-	content,
-	created_at 
-	FROM files 
-	WHERE id = ? 
-	AND user_id = ?`,
-		fileId, user_id).Scan(&file.Id, &file.FileName, &file.Size, &file.CreatedAt)
+	f.id,
+	f.file_name,
+	f.size,
+	f.blob_id,
+	b.storage_key,
+	b.sha256,
+	b.encoding,
+	COALESCE(b.key_user_id, 0),
+	f.created_at 
+	FROM files f
+	JOIN blobs b ON b.id = f.blob_id
+	WHERE f.id = ? 
+	AND f.user_id = ?
+	AND f.deleted_at IS NULL`,
+		fileId, ownerId).Scan(&file.Id, &file.FileName, &file.Size, &file.BlobId, &file.StorageKey,
+		&file.Hash, &file.Encoding, &file.KeyUserId, &file.CreatedAt)
 	if err != nil {
 		logger.LogError("Error retrieving file: ", err)
 		return models.File{}, err
 	}
 	return file, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"webserver/internal/encryption"
+	"webserver/internal/logger"
+)
+
+// rowQuerier is implemented by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// UserDataKey returns the user's data key, creating one on first use
+func UserDataKey(user_id int) ([]byte, error) {
+	if !encryption.Enabled() {
+		return nil, errors.New("no master key is configured")
+	}
+	_, _, err := GetDataKey(user_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		dataKey, err := encryption.NewDataKey()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := encryption.WrapKey(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := CreateDataKey(user_id, wrapped, encryption.MasterKeyId()); err != nil {
+			return nil, err
+		}
+		logger.LogInfo("Created data key for user %d", user_id)
+	} else if err != nil {
+		return nil, fmt.Errorf("error retrieving data key: %v", err)
+	}
+	// Read back whichever key was stored in case another request created
+	// one at the same time
+	return openDataKey(db, user_id)
+}
+
+// openDataKey unwraps the user's existing data key
+func openDataKey(q rowQuerier, user_id int) ([]byte, error) {
+	if !encryption.Enabled() {
+		return nil, errors.New("no master key is configured")
+	}
+	var wrapped []byte
+	var masterKeyId string
+	err := q.QueryRow("SELECT wrapped_key, master_key_id FROM data_keys WHERE user_id = ?", user_id).
+		Scan(&wrapped, &masterKeyId)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving data key: %v", err)
+	}
+	if masterKeyId != encryption.MasterKeyId() {
+		return nil, fmt.Errorf("data key of user %d is wrapped by master key %s, configured key is %s",
+			user_id, masterKeyId, encryption.MasterKeyId())
+	}
+	return encryption.UnwrapKey(wrapped)
+}
+
+// GetDataKey returns a user's wrapped data key and the id of the master
+// key that wrapped it
+func GetDataKey(user_id int) (wrapped []byte, masterKeyId string, err error) {
+	err = db.QueryRow("SELECT wrapped_key, master_key_id FROM data_keys WHERE user_id = ?", user_id).
+		Scan(&wrapped, &masterKeyId)
+	return wrapped, masterKeyId, err
+}
+
+// CreateDataKey stores a wrapped data key for a user unless one already
+// exists, so concurrent first uploads settle on a single key
+func CreateDataKey(user_id int, wrapped []byte, masterKeyId string) error {
+	_, err := db.Exec(`
+	INSERT OR IGNORE INTO data_keys (user_id, wrapped_key, master_key_id, created_at)
+	VALUES (?, ?, ?, ?)`,
+		user_id, wrapped, masterKeyId, time.Now())
+	if err != nil {
+		logger.LogError("Error creating data key: %v", err)
+	}
+	return err
+}
+
+// RewrapDataKeys replaces every data key not yet wrapped by the master key
+// newKeyId with the result of rewrap, in a single transaction. File
+// contents are untouched since the data keys themselves do not change.
+func RewrapDataKeys(newKeyId string, rewrap func(wrapped []byte) ([]byte, error)) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT user_id, wrapped_key FROM data_keys WHERE master_key_id != ?", newKeyId)
+	if err != nil {
+		return 0, err
+	}
+	keys := make(map[int][]byte)
+	for rows.Next() {
+		var userId int
+		var wrapped []byte
+		if err := rows.Scan(&userId, &wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys[userId] = wrapped
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for userId, wrapped := range keys {
+		rewrapped, err := rewrap(wrapped)
+		if err != nil {
+			return 0, fmt.Errorf("error rewrapping data key of user %d: %v", userId, err)
+		}
+		_, err = tx.Exec("UPDATE data_keys SET wrapped_key = ?, master_key_id = ? WHERE user_id = ?",
+			rewrapped, newKeyId, userId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
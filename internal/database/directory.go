@@ -0,0 +1,92 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"webserver/internal/logger"
+)
+
+// DirectoryUser returns the name of the local user for a directory entry,
+// found by the entry's id so that moved and renamed entries keep their
+// user. The user is created the first time the entry logs in, without a
+// password. If username is taken by a local account it is linked when
+// link is set, which removes its password so only the directory can let
+// it in. ErrNameTaken is returned when the account can't be linked or
+// belongs to a different entry.
+func DirectoryUser(username, id, dn string, link bool) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var name, linkedDN string
+	err = tx.QueryRow("SELECT id, username, COALESCE(ldap_dn, '') FROM users WHERE ldap_id = ?", id).
+		Scan(&userID, &name, &linkedDN)
+	switch {
+	case err == nil:
+		// Entries can move within the directory, so keep the latest name
+		if linkedDN != dn {
+			if _, err = tx.Exec("UPDATE users SET ldap_dn = ? WHERE id = ?", dn, userID); err != nil {
+				logger.LogError("Error updating user: %v", err)
+				return "", err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			logger.LogError("failed to commit transaction: %v", err)
+			return "", err
+		}
+		return name, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return "", err
+	}
+
+	var isGroup bool
+	var linkedID, linked sql.NullString
+	err = tx.QueryRow("SELECT id, is_group, ldap_id, ldap_dn FROM users WHERE username = ?", username).
+		Scan(&userID, &isGroup, &linkedID, &linked)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec("INSERT INTO users (username, password_hash, ldap_id, ldap_dn) VALUES (?, '', ?, ?)",
+			username, id, dn)
+		if err != nil {
+			logger.LogError("Error creating user: %v", err)
+			return "", err
+		}
+		logger.LogInfo("Created user %s for %s", username, dn)
+	case err != nil:
+		return "", err
+	case linkedID.Valid:
+		logger.LogWarning("Refused login of %s: user %s belongs to another directory entry", dn, username)
+		return "", ErrNameTaken
+	case linked.Valid:
+		// Users linked before ids were kept are matched on their entry
+		// once, a different entry with the same name is refused
+		if linked.String != dn {
+			logger.LogWarning("Refused login of %s: user %s is linked to %s", dn, username, linked.String)
+			return "", ErrNameTaken
+		}
+		if _, err = tx.Exec("UPDATE users SET ldap_id = ? WHERE id = ?", id, userID); err != nil {
+			logger.LogError("Error updating user: %v", err)
+			return "", err
+		}
+	case isGroup || !link:
+		return "", ErrNameTaken
+	default:
+		_, err = tx.Exec("UPDATE users SET ldap_id = ?, ldap_dn = ?, password_hash = '' WHERE id = ?", id, dn, userID)
+		if err != nil {
+			logger.LogError("Error linking user: %v", err)
+			return "", err
+		}
+		logger.LogInfo("Linked user %s to %s", username, dn)
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return "", err
+	}
+	return username, nil
+}
@@ -0,0 +1,260 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"webserver/internal/logger"
+)
+
+// Purposes of the links sent by email
+const (
+	TokenVerifyEmail   = "verify"
+	TokenResetPassword = "reset"
+)
+
+// emailTokenInterval is how long a user has to wait between emails with
+// the same purpose, so the forms cannot be used to flood their inbox
+const emailTokenInterval = time.Minute
+
+var (
+	// ErrEmailTaken is returned when another user has verified the email
+	// address
+	ErrEmailTaken = errors.New("this email address is already in use")
+	// ErrInvalidToken is returned for links that are unknown, used or
+	// expired
+	ErrInvalidToken = errors.New("this link is invalid or has expired")
+	// ErrTokenRecent is returned when an email with the same purpose was
+	// sent less than emailTokenInterval ago
+	ErrTokenRecent = errors.New("an email was sent recently")
+)
+
+// emailTaken reports whether a user other than user_id has verified the
+// address. Unverified addresses claim nothing, so that nobody can keep an
+// address from its owner by registering with it.
+func emailTaken(tx *sql.Tx, email string, user_id int) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users
+		WHERE email = ? COLLATE NOCASE AND email_verified = 1 AND id != ?)`, email, user_id).
+		Scan(&taken)
+	return taken, err
+}
+
+// GetEmail returns the user's email address, "" if they have none, and
+// whether it has been verified
+func GetEmail(user_id int) (string, bool, error) {
+	var email sql.NullString
+	var verified bool
+	err := db.QueryRow("SELECT email, email_verified FROM users WHERE id = ?", user_id).Scan(&email, &verified)
+	if err != nil {
+		logger.LogError("Error retrieving email address: %v", err)
+		return "", false, err
+	}
+	return email.String, verified, nil
+}
+
+// PendingEmail returns the address the user asked to change to, which
+// becomes theirs once they follow the link sent to it, or "" if there is
+// none
+func PendingEmail(user_id int) (string, error) {
+	var email string
+	err := db.QueryRow(`
+	SELECT t.email FROM email_tokens t JOIN users u ON u.id = t.user_id
+	WHERE t.user_id = ? AND t.purpose = ? AND t.expires_at >= ?
+	AND (u.email IS NULL OR u.email != t.email COLLATE NOCASE)`,
+		user_id, TokenVerifyEmail, time.Now()).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return email, err
+}
+
+// EmailTaken reports whether a user other than user_id has verified the
+// address
+func EmailTaken(email string, user_id int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	return emailTaken(tx, email, user_id)
+}
+
+// CreateEmailToken returns a token for a link sent to email, replacing any
+// earlier token the user had for the same purpose. It returns
+// ErrTokenRecent if one was created less than emailTokenInterval ago. Only
+// a hash of the token is stored.
+func CreateEmailToken(user_id int, purpose, email string, ttl time.Duration) (string, error) {
+	token := generateAPIKey()
+	if token == "" {
+		return "", errors.New("could not generate token")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec("DELETE FROM email_tokens WHERE expires_at < ?", now); err != nil {
+		logger.LogError("Error removing expired email tokens: %v", err)
+		return "", err
+	}
+	var recent bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM email_tokens WHERE user_id = ? AND purpose = ? AND created_at > ?)",
+		user_id, purpose, now.Add(-emailTokenInterval)).Scan(&recent)
+	if err != nil {
+		return "", err
+	}
+	if recent {
+		return "", ErrTokenRecent
+	}
+	if _, err := tx.Exec("DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?", user_id, purpose); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO email_tokens (token_hash, user_id, purpose, email, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?)`, sha256Key(token), user_id, purpose, email, now, now.Add(ttl))
+	if err != nil {
+		logger.LogError("Error creating email token: %v", err)
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// takeEmailToken returns and forgets a token, so each link works once,
+// along with the address it was sent to
+func takeEmailToken(tx *sql.Tx, token, purpose string) (int, string, error) {
+	hash := sha256Key(token)
+	var userId int
+	var email string
+	err := tx.QueryRow("SELECT user_id, email FROM email_tokens WHERE token_hash = ? AND purpose = ? AND expires_at >= ?",
+		hash, purpose, time.Now()).Scan(&userId, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", ErrInvalidToken
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := tx.Exec("DELETE FROM email_tokens WHERE token_hash = ?", hash); err != nil {
+		return 0, "", err
+	}
+	return userId, email, nil
+}
+
+// VerifyEmail makes the address a verification link was sent to the
+// user's verified address, returning the user's name. It returns
+// ErrEmailTaken if someone else verified the address first.
+func VerifyEmail(token string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	userId, email, err := takeEmailToken(tx, token, TokenVerifyEmail)
+	if err != nil {
+		return "", err
+	}
+	taken, err := emailTaken(tx, email, userId)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrEmailTaken
+	}
+	if _, err := tx.Exec("UPDATE users SET email = ?, email_verified = 1 WHERE id = ?", email, userId); err != nil {
+		logger.LogError("Error verifying email address: %v", err)
+		return "", err
+	}
+	// Reset links sent to an old address stop working
+	if _, err := tx.Exec("DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?", userId, TokenResetPassword); err != nil {
+		return "", err
+	}
+	var username string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", userId).Scan(&username); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return "", err
+	}
+	return username, nil
+}
+
+// CheckResetToken reports whether a password reset link still works,
+// without using it up
+func CheckResetToken(token string) error {
+	var exists bool
+	err := db.QueryRow(`
+	SELECT EXISTS(SELECT 1 FROM email_tokens t JOIN users u ON u.id = t.user_id
+	WHERE t.token_hash = ? AND t.purpose = ? AND t.expires_at >= ? AND u.password_hash != '')`,
+		sha256Key(token), TokenResetPassword, time.Now()).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// ResetPassword sets a new password with a reset link, returning the
+// user's name. The user is logged out everywhere, since whoever knew the
+// old password may be logged in. Users who have since been linked to a
+// directory cannot be given a password this way.
+func ResetPassword(token, passwordHash string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	userId, _, err := takeEmailToken(tx, token, TokenResetPassword)
+	if err != nil {
+		return "", err
+	}
+	result, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ? AND password_hash != ''", passwordHash, userId)
+	if err != nil {
+		logger.LogError("Error resetting password: %v", err)
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return "", ErrInvalidToken
+	}
+	var username string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", userId).Scan(&username); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userId); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return "", err
+	}
+	return username, nil
+}
+
+// ResetUser finds the user who can reset their password with a link sent
+// to email, returning their id, name and address as stored. Only verified
+// addresses of users with a password, rather than single sign-on or
+// directory users, are found.
+func ResetUser(email string) (int, string, string, error) {
+	var userId int
+	var username, stored string
+	err := db.QueryRow(`
+	SELECT id, username, email FROM users
+	WHERE email = ? COLLATE NOCASE AND email_verified = 1 AND is_group = 0 AND password_hash != ''`, email).
+		Scan(&userId, &username, &stored)
+	return userId, username, stored, err
+}
@@ -0,0 +1,387 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// ErrCycle is returned when a folder would be moved or copied into itself
+// or one of its descendants
+var ErrCycle = errors.New("a folder cannot be moved or copied into itself")
+
+// ErrOtherDrive is returned when an item would be moved or copied into a
+// folder owned by a different user or group
+var ErrOtherDrive = errors.New("items can only be moved or copied within the same drive")
+
+// activeFolder checks that a folder belongs to the user and is not in the
+// trash, returning sql.ErrNoRows otherwise
+func activeFolder(tx *sql.Tx, folderId int64, user_id int) error {
+	var id int64
+	return tx.QueryRow("SELECT id FROM folders WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		folderId, user_id).Scan(&id)
+}
+
+// fileNameTaken reports whether another file in folderId outside the
+// trash is called name
+func fileNameTaken(tx *sql.Tx, folderId int64, name string, fileId int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM files
+		WHERE folder_id = ? AND file_name = ? AND id != ? AND deleted_at IS NULL
+	)`, folderId, name, fileId).Scan(&taken)
+	return taken, err
+}
+
+// folderNameTaken reports whether another folder in parentId outside the
+// trash is called name
+func folderNameTaken(tx *sql.Tx, parentId int64, name string, folderId int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM folders
+		WHERE parent_folder_id = ? AND folder_name = ? AND id != ? AND deleted_at IS NULL
+	)`, parentId, name, folderId).Scan(&taken)
+	return taken, err
+}
+
+// insideFolder reports whether folderId is ancestorId or one of its
+// descendants, by walking up from folderId
+func insideFolder(tx *sql.Tx, folderId, ancestorId int64) (bool, error) {
+	var inside bool
+	err := tx.QueryRow(`
+	WITH RECURSIVE ancestors(id, parent_folder_id) AS (
+		SELECT id, parent_folder_id FROM folders WHERE id = ?
+		UNION
+		SELECT f.id, f.parent_folder_id FROM folders f JOIN ancestors a ON f.id = a.parent_folder_id
+	)
+	SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = ?)`, folderId, ancestorId).Scan(&inside)
+	return inside, err
+}
+
+// CreateFolder adds a folder inside parentId
+func CreateFolder(user_id int, parentId int64, name string) (models.Folder, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return models.Folder{}, err
+	}
+	defer tx.Rollback()
+
+	if err := activeFolder(tx, parentId, user_id); err != nil {
+		return models.Folder{}, err
+	}
+	if taken, err := folderNameTaken(tx, parentId, name, 0); err != nil {
+		return models.Folder{}, err
+	} else if taken {
+		return models.Folder{}, ErrNameConflict
+	}
+
+	folder := models.Folder{UserId: user_id, FolderName: name, ParentId: parentId, CreatedAt: time.Now()}
+	result, err := tx.Exec("INSERT INTO folders (user_id, parent_folder_id, folder_name, created_at) VALUES (?, ?, ?, ?)",
+		user_id, parentId, name, folder.CreatedAt)
+	if err != nil {
+		logger.LogError("Error creating folder: %v", err)
+		return models.Folder{}, err
+	}
+	if folder.Id, err = result.LastInsertId(); err != nil {
+		return models.Folder{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return models.Folder{}, err
+	}
+	return folder, nil
+}
+
+// RenameFolder changes a folder's name. The root folder cannot be renamed.
+func RenameFolder(folderId int64, user_id int, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var parentId int64
+	err = tx.QueryRow(`
+	SELECT parent_folder_id FROM folders
+	WHERE id = ? AND user_id = ? AND parent_folder_id IS NOT NULL AND deleted_at IS NULL`,
+		folderId, user_id).Scan(&parentId)
+	if err != nil {
+		return err
+	}
+	if taken, err := folderNameTaken(tx, parentId, name, folderId); err != nil {
+		return err
+	} else if taken {
+		return ErrNameConflict
+	}
+
+	if _, err := tx.Exec("UPDATE folders SET folder_name = ? WHERE id = ?", name, folderId); err != nil {
+		logger.LogError("Error renaming folder: %v", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// MoveFolder moves a folder and its contents into targetId, which must not
+// be the folder itself or one of its descendants
+func MoveFolder(folderId int64, user_id int, targetId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow(`
+	SELECT folder_name FROM folders
+	WHERE id = ? AND user_id = ? AND parent_folder_id IS NOT NULL AND deleted_at IS NULL`,
+		folderId, user_id).Scan(&name)
+	if err != nil {
+		return err
+	}
+	if err := activeFolder(tx, targetId, user_id); err != nil {
+		return err
+	}
+
+	if cycle, err := insideFolder(tx, targetId, folderId); err != nil {
+		logger.LogError("Error checking folder ancestry: %v", err)
+		return err
+	} else if cycle {
+		return ErrCycle
+	}
+
+	if taken, err := folderNameTaken(tx, targetId, name, folderId); err != nil {
+		return err
+	} else if taken {
+		return ErrNameConflict
+	}
+
+	if _, err := tx.Exec("UPDATE folders SET parent_folder_id = ? WHERE id = ?", targetId, folderId); err != nil {
+		logger.LogError("Error moving folder: %v", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RenameFile changes a file's name
+func RenameFile(fileId int64, user_id int, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var folderId int64
+	err = tx.QueryRow("SELECT folder_id FROM files WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		fileId, user_id).Scan(&folderId)
+	if err != nil {
+		return err
+	}
+	if taken, err := fileNameTaken(tx, folderId, name, fileId); err != nil {
+		return err
+	} else if taken {
+		return ErrNameConflict
+	}
+
+	if _, err := tx.Exec("UPDATE files SET file_name = ? WHERE id = ?", name, fileId); err != nil {
+		logger.LogError("Error renaming file: %v", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// MoveFile moves a file into targetId
+func MoveFile(fileId int64, user_id int, targetId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow("SELECT file_name FROM files WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		fileId, user_id).Scan(&name)
+	if err != nil {
+		return err
+	}
+	if err := activeFolder(tx, targetId, user_id); err != nil {
+		return err
+	}
+	if taken, err := fileNameTaken(tx, targetId, name, fileId); err != nil {
+		return err
+	} else if taken {
+		return ErrNameConflict
+	}
+
+	if _, err := tx.Exec("UPDATE files SET folder_id = ? WHERE id = ?", targetId, fileId); err != nil {
+		logger.LogError("Error moving file: %v", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetFolder returns a folder outside the trash that the user owns or that
+// was shared with them
+func GetFolder(folderId int64, user_id int) (models.Folder, error) {
+	ownerId, _, err := FolderRole(folderId, user_id)
+	if err != nil {
+		return models.Folder{}, err
+	}
+
+	var folder models.Folder
+	var parentId sql.NullInt64
+	err = db.QueryRow(`
+	SELECT id, user_id, folder_name, parent_folder_id
+	FROM folders
+	WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		folderId, ownerId).Scan(&folder.Id, &folder.UserId, &folder.FolderName, &parentId)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	folder.ParentId = parentId.Int64
+	return folder, nil
+}
+
+// GetFolderPaths lists all of a user's folders outside the trash with
+// their full paths, ordered by path
+func GetFolderPaths(user_id int) ([]models.FolderPath, error) {
+	rows, err := db.Query(`
+	WITH RECURSIVE directory_path(id, path) AS (
+		SELECT id, folder_name
+		FROM folders
+		WHERE parent_folder_id IS NULL AND user_id = ?
+		UNION ALL
+		SELECT d.id, dp.path || '/' || d.folder_name
+		FROM folders d
+		JOIN directory_path dp ON dp.id = d.parent_folder_id
+		WHERE d.deleted_at IS NULL
+	)
+	SELECT id, path FROM directory_path ORDER BY path`, user_id)
+	if err != nil {
+		logger.LogError("Error retrieving folder paths: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []models.FolderPath
+	for rows.Next() {
+		var p models.FolderPath
+		if err := rows.Scan(&p.Id, &p.Path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+// dedupeFolderNames renames folders that share a name with a sibling by
+// appending a number, so per-parent names can be made unique
+func dedupeFolderNames() error {
+	ids, err := queryIds(db, `
+	SELECT f.id FROM folders f
+	WHERE f.deleted_at IS NULL
+	AND f.parent_folder_id IS NOT NULL
+	AND EXISTS (
+		SELECT 1 FROM folders o
+		WHERE o.parent_folder_id = f.parent_folder_id
+		AND o.folder_name = f.folder_name
+		AND o.deleted_at IS NULL
+		AND o.id < f.id
+	)`)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var parentId int64
+		var name string
+		if err := db.QueryRow("SELECT parent_folder_id, folder_name FROM folders WHERE id = ?", id).
+			Scan(&parentId, &name); err != nil {
+			return err
+		}
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s (%d)", name, n)
+			var taken bool
+			err := db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM folders WHERE parent_folder_id = ? AND folder_name = ? AND deleted_at IS NULL)`,
+				parentId, candidate).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if !taken {
+				if _, err := db.Exec("UPDATE folders SET folder_name = ? WHERE id = ?", candidate, id); err != nil {
+					return err
+				}
+				logger.LogInfo("Renamed duplicate folder %d to %s", id, candidate)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// EnsureFolder returns the folder called name inside parentId, creating it
+// if there is none
+func EnsureFolder(user_id int, parentId int64, name string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := activeFolder(tx, parentId, user_id); err != nil {
+		return 0, err
+	}
+	var folderId int64
+	err = tx.QueryRow("SELECT id FROM folders WHERE parent_folder_id = ? AND folder_name = ? AND deleted_at IS NULL",
+		parentId, name).Scan(&folderId)
+	if err == nil {
+		return folderId, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO folders (user_id, parent_folder_id, folder_name, created_at) VALUES (?, ?, ?, ?)",
+		user_id, parentId, name, time.Now())
+	if err != nil {
+		logger.LogError("Error creating folder: %v", err)
+		return 0, err
+	}
+	if folderId, err = result.LastInsertId(); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	return folderId, nil
+}
@@ -0,0 +1,341 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+var (
+	// ErrForbidden is returned when a user can see an item but their role
+	// does not allow the operation
+	ErrForbidden = errors.New("permission denied")
+	// ErrUnknownUser is returned when sharing with a username that does
+	// not exist
+	ErrUnknownUser = errors.New("no such user")
+	// ErrGrantOwner is returned when sharing an item with its owner
+	ErrGrantOwner = errors.New("the owner already has access")
+)
+
+// ancestor is a folder on the way from some folder up to its root
+type ancestor struct {
+	id     int64
+	name   string
+	userId int
+	root   bool
+}
+
+// folderAncestors returns a folder followed by its parents up to the root.
+// It returns sql.ErrNoRows if the folder or any of its parents is missing
+// or in the trash.
+func folderAncestors(q querier, folderId int64) ([]ancestor, error) {
+	rows, err := q.Query(`
+	WITH RECURSIVE ancestors(id, name, user_id, parent_id, depth) AS (
+		SELECT id, folder_name, user_id, parent_folder_id, 0
+		FROM folders
+		WHERE id = ? AND deleted_at IS NULL
+		UNION ALL
+		SELECT f.id, f.folder_name, f.user_id, f.parent_folder_id, a.depth + 1
+		FROM folders f
+		JOIN ancestors a ON f.id = a.parent_id
+		WHERE f.deleted_at IS NULL
+	)
+	SELECT id, name, user_id, parent_id IS NULL FROM ancestors ORDER BY depth`, folderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ancestors []ancestor
+	for rows.Next() {
+		var a ancestor
+		if err := rows.Scan(&a.id, &a.name, &a.userId, &a.root); err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ancestors) == 0 || !ancestors[len(ancestors)-1].root {
+		return nil, sql.ErrNoRows
+	}
+	return ancestors, nil
+}
+
+// grantedRoles returns the roles granted to a user, directly or through a
+// group they belong to, on any of the given folders and on fileId if it is
+// not 0
+func grantedRoles(q querier, user_id int, folderIds []int64, fileId int64) (folders map[int64]models.Role, file models.Role, err error) {
+	args := []any{user_id, user_id, fileId}
+	for _, id := range folderIds {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(folderIds)), ",")
+	rows, err := q.Query(`
+	SELECT COALESCE(folder_id, 0), role
+	FROM grants
+	WHERE (user_id = ? OR user_id IN (SELECT group_id FROM group_members WHERE user_id = ?))
+	AND (file_id = ? OR folder_id IN (`+placeholders+`))`, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	folders = make(map[int64]models.Role)
+	for rows.Next() {
+		var folderId int64
+		var role models.Role
+		if err := rows.Scan(&folderId, &role); err != nil {
+			return nil, "", err
+		}
+		if folderId == 0 {
+			if role.Rank() > file.Rank() {
+				file = role
+			}
+		} else if role.Rank() > folders[folderId].Rank() {
+			folders[folderId] = role
+		}
+	}
+	return folders, file, rows.Err()
+}
+
+// itemRole works out a user's role on folderId, or on fileId inside it if
+// fileId is not 0. Owners have RoleOwner; everyone else has the highest of
+// their role in the group owning the item and the roles granted on the
+// item or any folder above it. It returns sql.ErrNoRows if the user has no
+// access.
+func itemRole(q querier, user_id int, folderId, fileId int64) (ownerId int, role models.Role, err error) {
+	ancestors, err := folderAncestors(q, folderId)
+	if err != nil {
+		return 0, "", err
+	}
+	ownerId = ancestors[0].userId
+	if ownerId == user_id {
+		return ownerId, models.RoleOwner, nil
+	}
+
+	ids := make([]int64, len(ancestors))
+	for i, a := range ancestors {
+		ids[i] = a.id
+	}
+	member, err := groupRole(q, ownerId, user_id)
+	if err != nil {
+		return 0, "", err
+	}
+	folders, file, err := grantedRoles(q, user_id, ids, fileId)
+	if err != nil {
+		return 0, "", err
+	}
+	role = member
+	if file.Rank() > role.Rank() {
+		role = file
+	}
+	for _, r := range folders {
+		if r.Rank() > role.Rank() {
+			role = r
+		}
+	}
+	if role.Rank() == 0 {
+		return 0, "", sql.ErrNoRows
+	}
+	return ownerId, role, nil
+}
+
+// FolderRole returns who owns a folder and the user's role on it, or
+// sql.ErrNoRows if the user cannot access it
+func FolderRole(folderId int64, user_id int) (ownerId int, role models.Role, err error) {
+	return itemRole(db, user_id, folderId, 0)
+}
+
+// FileRole returns who owns a file and the user's role on it, or
+// sql.ErrNoRows if the user cannot access it
+func FileRole(fileId int64, user_id int) (ownerId int, role models.Role, err error) {
+	var folderId int64
+	err = db.QueryRow("SELECT folder_id FROM files WHERE id = ? AND deleted_at IS NULL", fileId).Scan(&folderId)
+	if err != nil {
+		return 0, "", err
+	}
+	return itemRole(db, user_id, folderId, fileId)
+}
+
+// grantItemRole returns the user's role on the file or folder a grant is
+// for
+func grantItemRole(grant models.Grant, user_id int) (ownerId int, role models.Role, err error) {
+	if grant.IsFolder() {
+		return FolderRole(grant.FolderId, user_id)
+	}
+	return FileRole(grant.FileId, user_id)
+}
+
+// SaveGrant gives the user called username a role on grant's file or
+// folder, replacing any role they had on it. Only users with RoleOwner on
+// the item can share it.
+func SaveGrant(grant models.Grant, username string) error {
+	ownerId, role, err := grantItemRole(grant, grant.GrantedBy)
+	if err != nil {
+		return err
+	}
+	if !role.Allows(models.RoleOwner) {
+		return ErrForbidden
+	}
+
+	err = db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&grant.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if grant.UserId == ownerId {
+		return ErrGrantOwner
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	item, id := "file_id", grant.FileId
+	if grant.IsFolder() {
+		item, id = "folder_id", grant.FolderId
+	}
+	result, err := tx.Exec("UPDATE grants SET role = ?, granted_by = ? WHERE "+item+" = ? AND user_id = ?",
+		grant.Role, grant.GrantedBy, id, grant.UserId)
+	if err != nil {
+		logger.LogError("Error updating grant: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO grants ("+item+", user_id, role, granted_by, created_at) VALUES (?, ?, ?, ?, ?)",
+			id, grant.UserId, grant.Role, grant.GrantedBy, time.Now())
+		if err != nil {
+			logger.LogError("Error creating grant: %v", err)
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetGrants lists who a file or folder is shared with directly. Only users
+// with RoleOwner on the item can see them.
+func GetGrants(folderId, fileId int64, user_id int) ([]models.Grant, error) {
+	_, role, err := grantItemRole(models.Grant{FolderId: folderId, FileId: fileId}, user_id)
+	if err != nil {
+		return nil, err
+	}
+	if !role.Allows(models.RoleOwner) {
+		return nil, ErrForbidden
+	}
+
+	rows, err := db.Query(`
+	SELECT g.id, COALESCE(g.file_id, 0), COALESCE(g.folder_id, 0), g.user_id, u.username, g.role, g.granted_by, g.created_at
+	FROM grants g
+	JOIN users u ON u.id = g.user_id
+	WHERE (g.folder_id = ? OR g.file_id = ?)
+	ORDER BY u.username`,
+		sql.NullInt64{Int64: folderId, Valid: folderId != 0},
+		sql.NullInt64{Int64: fileId, Valid: fileId != 0})
+	if err != nil {
+		logger.LogError("Error retrieving grants: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []models.Grant
+	for rows.Next() {
+		var g models.Grant
+		if err := rows.Scan(&g.Id, &g.FileId, &g.FolderId, &g.UserId, &g.Username, &g.Role, &g.GrantedBy, &g.CreatedAt); err != nil {
+			logger.LogError("Error scanning grant: %v", err)
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// RevokeGrant removes a grant. Users with RoleOwner on the item can revoke
+// any grant on it, and users can always give up their own. It returns the
+// grant that was removed.
+func RevokeGrant(id int64, user_id int) (models.Grant, error) {
+	var grant models.Grant
+	err := db.QueryRow("SELECT id, COALESCE(file_id, 0), COALESCE(folder_id, 0), user_id FROM grants WHERE id = ?", id).
+		Scan(&grant.Id, &grant.FileId, &grant.FolderId, &grant.UserId)
+	if err != nil {
+		return grant, err
+	}
+	if grant.UserId != user_id {
+		_, role, err := grantItemRole(grant, user_id)
+		if err != nil {
+			return grant, err
+		}
+		if !role.Allows(models.RoleOwner) {
+			return grant, ErrForbidden
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM grants WHERE id = ?", id); err != nil {
+		logger.LogError("Error revoking grant: %v", err)
+		return grant, err
+	}
+	return grant, nil
+}
+
+// GetSharedWithMe lists the files and folders shared with the user or
+// with a group they belong to, leaving out anything that is in the trash.
+// Username is whoever the item was shared with.
+func GetSharedWithMe(user_id int) ([]models.Grant, error) {
+	rows, err := db.Query(`
+	SELECT g.id, COALESCE(g.file_id, 0), COALESCE(g.folder_id, 0), g.user_id, u.username, g.role, g.granted_by, g.created_at,
+	COALESCE(f.file_name, d.folder_name), o.username
+	FROM grants g
+	JOIN users u ON u.id = g.user_id
+	LEFT JOIN files f ON f.id = g.file_id AND f.deleted_at IS NULL
+	LEFT JOIN folders d ON d.id = g.folder_id AND d.deleted_at IS NULL
+	JOIN users o ON o.id = COALESCE(f.user_id, d.user_id)
+	WHERE (g.user_id = ? OR g.user_id IN (SELECT group_id FROM group_members WHERE user_id = ?))
+	ORDER BY o.username, 9`, user_id, user_id)
+	if err != nil {
+		logger.LogError("Error retrieving shared items: %v", err)
+		return nil, err
+	}
+	var grants []models.Grant
+	for rows.Next() {
+		var g models.Grant
+		if err := rows.Scan(&g.Id, &g.FileId, &g.FolderId, &g.UserId, &g.Username, &g.Role, &g.GrantedBy, &g.CreatedAt,
+			&g.Name, &g.Owner); err != nil {
+			rows.Close()
+			logger.LogError("Error scanning shared item: %v", err)
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Items inside a trashed folder are only implicitly trashed
+	shared := grants[:0]
+	for _, g := range grants {
+		_, _, err := grantItemRole(g, user_id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, g)
+	}
+	return shared, nil
+}
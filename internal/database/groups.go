@@ -0,0 +1,276 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// A group is stored as a row in users with is_group set and no password,
+// so it cannot log in. Its team drive is that account's root folder, which
+// means everything in the drive is owned, counted against quotas and
+// encrypted like a user's files, while access comes from group_members.
+
+var (
+	// ErrNameTaken is returned when creating a group whose name is
+	// already used by a user or another group
+	ErrNameTaken = errors.New("a user or group with this name already exists")
+	// ErrLastOwner is returned when a change would leave a group without
+	// an owner
+	ErrLastOwner = errors.New("a group needs at least one owner")
+)
+
+// groupRole returns the user's role in a group, or "" if accountId is not
+// a group the user belongs to
+func groupRole(q querier, accountId, user_id int) (models.Role, error) {
+	rows, err := q.Query("SELECT role FROM group_members WHERE group_id = ? AND user_id = ?", accountId, user_id)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var role models.Role
+	if rows.Next() {
+		if err := rows.Scan(&role); err != nil {
+			return "", err
+		}
+	}
+	return role, rows.Err()
+}
+
+// AccountRole returns the user's role on everything owned by accountId:
+// RoleOwner for their own account, their membership role for a group and
+// "" otherwise
+func AccountRole(accountId, user_id int) (models.Role, error) {
+	if accountId == user_id {
+		return models.RoleOwner, nil
+	}
+	return groupRole(db, accountId, user_id)
+}
+
+// CreateGroup creates a group with the user as its owner, along with the
+// root folder of its team drive
+func CreateGroup(name string, user_id int) (models.Group, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return models.Group{}, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", name).Scan(&taken); err != nil {
+		return models.Group{}, err
+	}
+	if taken {
+		return models.Group{}, ErrNameTaken
+	}
+
+	now := time.Now()
+	result, err := tx.Exec("INSERT INTO users (username, password_hash, is_group) VALUES (?, '', 1)", name)
+	if err != nil {
+		logger.LogError("Error creating group: %v", err)
+		return models.Group{}, err
+	}
+	groupId, err := result.LastInsertId()
+	if err != nil {
+		return models.Group{}, err
+	}
+	_, err = tx.Exec("INSERT INTO group_members (group_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		groupId, user_id, models.RoleOwner, now)
+	if err != nil {
+		logger.LogError("Error adding group owner: %v", err)
+		return models.Group{}, err
+	}
+	result, err = tx.Exec("INSERT INTO folders (user_id, parent_folder_id, folder_name, created_at) VALUES (?, NULL, ?, ?)",
+		groupId, name, now)
+	if err != nil {
+		logger.LogError("Error creating team drive: %v", err)
+		return models.Group{}, err
+	}
+	rootId, err := result.LastInsertId()
+	if err != nil {
+		return models.Group{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return models.Group{}, err
+	}
+	return models.Group{Id: int(groupId), Name: name, RootId: rootId, Role: models.RoleOwner, Members: 1, CreatedAt: now}, nil
+}
+
+const groupQuery = `
+	SELECT g.id, g.username, COALESCE(r.id, 0), m.role, g.created_at,
+	(SELECT COUNT(*) FROM group_members c WHERE c.group_id = g.id)
+	FROM group_members m
+	JOIN users g ON g.id = m.group_id AND g.is_group = 1
+	LEFT JOIN folders r ON r.user_id = g.id AND r.parent_folder_id IS NULL
+	WHERE m.user_id = ?`
+
+func scanGroup(row interface{ Scan(...any) error }) (models.Group, error) {
+	var group models.Group
+	err := row.Scan(&group.Id, &group.Name, &group.RootId, &group.Role, &group.CreatedAt, &group.Members)
+	return group, err
+}
+
+// GetGroups lists the groups the user belongs to
+func GetGroups(user_id int) ([]models.Group, error) {
+	rows, err := db.Query(groupQuery+" ORDER BY g.username", user_id)
+	if err != nil {
+		logger.LogError("Error retrieving groups: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []models.Group
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			logger.LogError("Error scanning group: %v", err)
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// GetGroup returns a group the user belongs to, or sql.ErrNoRows
+func GetGroup(groupId, user_id int) (models.Group, error) {
+	return scanGroup(db.QueryRow(groupQuery+" AND g.id = ?", user_id, groupId))
+}
+
+// GetGroupMembers lists the members of a group the user belongs to
+func GetGroupMembers(groupId, user_id int) ([]models.GroupMember, error) {
+	role, err := groupRole(db, groupId, user_id)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := db.Query(`
+	SELECT m.user_id, u.username, m.role, m.created_at
+	FROM group_members m
+	JOIN users u ON u.id = m.user_id
+	WHERE m.group_id = ?
+	ORDER BY u.username`, groupId)
+	if err != nil {
+		logger.LogError("Error retrieving group members: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []models.GroupMember
+	for rows.Next() {
+		var member models.GroupMember
+		if err := rows.Scan(&member.UserId, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			logger.LogError("Error scanning group member: %v", err)
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// memberChange checks that by may change the membership of user_id in a
+// group: owners can change anyone, and members can leave. A change that
+// takes away the last owner is refused.
+func memberChange(tx *sql.Tx, groupId, user_id, by int, newRole models.Role) error {
+	role, err := groupRole(tx, groupId, by)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return sql.ErrNoRows
+	}
+	if role != models.RoleOwner && !(user_id == by && newRole == "") {
+		return ErrForbidden
+	}
+
+	current, err := groupRole(tx, groupId, user_id)
+	if err != nil {
+		return err
+	}
+	if current == models.RoleOwner && newRole != models.RoleOwner {
+		var owners int
+		err := tx.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND role = ?",
+			groupId, models.RoleOwner).Scan(&owners)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return ErrLastOwner
+		}
+	}
+	return nil
+}
+
+// SaveGroupMember adds the user called username to a group as role, or
+// changes their role. Only group owners can do this.
+func SaveGroupMember(groupId int, username string, role models.Role, by int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var user_id int
+	err = tx.QueryRow("SELECT id FROM users WHERE username = ? AND is_group = 0", username).Scan(&user_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if err := memberChange(tx, groupId, user_id, by, role); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO group_members (group_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (group_id, user_id) DO UPDATE SET role = excluded.role`,
+		groupId, user_id, role, time.Now())
+	if err != nil {
+		logger.LogError("Error saving group member: %v", err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RemoveGroupMember takes a user out of a group. Owners can remove anyone
+// and members can remove themselves.
+func RemoveGroupMember(groupId, user_id, by int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := memberChange(tx, groupId, user_id, by, ""); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupId, user_id)
+	if err != nil {
+		logger.LogError("Error removing group member: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// WebKeyName is the name given to keys made before keys had names, when
+// the web interface used the user's only key
+const WebKeyName = "web"
+
+// keyPrefixLength is how many characters of a key are stored in the clear.
+// The prefix finds the key's row and tells keys apart in listings.
+const keyPrefixLength = 8
+
+// lastUsedInterval limits how often a key's last use is written, so that
+// busy keys do not cause a write on every request
+const lastUsedInterval = time.Minute
+
+// Stored key hashes start with the scheme that produced them, so that keys
+// hashed before a secret was configured keep working
+const (
+	schemeSHA256 = "sha256:"
+	schemeHMAC   = "hmac-sha256:"
+)
+
+// apiKeySecret is the server secret API keys are hashed with, or nil to
+// use plain SHA-256
+var apiKeySecret []byte
+
+// SetAPIKeySecret sets the secret new API keys are hashed with. It must be
+// called before InitDB so that migrated keys use it too.
+func SetAPIKeySecret(secret []byte) {
+	apiKeySecret = secret
+}
+
+// hashAPIKey returns the hash stored for a new key
+func hashAPIKey(key string) string {
+	if apiKeySecret != nil {
+		return schemeHMAC + hmacKey(key)
+	}
+	return schemeSHA256 + sha256Key(key)
+}
+
+func sha256Key(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacKey(key string) string {
+	mac := hmac.New(sha256.New, apiKeySecret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyMatches reports whether key hashes to stored, in constant time
+func keyMatches(key, stored string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(stored, schemeHMAC):
+		if apiKeySecret == nil {
+			logger.LogError("API key hashed with a secret but API_KEY_SECRET is not set")
+			return false
+		}
+		expected = schemeHMAC + hmacKey(key)
+	case strings.HasPrefix(stored, schemeSHA256):
+		expected = schemeSHA256 + sha256Key(key)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(stored)) == 1
+}
+
+// CreateAPIKey generates a new API key for the user with the name, scope,
+// folder and expiry of key. Only its prefix and hash are stored, so this
+// is the one time the key is available.
+func CreateAPIKey(user_id int, key models.APIKey) (models.APIKey, string, error) {
+	secret := generateAPIKey()
+	if secret == "" {
+		return models.APIKey{}, "", errors.New("could not generate API key")
+	}
+	key.Hint = secret[:keyPrefixLength]
+	key.CreatedAt = time.Now()
+	result, err := db.Exec(`
+	INSERT INTO keys (user_id, prefix, key_hash, name, scope, folder_id, expires_at, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user_id, key.Hint, hashAPIKey(secret), key.Name, key.Scope,
+		sql.NullInt64{Int64: key.FolderId, Valid: key.FolderId != 0},
+		sql.NullTime{Time: key.ExpiresAt, Valid: !key.ExpiresAt.IsZero()},
+		key.CreatedAt)
+	if err != nil {
+		logger.LogError("Error creating API key: %v", err)
+		return models.APIKey{}, "", err
+	}
+	if key.Id, err = result.LastInsertId(); err != nil {
+		return models.APIKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// GetAPIKeys lists the user's API keys, newest first, including expired
+// ones until they are revoked
+func GetAPIKeys(user_id int) ([]models.APIKey, error) {
+	rows, err := db.Query(`
+	SELECT id, name, prefix, scope, COALESCE(folder_id, 0), expires_at, created_at, last_used_at
+	FROM keys
+	WHERE user_id = ?
+	ORDER BY created_at DESC, id DESC`, user_id)
+	if err != nil {
+		logger.LogError("Error retrieving API keys: %v", err)
+		return nil, err
+	}
+
+	var keys []models.APIKey
+	for rows.Next() {
+		var key models.APIKey
+		var expiresAt, lastUsed sql.NullTime
+		if err := rows.Scan(&key.Id, &key.Name, &key.Hint, &key.Scope, &key.FolderId, &expiresAt,
+			&key.CreatedAt, &lastUsed); err != nil {
+			rows.Close()
+			logger.LogError("Error scanning API key: %v", err)
+			return nil, err
+		}
+		key.ExpiresAt = expiresAt.Time
+		key.LastUsedAt = lastUsed.Time
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if key.FolderId == 0 {
+			continue
+		}
+		path, err := FilePath(key.FolderId, user_id)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Keys restricted to a folder that is gone or no longer
+			// shared match nothing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys[i].FolderPath = path
+	}
+	return keys, nil
+}
+
+// WithinFolder reports whether folderId, or the file fileId if it is not
+// 0, is rootId or somewhere below it
+func WithinFolder(folderId, fileId, rootId int64) (bool, error) {
+	if fileId != 0 {
+		err := db.QueryRow("SELECT folder_id FROM files WHERE id = ?", fileId).Scan(&folderId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	ancestors, err := folderAncestors(db, folderId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, a := range ancestors {
+		if a.id == rootId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RevokeAPIKey deletes one of the user's API keys, or returns
+// sql.ErrNoRows
+func RevokeAPIKey(id int64, user_id int) error {
+	result, err := db.Exec("DELETE FROM keys WHERE id = ? AND user_id = ?", id, user_id)
+	if err != nil {
+		logger.LogError("Error revoking API key: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// touchAPIKey records that a key was just used
+func touchAPIKey(id int64) {
+	now := time.Now()
+	_, err := db.Exec("UPDATE keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		now, id, now.Add(-lastUsedInterval))
+	if err != nil {
+		logger.LogError("Error recording API key use: %v", err)
+	}
+}
@@ -0,0 +1,495 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"webserver/internal/logger"
+	"webserver/internal/models"
+	"webserver/internal/storage"
+)
+
+// columnExists reports whether table has a column with the given name
+func columnExists(table, column string) (bool, error) {
+	_, exists, err := columnNotNull(table, column)
+	return exists, err
+}
+
+// columnNotNull reports whether a column of table is declared NOT NULL,
+// and whether the column exists at all
+func columnNotNull(table, column string) (bool, bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue any
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, false, err
+		}
+		if name == column {
+			return notNull == 1, true, nil
+		}
+	}
+	return false, false, rows.Err()
+}
+
+// addColumn adds a column to an existing table unless it is already there.
+// Tables created by InitDB include the column; this brings older databases
+// up to date.
+func addColumn(table, column, definition string) error {
+	exists, err := columnExists(table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	logger.LogInfo("Adding column %s.%s", table, column)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// migrateSchema adds columns introduced after a table was first created
+func migrateSchema() error {
+	if err := addColumn("users", "quota_bytes", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "quota_files", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "is_group", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "totp_secret", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "totp_failures", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "totp_locked_until", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "oidc_issuer", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "oidc_subject", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_issuer, oidc_subject)
+		WHERE oidc_subject IS NOT NULL`); err != nil {
+		return err
+	}
+	if err := addColumn("users", "ldap_dn", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "ldap_id", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_ldap_id ON users(ldap_id)
+		WHERE ldap_id IS NOT NULL`); err != nil {
+		return err
+	}
+	if err := addColumn("users", "email", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn("users", "email_verified", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Only verified addresses are unique, see emailTaken
+	if _, err := db.Exec("DROP INDEX IF EXISTS idx_users_email"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_verified_email ON users(email COLLATE NOCASE)
+		WHERE email IS NOT NULL AND email_verified = 1`); err != nil {
+		return err
+	}
+	if err := addColumn("share_links", "created_by", "INTEGER REFERENCES users(id)"); err != nil {
+		return err
+	}
+	if err := addColumn("share_links", "password_failures", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("share_links", "locked_until", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "name", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "last_used_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "prefix", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "key_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_keys_prefix ON keys(prefix)"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "scope", "TEXT NOT NULL DEFAULT 'admin'"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "folder_id", "INTEGER REFERENCES folders(id)"); err != nil {
+		return err
+	}
+	if err := addColumn("keys", "expires_at", "DATETIME"); err != nil {
+		return err
+	}
+	// Keys made before they had names are the ones created at
+	// registration for the web interface
+	if _, err := db.Exec("UPDATE keys SET name = ? WHERE name = ''", WebKeyName); err != nil {
+		return err
+	}
+	if err := addColumn("files", "deleted_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumn("folders", "deleted_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	// File names only need to be unique outside the trash; MigrateVersions
+	// creates the replacement index
+	if _, err := db.Exec("DROP INDEX IF EXISTS idx_files_name"); err != nil {
+		return err
+	}
+	if err := addColumn("blobs", "encoding", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn("blobs", "key_user_id", "INTEGER REFERENCES users(id)"); err != nil {
+		return err
+	}
+
+	// Encrypted contents can only be shared between files of the user
+	// whose data key sealed them, so blobs are unique per hash and key.
+	// This replaces the original index on sha256 alone.
+	if _, err := db.Exec("DROP INDEX IF EXISTS idx_blobs_sha256"); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_blobs_content ON blobs(sha256, COALESCE(key_user_id, 0))")
+	if err != nil {
+		return err
+	}
+
+	// Purging the trash used to leave grants and share links on the
+	// purged items behind, which would apply to new items given the same
+	// id
+	for _, table := range []string{"grants", "share_links"} {
+		_, err = db.Exec(`
+		DELETE FROM ` + table + `
+		WHERE (file_id IS NOT NULL AND file_id NOT IN (SELECT id FROM files))
+		OR (folder_id IS NOT NULL AND folder_id NOT IN (SELECT id FROM folders))`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Folder names are unique per parent outside the trash
+	if err := dedupeFolderNames(); err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_active_name ON folders(parent_folder_id, folder_name)
+	WHERE deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	// Databases from before deduplication keep a storage key and hash on
+	// each file until MigrateBlobs moves them into the blobs table
+	dedup, err := columnExists("files", "blob_id")
+	if err != nil {
+		return err
+	}
+	if !dedup {
+		if err := addColumn("files", "storage_key", "TEXT"); err != nil {
+			return err
+		}
+		if err := addColumn("files", "sha256", "TEXT"); err != nil {
+			return err
+		}
+		if err := addColumn("files", "blob_id", "INTEGER REFERENCES blobs(id)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// queryIds runs a query returning a single id column and collects the
+// results. The pool only has one connection, so callers gather ids first
+// and close the rows before running other statements.
+func queryIds(q querier, query string, args ...any) ([]int64, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// MigrateAPIKeys replaces the plaintext keys of older databases with their
+// prefix and hash, then drops the legacy keys.key column. It is a no-op
+// once the column is gone.
+func MigrateAPIKeys() error {
+	legacy, err := columnExists("keys", "key")
+	if err != nil {
+		logger.LogError("Error inspecting keys table: %v", err)
+		return err
+	}
+	if !legacy {
+		return nil
+	}
+
+	logger.LogInfo("Hashing stored API keys...")
+	rows, err := db.Query("SELECT id, key FROM keys WHERE key_hash = ''")
+	if err != nil {
+		return err
+	}
+	keys := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys[id] = key
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, key := range keys {
+		if len(key) < keyPrefixLength {
+			// Too short to have been issued by this server
+			if _, err := tx.Exec("DELETE FROM keys WHERE id = ?", id); err != nil {
+				return err
+			}
+			continue
+		}
+		_, err := tx.Exec("UPDATE keys SET prefix = ?, key_hash = ? WHERE id = ?",
+			key[:keyPrefixLength], hashAPIKey(key), id)
+		if err != nil {
+			return fmt.Errorf("error hashing API key %d: %v", id, err)
+		}
+	}
+	if _, err := tx.Exec("ALTER TABLE keys DROP COLUMN key"); err != nil {
+		logger.LogError("Failed to drop key column: %v", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.LogInfo("Hashed %d API keys", len(keys))
+	return nil
+}
+
+// MigrateFileContents moves file bytes out of the legacy files.contents
+// column into the blob store and records the storage key on each row.
+// It is a no-op once the column is gone.
+func MigrateFileContents(store storage.BlobStore) error {
+	legacy, err := columnExists("files", "contents")
+	if err != nil {
+		logger.LogError("Error inspecting files table: %v", err)
+		return err
+	}
+	if !legacy {
+		return nil
+	}
+
+	logger.LogInfo("Migrating file contents into the blob store...")
+	ids, err := queryIds(db, "SELECT id FROM files WHERE storage_key IS NULL")
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var contents []byte
+		if err := db.QueryRow("SELECT contents FROM files WHERE id = ?", id).Scan(&contents); err != nil {
+			return fmt.Errorf("error reading contents of file %d: %v", id, err)
+		}
+		key := storage.NewKey()
+		if _, err := store.Put(context.Background(), key, bytes.NewReader(contents)); err != nil {
+			return fmt.Errorf("error storing contents of file %d: %v", id, err)
+		}
+		hash := sha256.Sum256(contents)
+		_, err := db.Exec("UPDATE files SET storage_key = ?, sha256 = ? WHERE id = ?",
+			key, hex.EncodeToString(hash[:]), id)
+		if err != nil {
+			return fmt.Errorf("error updating file %d: %v", id, err)
+		}
+	}
+
+	if _, err := db.Exec("ALTER TABLE files DROP COLUMN contents"); err != nil {
+		logger.LogError("Failed to drop contents column: %v", err)
+		return err
+	}
+	logger.LogInfo("Migrated %d files into the blob store", len(ids))
+	return nil
+}
+
+// MigrateBlobs links files that still carry their own storage key to a
+// row in the blobs table, merging files with identical contents into one
+// blob. It is a no-op once files.storage_key is gone.
+func MigrateBlobs(store storage.BlobStore) error {
+	legacy, err := columnExists("files", "storage_key")
+	if err != nil {
+		logger.LogError("Error inspecting files table: %v", err)
+		return err
+	}
+	if !legacy {
+		return rebuildFiles()
+	}
+
+	logger.LogInfo("Deduplicating stored files...")
+	ids, err := queryIds(db, "SELECT id FROM files WHERE blob_id IS NULL")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, id := range ids {
+		var key, hash string
+		var size int64
+		err := db.QueryRow("SELECT storage_key, COALESCE(sha256, ''), size FROM files WHERE id = ?", id).
+			Scan(&key, &hash, &size)
+		if err != nil {
+			return fmt.Errorf("error reading file %d: %v", id, err)
+		}
+
+		// Files stored before uploads were hashed need their hash computed
+		if hash == "" {
+			hash, err = hashBlob(ctx, store, key)
+			if err != nil {
+				return fmt.Errorf("error hashing file %d: %v", id, err)
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		blobId, reused, err := linkBlob(tx, models.UploadFile{Hash: hash, StorageKey: key, Size: size})
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error linking file %d: %v", id, err)
+		}
+		if _, err := tx.Exec("UPDATE files SET blob_id = ? WHERE id = ?", blobId, id); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error updating file %d: %v", id, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		// The contents already live under another key
+		if reused {
+			if err := store.Delete(ctx, key); err != nil {
+				logger.LogError("Error removing duplicate blob %s: %v", key, err)
+			}
+		}
+	}
+
+	logger.LogInfo("Linked %d files to deduplicated blobs", len(ids))
+	return rebuildFiles()
+}
+
+// rebuildFiles recreates the files table of an upgraded database with the
+// columns and constraints of a new one, dropping the legacy storage_key
+// and sha256 columns and making blob_id NOT NULL. Columns added with
+// ALTER TABLE cannot be given those constraints in place. It is a no-op
+// once blob_id is NOT NULL.
+func rebuildFiles() error {
+	notNull, _, err := columnNotNull("files", "blob_id")
+	if err != nil {
+		logger.LogError("Error inspecting files table: %v", err)
+		return err
+	}
+	if notNull {
+		return nil
+	}
+
+	var missing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE blob_id IS NULL").Scan(&missing); err != nil {
+		return err
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d files have no stored contents, cannot rebuild the files table", missing)
+	}
+
+	logger.LogInfo("Rebuilding the files table...")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Indexes go with the old table; MigrateVersions recreates the one on
+	// file names
+	statements := []string{
+		"CREATE TABLE files_rebuilt (" + filesColumns + ")",
+		`INSERT INTO files_rebuilt (id, user_id, file_name, folder_id, blob_id, size, created_at, deleted_at)
+		SELECT id, user_id, file_name, folder_id, blob_id, size, created_at, deleted_at FROM files`,
+		"DROP TABLE files",
+		"ALTER TABLE files_rebuilt RENAME TO files",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			logger.LogError("Failed to rebuild files table: %v", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func hashBlob(ctx context.Context, store storage.BlobStore, key string) (string, error) {
+	contents, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer contents.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, contents); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// oidcLoginLifetime is how long a user has to sign in at the provider
+const oidcLoginLifetime = 10 * time.Minute
+
+// SaveOIDCLogin remembers the nonce and PKCE verifier of a sign-in that
+// was sent to the provider with state
+func SaveOIDCLogin(state, nonce, verifier string) error {
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM oidc_logins WHERE created_at < ?", now.Add(-oidcLoginLifetime)); err != nil {
+		logger.LogError("Error removing expired sign-ins: %v", err)
+		return err
+	}
+	_, err := db.Exec("INSERT INTO oidc_logins (state_hash, nonce, verifier, created_at) VALUES (?, ?, ?, ?)",
+		sha256Key(state), nonce, verifier, now)
+	if err != nil {
+		logger.LogError("Error saving sign-in: %v", err)
+	}
+	return err
+}
+
+// TakeOIDCLogin returns and forgets the sign-in started with state, so a
+// callback can only be used once. It returns sql.ErrNoRows for unknown or
+// expired states.
+func TakeOIDCLogin(state string) (nonce, verifier string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	hash := sha256Key(state)
+	err = tx.QueryRow("SELECT nonce, verifier FROM oidc_logins WHERE state_hash = ? AND created_at >= ?",
+		hash, time.Now().Add(-oidcLoginLifetime)).Scan(&nonce, &verifier)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := tx.Exec("DELETE FROM oidc_logins WHERE state_hash = ?", hash); err != nil {
+		return "", "", err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return "", "", err
+	}
+	return nonce, verifier, nil
+}
+
+// OIDCUser returns the name of the user linked to a provider account,
+// creating the user called username the first time the account signs in.
+// Before that, an unlinked local account whose verified email address is
+// linkEmail, or else the one called linkName, is linked instead; both come
+// from claims the provider vouches for and are empty when linking is off.
+// If username is taken ErrNameTaken is returned. Users created this way
+// have no password.
+func OIDCUser(issuer, subject, username, linkName, linkEmail string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var existing string
+	err = tx.QueryRow("SELECT username FROM users WHERE oidc_issuer = ? AND oidc_subject = ?", issuer, subject).
+		Scan(&existing)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	var id int
+	const unlinked = "SELECT id, username FROM users WHERE is_group = 0 AND oidc_subject IS NULL"
+	switch {
+	case linkEmail != "":
+		err = tx.QueryRow(unlinked+" AND email = ? COLLATE NOCASE AND email_verified = 1", linkEmail).
+			Scan(&id, &existing)
+	case linkName != "":
+		err = tx.QueryRow(unlinked+" AND username = ?", linkName).Scan(&id, &existing)
+	default:
+		err = sql.ErrNoRows
+	}
+	switch {
+	case err == nil:
+		_, err = tx.Exec("UPDATE users SET oidc_issuer = ?, oidc_subject = ? WHERE id = ?", issuer, subject, id)
+		if err != nil {
+			logger.LogError("Error linking user: %v", err)
+			return "", err
+		}
+		logger.LogInfo("Linked user %s to %s at %s", existing, subject, issuer)
+		username = existing
+	case !errors.Is(err, sql.ErrNoRows):
+		return "", err
+	default:
+		var taken bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return "", ErrNameTaken
+		}
+		_, err = tx.Exec("INSERT INTO users (username, password_hash, oidc_issuer, oidc_subject) VALUES (?, '', ?, ?)",
+			username, issuer, subject)
+		if err != nil {
+			logger.LogError("Error creating user: %v", err)
+			return "", err
+		}
+		logger.LogInfo("Created user %s for %s at %s", username, subject, issuer)
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return "", err
+	}
+	return username, nil
+}
+
+// SyncGroupRoles makes the user's membership of each group in managed
+// match roles, adding, changing or removing it. Groups outside managed are
+// left alone, as are missing groups and changes that would leave a group
+// without an owner.
+func SyncGroupRoles(user_id int, roles map[string]models.Role, managed []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, name := range managed {
+		var groupId int
+		err := tx.QueryRow("SELECT id FROM users WHERE username = ? AND is_group = 1", name).Scan(&groupId)
+		if errors.Is(err, sql.ErrNoRows) {
+			logger.LogWarning("Role mapping names group %s, which does not exist", name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		current, err := groupRole(tx, groupId, user_id)
+		if err != nil {
+			return err
+		}
+		role := roles[name]
+		if role == current {
+			continue
+		}
+		if current == models.RoleOwner {
+			var owners int
+			err := tx.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND role = ?",
+				groupId, models.RoleOwner).Scan(&owners)
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				logger.LogWarning("Keeping user %d as the last owner of group %s", user_id, name)
+				continue
+			}
+		}
+
+		if role == "" {
+			_, err = tx.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupId, user_id)
+		} else {
+			_, err = tx.Exec(`
+			INSERT INTO group_members (group_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (group_id, user_id) DO UPDATE SET role = excluded.role`,
+				groupId, user_id, role, now)
+		}
+		if err != nil {
+			logger.LogError("Error updating membership of group %s: %v", name, err)
+			return err
+		}
+		logger.LogInfo("Set role of user %d in group %s to %q", user_id, name, role)
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
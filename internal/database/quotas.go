@@ -0,0 +1,49 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// GetQuota returns a user's storage limits and usage. Limits left NULL in
+// the users table fall back to defaultBytes and defaultFiles.
+func GetQuota(user_id int, defaultBytes, defaultFiles int64) (models.Quota, error) {
+	var maxBytes, maxFiles sql.NullInt64
+	err := db.QueryRow("SELECT quota_bytes, quota_files FROM users WHERE id = ?", user_id).Scan(&maxBytes, &maxFiles)
+	if err != nil {
+		logger.LogError("Error retrieving quota: %v", err)
+		return models.Quota{}, err
+	}
+
+	quota := models.Quota{MaxBytes: defaultBytes, MaxFiles: defaultFiles}
+	if maxBytes.Valid {
+		quota.MaxBytes = maxBytes.Int64
+	}
+	if maxFiles.Valid {
+		quota.MaxFiles = maxFiles.Int64
+	}
+
+	quota.UsedBytes, quota.UsedFiles, err = StorageUsage(user_id)
+	if err != nil {
+		return models.Quota{}, err
+	}
+	return quota, nil
+}
+
+// SetQuota sets a user's limits. A NULL limit falls back to the
+// configured default.
+func SetQuota(username string, maxBytes, maxFiles sql.NullInt64) error {
+	result, err := db.Exec("UPDATE users SET quota_bytes = ?, quota_files = ? WHERE username = ?",
+		maxBytes, maxFiles, username)
+	if err != nil {
+		logger.LogError("Error setting quota: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %s not found", username)
+	}
+	return nil
+}
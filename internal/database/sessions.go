@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// Sessions end after sessionIdle without a request, or sessionMaxAge after
+// login, whichever comes first
+var (
+	sessionIdle   = 2 * time.Hour
+	sessionMaxAge = 24 * time.Hour
+)
+
+// SetSessionTimeouts sets how long sessions last when idle and at most
+func SetSessionTimeouts(idle, maxAge time.Duration) {
+	sessionIdle = idle
+	sessionMaxAge = maxAge
+}
+
+// sessionCutoffs returns the earliest login and last request times of
+// sessions that are still valid
+func sessionCutoffs() (created, seen time.Time) {
+	now := time.Now()
+	return now.Add(-sessionMaxAge), now.Add(-sessionIdle)
+}
+
+// CreateSession logs the user in, returning the token for their cookie.
+// Like API keys, only a hash of the token is stored. Sessions that have
+// timed out are removed at the same time.
+func CreateSession(user_id int) (string, models.Session, error) {
+	token := generateAPIKey()
+	csrf := generateAPIKey()
+	if token == "" || csrf == "" {
+		return "", models.Session{}, errors.New("could not generate session token")
+	}
+
+	created, seen := sessionCutoffs()
+	if _, err := db.Exec("DELETE FROM sessions WHERE created_at < ? OR last_seen_at < ?", created, seen); err != nil {
+		logger.LogError("Error removing expired sessions: %v", err)
+		return "", models.Session{}, err
+	}
+
+	now := time.Now()
+	session := models.Session{UserId: user_id, CSRFToken: csrf, CreatedAt: now, LastSeenAt: now}
+	result, err := db.Exec(`
+	INSERT INTO sessions (token_hash, user_id, csrf_token, created_at, last_seen_at)
+	VALUES (?, ?, ?, ?, ?)`, sha256Key(token), user_id, csrf, now, now)
+	if err != nil {
+		logger.LogError("Error creating session: %v", err)
+		return "", models.Session{}, err
+	}
+	if session.Id, err = result.LastInsertId(); err != nil {
+		return "", models.Session{}, err
+	}
+	return token, session, nil
+}
+
+// GetUserBySession finds the user a session token belongs to and records
+// the request against the idle timeout. Sessions that have timed out are
+// not found.
+func GetUserBySession(token string) (UserData, models.Session, error) {
+	var userData UserData
+	var session models.Session
+	created, seen := sessionCutoffs()
+	err := db.QueryRow(`
+	SELECT s.id, s.user_id, u.username, s.csrf_token, s.created_at, s.last_seen_at
+	FROM sessions s
+	JOIN users u ON u.id = s.user_id
+	WHERE s.token_hash = ? AND s.created_at >= ? AND s.last_seen_at >= ?`, sha256Key(token), created, seen).
+		Scan(&session.Id, &session.UserId, &userData.Username, &session.CSRFToken, &session.CreatedAt, &session.LastSeenAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.LogError("Error retrieving session: %v", err)
+		}
+		return UserData{}, models.Session{}, err
+	}
+	userData.UserId = session.UserId
+
+	// Like API key use, only write the time once a minute
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) >= lastUsedInterval {
+		if _, err := db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", now, session.Id); err != nil {
+			logger.LogError("Error recording session use: %v", err)
+		}
+		session.LastSeenAt = now
+	}
+	return userData, session, nil
+}
+
+// DeleteSession logs out the session with token
+func DeleteSession(token string) error {
+	if _, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", sha256Key(token)); err != nil {
+		logger.LogError("Error deleting session: %v", err)
+		return err
+	}
+	return nil
+}
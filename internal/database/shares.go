@@ -0,0 +1,182 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// shareLinkQuery selects share links that can still be used, together with
+// the name and size of the shared item. Links whose item was trashed or
+// deleted are left out.
+const shareLinkQuery = `
+	SELECT s.id, s.token, s.user_id, COALESCE(s.file_id, 0), COALESCE(s.folder_id, 0),
+	COALESCE(s.password_hash, ''), s.expires_at, COALESCE(s.max_downloads, 0), s.downloads, s.created_at,
+	COALESCE(f.file_name, d.folder_name), COALESCE(f.size, 0)
+	FROM share_links s
+	LEFT JOIN files f ON f.id = s.file_id AND f.user_id = s.user_id AND f.deleted_at IS NULL
+	LEFT JOIN folders d ON d.id = s.folder_id AND d.user_id = s.user_id AND d.deleted_at IS NULL
+	WHERE s.revoked_at IS NULL
+	AND (s.expires_at IS NULL OR s.expires_at > ?)
+	AND (f.id IS NOT NULL OR d.id IS NOT NULL)`
+
+// shareLinkUsable limits shareLinkQuery to links with downloads left
+const shareLinkUsable = " AND (s.max_downloads IS NULL OR s.downloads < s.max_downloads)"
+
+func scanShareLink(row interface{ Scan(...any) error }) (models.ShareLink, error) {
+	var link models.ShareLink
+	var expiresAt sql.NullTime
+	err := row.Scan(&link.Id, &link.Token, &link.UserId, &link.FileId, &link.FolderId,
+		&link.PasswordHash, &expiresAt, &link.MaxDownloads, &link.Downloads, &link.CreatedAt,
+		&link.Name, &link.Size)
+	link.ExpiresAt = expiresAt.Time
+	return link, err
+}
+
+// CreateShareLink stores a new share link for a file or folder outside the
+// trash owned by link.UserId
+func CreateShareLink(link models.ShareLink) (int64, error) {
+	var owned bool
+	var err error
+	if link.FolderId != 0 {
+		err = db.QueryRow("SELECT 1 FROM folders WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+			link.FolderId, link.UserId).Scan(&owned)
+	} else {
+		err = db.QueryRow("SELECT 1 FROM files WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+			link.FileId, link.UserId).Scan(&owned)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(`
+	INSERT INTO share_links (token, user_id, created_by, file_id, folder_id, password_hash, expires_at, max_downloads, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		link.Token, link.UserId, link.CreatedBy,
+		sql.NullInt64{Int64: link.FileId, Valid: link.FileId != 0},
+		sql.NullInt64{Int64: link.FolderId, Valid: link.FolderId != 0},
+		sql.NullString{String: link.PasswordHash, Valid: link.PasswordHash != ""},
+		sql.NullTime{Time: link.ExpiresAt, Valid: !link.ExpiresAt.IsZero()},
+		sql.NullInt64{Int64: int64(link.MaxDownloads), Valid: link.MaxDownloads > 0},
+		time.Now())
+	if err != nil {
+		logger.LogError("Error creating share link: %v", err)
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetShareLinks lists the share links the user created that can still be
+// used, newest first
+func GetShareLinks(user_id int) ([]models.ShareLink, error) {
+	rows, err := db.Query(shareLinkQuery+shareLinkUsable+" AND COALESCE(s.created_by, s.user_id) = ? ORDER BY s.created_at DESC", time.Now(), user_id)
+	if err != nil {
+		logger.LogError("Error retrieving share links: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []models.ShareLink
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			logger.LogError("Error scanning share link: %v", err)
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// GetShareLink returns the share link with the given token if it can
+// still be used, or sql.ErrNoRows. With started set a link that ran out of
+// downloads is returned too, for finishing the last one.
+func GetShareLink(token string, started bool) (models.ShareLink, error) {
+	query := shareLinkQuery
+	if !started {
+		query += shareLinkUsable
+	}
+	return scanShareLink(db.QueryRow(query+" AND s.token = ?", time.Now(), token))
+}
+
+// UseShareLink counts a download of a share link. It returns sql.ErrNoRows
+// if the link ran out of downloads, expired or was revoked in the
+// meantime.
+func UseShareLink(id int64) error {
+	result, err := db.Exec(`
+	UPDATE share_links SET downloads = downloads + 1
+	WHERE id = ?
+	AND revoked_at IS NULL
+	AND (expires_at IS NULL OR expires_at > ?)
+	AND (max_downloads IS NULL OR downloads < max_downloads)`,
+		id, time.Now())
+	if err != nil {
+		logger.LogError("Error counting share link download: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// A share link is locked for shareLinkLockout after shareLinkAttempts
+// wrong passwords in a row. Once the lock ends each further wrong password
+// locks it again, until the right one is given.
+const (
+	shareLinkAttempts = 5
+	shareLinkLockout  = 15 * time.Minute
+)
+
+// ErrShareLinkLocked is returned for password attempts on a locked share
+// link
+var ErrShareLinkLocked = errors.New("share link is locked after too many wrong passwords")
+
+// ShareLinkAttempt records a password attempt on a share link before the
+// password is checked, so that parallel guesses count too. It returns
+// ErrShareLinkLocked if the link is locked.
+func ShareLinkAttempt(id int64) error {
+	now := time.Now()
+	result, err := db.Exec(`
+	UPDATE share_links SET password_failures = password_failures + 1,
+	locked_until = CASE WHEN password_failures + 1 >= ? THEN ? ELSE locked_until END
+	WHERE id = ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		shareLinkAttempts, now.Add(shareLinkLockout), id, now)
+	if err != nil {
+		logger.LogError("Error recording share link password attempt: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrShareLinkLocked
+	}
+	return nil
+}
+
+// ShareLinkPasswordAccepted clears the failed password attempts of a
+// share link after the right password was given
+func ShareLinkPasswordAccepted(id int64) error {
+	_, err := db.Exec("UPDATE share_links SET password_failures = 0, locked_until = NULL WHERE id = ?", id)
+	if err != nil {
+		logger.LogError("Error resetting share link password attempts: %v", err)
+	}
+	return err
+}
+
+// RevokeShareLink stops a share link the user created from working
+func RevokeShareLink(id int64, user_id int) error {
+	result, err := db.Exec(`
+	UPDATE share_links SET revoked_at = ?
+	WHERE id = ? AND COALESCE(created_by, user_id) = ? AND revoked_at IS NULL`,
+		time.Now(), id, user_id)
+	if err != nil {
+		logger.LogError("Error revoking share link: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// ErrNameConflict is returned when an item would end up next to another
+// item of the same name
+var ErrNameConflict = errors.New("an item with this name already exists")
+
+// TrashFile moves a file into the trash. It keeps its folder so it can be
+// restored there.
+func TrashFile(fileId int64, user_id int) error {
+	result, err := db.Exec("UPDATE files SET deleted_at = ? WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		time.Now(), fileId, user_id)
+	if err != nil {
+		logger.LogError("Error trashing file: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TrashFolder moves a folder and, implicitly, everything inside it into
+// the trash. The root folder cannot be trashed.
+func TrashFolder(folderId int64, user_id int) error {
+	result, err := db.Exec(`
+	UPDATE folders SET deleted_at = ?
+	WHERE id = ?
+	AND user_id = ?
+	AND parent_folder_id IS NOT NULL
+	AND deleted_at IS NULL`,
+		time.Now(), folderId, user_id)
+	if err != nil {
+		logger.LogError("Error trashing folder: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetTrash lists the files and folders a user deleted, newest first.
+// Items inside a trashed folder are not listed separately.
+func GetTrash(user_id int) ([]models.File, []models.Folder, error) {
+	rows, err := db.Query(`
+	SELECT id, file_name, size, created_at, deleted_at
+	FROM files
+	WHERE user_id = ?
+	AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC`, user_id)
+	if err != nil {
+		logger.LogError("Error retrieving trashed files: %v", err)
+		return nil, nil, err
+	}
+	var files []models.File
+	for rows.Next() {
+		var file models.File
+		if err := rows.Scan(&file.Id, &file.FileName, &file.Size, &file.CreatedAt, &file.DeletedAt); err != nil {
+			rows.Close()
+			logger.LogError("Error scanning file: %v", err)
+			return nil, nil, err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.Query(`
+	SELECT id, user_id, folder_name, parent_folder_id, COALESCE(created_at, deleted_at), deleted_at
+	FROM folders
+	WHERE user_id = ?
+	AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC`, user_id)
+	if err != nil {
+		logger.LogError("Error retrieving trashed folders: %v", err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var folders []models.Folder
+	for rows.Next() {
+		var folder models.Folder
+		err := rows.Scan(&folder.Id, &folder.UserId, &folder.FolderName, &folder.ParentId,
+			&folder.CreatedAt, &folder.DeletedAt)
+		if err != nil {
+			logger.LogError("Error scanning folder: %v", err)
+			return nil, nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return files, folders, rows.Err()
+}
+
+// restoreTarget returns folderId if it and all its ancestors are still in
+// place, or the user's root folder otherwise
+func restoreTarget(tx *sql.Tx, folderId int64, user_id int) (int64, error) {
+	var trashed int
+	err := tx.QueryRow(`
+	WITH RECURSIVE ancestors(id, parent_folder_id, deleted_at) AS (
+		SELECT id, parent_folder_id, deleted_at FROM folders WHERE id = ? AND user_id = ?
+		UNION ALL
+		SELECT f.id, f.parent_folder_id, f.deleted_at
+		FROM folders f JOIN ancestors a ON f.id = a.parent_folder_id
+	)
+	SELECT
+	CASE WHEN COUNT(*) = 0 THEN 1 ELSE COUNT(deleted_at) END
+	FROM ancestors`, folderId, user_id).Scan(&trashed)
+	if err != nil {
+		return 0, err
+	}
+	if trashed == 0 {
+		return folderId, nil
+	}
+
+	var rootId int64
+	err = tx.QueryRow("SELECT id FROM folders WHERE user_id = ? AND parent_folder_id IS NULL", user_id).Scan(&rootId)
+	return rootId, err
+}
+
+// RestoreFile takes a file out of the trash and puts it back in its
+// folder, or in the root folder if that folder is gone or in the trash
+func RestoreFile(fileId int64, user_id int) (folderId int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var fileName string
+	err = tx.QueryRow("SELECT folder_id, file_name FROM files WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL",
+		fileId, user_id).Scan(&folderId, &fileName)
+	if err != nil {
+		return 0, err
+	}
+	if folderId, err = restoreTarget(tx, folderId, user_id); err != nil {
+		logger.LogError("Error finding restore target: %v", err)
+		return 0, err
+	}
+
+	if taken, err := fileNameTaken(tx, folderId, fileName, fileId); err != nil {
+		return 0, err
+	} else if taken {
+		return 0, ErrNameConflict
+	}
+
+	_, err = tx.Exec("UPDATE files SET folder_id = ?, deleted_at = NULL WHERE id = ?", folderId, fileId)
+	if err != nil {
+		logger.LogError("Error restoring file: %v", err)
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	return folderId, nil
+}
+
+// RestoreFolder takes a folder and its contents out of the trash, putting
+// it back under its parent or under the root folder if the parent is gone
+// or in the trash
+func RestoreFolder(folderId int64, user_id int) (parentId int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow("SELECT parent_folder_id, folder_name FROM folders WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL",
+		folderId, user_id).Scan(&parentId, &name)
+	if err != nil {
+		return 0, err
+	}
+	if parentId, err = restoreTarget(tx, parentId, user_id); err != nil {
+		logger.LogError("Error finding restore target: %v", err)
+		return 0, err
+	}
+	if taken, err := folderNameTaken(tx, parentId, name, folderId); err != nil {
+		return 0, err
+	} else if taken {
+		return 0, ErrNameConflict
+	}
+
+	_, err = tx.Exec("UPDATE folders SET parent_folder_id = ?, deleted_at = NULL WHERE id = ?", parentId, folderId)
+	if err != nil {
+		logger.LogError("Error restoring folder: %v", err)
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	return parentId, nil
+}
+
+// EmptyTrash permanently deletes everything in a user's trash
+func EmptyTrash(user_id int) (removed int, orphanKeys []string, err error) {
+	return purgeTrash("user_id = ?", user_id)
+}
+
+// PurgeTrash permanently deletes items of all users that were moved to
+// the trash before the given time
+func PurgeTrash(before time.Time) (removed int, orphanKeys []string, err error) {
+	return purgeTrash("deleted_at < ?", before)
+}
+
+// purgeTrash deletes trashed files and folders matching the condition,
+// including everything inside the folders. Storage keys of blobs that
+// are no longer referenced are returned for removal from the blob store.
+func purgeTrash(condition string, args ...any) (removed int, orphanKeys []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	folderIds, err := queryIds(tx, "SELECT id FROM folders WHERE deleted_at IS NOT NULL AND "+condition, args...)
+	if err != nil {
+		logger.LogError("Error finding trashed folders: %v", err)
+		return 0, nil, err
+	}
+	fileIds, err := queryIds(tx, "SELECT id FROM files WHERE deleted_at IS NOT NULL AND "+condition, args...)
+	if err != nil {
+		logger.LogError("Error finding trashed files: %v", err)
+		return 0, nil, err
+	}
+
+	// Trashed folders take their whole subtree with them. Subtrees can
+	// overlap when a folder was trashed inside one that was trashed later.
+	folders := make(map[int64]bool)
+	files := make(map[int64]bool)
+	for _, fileId := range fileIds {
+		files[fileId] = true
+	}
+	for _, folderId := range folderIds {
+		subtree, err := queryIds(tx, `
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT f.id FROM folders f JOIN subtree s ON f.parent_folder_id = s.id
+		)
+		SELECT id FROM subtree`, folderId)
+		if err != nil {
+			logger.LogError("Error listing folder %d: %v", folderId, err)
+			return 0, nil, err
+		}
+		for _, id := range subtree {
+			folders[id] = true
+			ids, err := queryIds(tx, "SELECT id FROM files WHERE folder_id = ?", id)
+			if err != nil {
+				return 0, nil, err
+			}
+			for _, fileId := range ids {
+				files[fileId] = true
+			}
+		}
+	}
+
+	for fileId := range files {
+		keys, err := deleteFile(tx, fileId)
+		if err != nil {
+			return 0, nil, err
+		}
+		orphanKeys = append(orphanKeys, keys...)
+	}
+	for folderId := range folders {
+		if _, err := tx.Exec("DELETE FROM grants WHERE folder_id = ?", folderId); err != nil {
+			logger.LogError("Error deleting grants on folder %d: %v", folderId, err)
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM share_links WHERE folder_id = ?", folderId); err != nil {
+			logger.LogError("Error deleting share links to folder %d: %v", folderId, err)
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM folders WHERE id = ?", folderId); err != nil {
+			logger.LogError("Error deleting folder %d: %v", folderId, err)
+			return 0, nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, nil, err
+	}
+	return len(files) + len(folders), orphanKeys, nil
+}
@@ -0,0 +1,512 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"webserver/internal/encryption"
+	"webserver/internal/logger"
+	"webserver/internal/models"
+	"webserver/internal/totp"
+)
+
+var (
+	// ErrInvalidCode is returned when a two-factor code or recovery code
+	// is wrong or was already used
+	ErrInvalidCode = errors.New("invalid two-factor code")
+	// ErrTwoFactorEnabled is returned when starting enrollment for a user
+	// who already has two-factor authentication
+	ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrTwoFactorDisabled is returned by changes that need two-factor
+	// authentication to be enabled
+	ErrTwoFactorDisabled = errors.New("two-factor authentication is not enabled")
+	// ErrTwoFactorLocked is returned while a user's codes are not checked
+	// after too many wrong ones
+	ErrTwoFactorLocked = errors.New("too many wrong two-factor codes, try again later")
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+// A login challenge is the step between a correct password and a correct
+// code. It only lasts challengeLifetime and allows challengeAttempts codes.
+const (
+	challengeLifetime = 5 * time.Minute
+	challengeAttempts = 5
+)
+
+// Codes are not checked for twoFactorLockout after twoFactorAttempts wrong
+// ones in a row, whichever login challenges they were given for. Once the
+// lock ends each further wrong code locks it again, until a right one is
+// given.
+const (
+	twoFactorAttempts = 5
+	twoFactorLockout  = 15 * time.Minute
+)
+
+// sealedSecretPrefix marks TOTP secrets sealed with the user's data key.
+// Secrets are base32, so plaintext ones never start with it.
+const sealedSecretPrefix = "sealed:"
+
+// sealSecret encrypts a TOTP secret with the user's data key, so that it
+// is not kept in the clear next to the password hash. Without a master key
+// the secret is stored as is.
+func sealSecret(user_id int, secret string) (string, error) {
+	if !encryption.Enabled() {
+		return secret, nil
+	}
+	dataKey, err := UserDataKey(user_id)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := encryption.Seal(dataKey, []byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return sealedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret returns the TOTP secret stored by sealSecret
+func openSecret(q rowQuerier, user_id int, stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedSecretPrefix)
+	if !ok {
+		return stored, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openDataKey(q, user_id)
+	if err != nil {
+		return "", err
+	}
+	secret, err := encryption.Open(dataKey, sealed)
+	if err != nil {
+		return "", fmt.Errorf("error opening TOTP secret of user %d: %v", user_id, err)
+	}
+	return string(secret), nil
+}
+
+// GetTwoFactor returns the user's two-factor settings
+func GetTwoFactor(user_id int) (models.TwoFactor, error) {
+	var status models.TwoFactor
+	err := db.QueryRow(`
+	SELECT totp_enabled, totp_secret IS NOT NULL AND totp_enabled = 0,
+	(SELECT COUNT(*) FROM recovery_codes r WHERE r.user_id = u.id AND r.used_at IS NULL)
+	FROM users u WHERE id = ?`, user_id).Scan(&status.Enabled, &status.Pending, &status.RecoveryCodes)
+	if err != nil {
+		logger.LogError("Error retrieving two-factor settings: %v", err)
+	}
+	return status, err
+}
+
+// StartTwoFactor generates a new TOTP secret for the user. It is not used
+// for logins until EnableTwoFactor confirms the user has added it to their
+// app.
+func StartTwoFactor(user_id int) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	stored, err := sealSecret(user_id, secret)
+	if err != nil {
+		logger.LogError("Error sealing TOTP secret: %v", err)
+		return "", err
+	}
+	result, err := db.Exec("UPDATE users SET totp_secret = ? WHERE id = ? AND totp_enabled = 0", stored, user_id)
+	if err != nil {
+		logger.LogError("Error saving TOTP secret: %v", err)
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", ErrTwoFactorEnabled
+	}
+	return secret, nil
+}
+
+// PendingTwoFactor returns the secret of an enrollment that has not been
+// confirmed yet, or sql.ErrNoRows
+func PendingTwoFactor(user_id int) (string, error) {
+	var stored string
+	err := db.QueryRow("SELECT totp_secret FROM users WHERE id = ? AND totp_enabled = 0 AND totp_secret IS NOT NULL",
+		user_id).Scan(&stored)
+	if err != nil {
+		return "", err
+	}
+	return openSecret(db, user_id, stored)
+}
+
+// EnableTwoFactor turns on two-factor authentication once code shows the
+// pending secret was set up correctly, and returns the user's recovery
+// codes. They are only stored hashed, so this is the one time they are
+// available.
+func EnableTwoFactor(user_id int, code string) ([]string, error) {
+	secret, err := PendingTwoFactor(user_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTwoFactorDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, user_id); err != nil {
+		logger.LogError("Error enabling two-factor authentication: %v", err)
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, user_id)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return nil, err
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a random code such as "k3j9q-x7m2a"
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, 7)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(buf))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode lets codes be typed without the dash or in capitals
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// replaceRecoveryCodes removes the user's recovery codes and stores a new
+// set, hashed like API keys
+func replaceRecoveryCodes(tx *sql.Tx, user_id int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user_id); err != nil {
+		logger.LogError("Error removing recovery codes: %v", err)
+		return nil, err
+	}
+	now := time.Now()
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			user_id, hashAPIKey(normalizeRecoveryCode(code)), now)
+		if err != nil {
+			logger.LogError("Error saving recovery code: %v", err)
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// verifyTwoFactor checks a code from the user's app, or one of their
+// recovery codes, which is then used up. App codes cannot be used twice
+// either. Wrong codes are counted in tx, which callers commit when
+// ErrInvalidCode is returned.
+func verifyTwoFactor(tx *sql.Tx, user_id int, code string) error {
+	var stored sql.NullString
+	var enabled bool
+	var lastStep int64
+	var lockedUntil sql.NullTime
+	err := tx.QueryRow("SELECT totp_secret, totp_enabled, totp_last_step, totp_locked_until FROM users WHERE id = ?",
+		user_id).Scan(&stored, &enabled, &lastStep, &lockedUntil)
+	if err != nil {
+		return err
+	}
+	if !enabled || !stored.Valid {
+		return ErrTwoFactorDisabled
+	}
+	now := time.Now()
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		logger.LogWarning("Two-factor code for locked user %d", user_id)
+		return ErrTwoFactorLocked
+	}
+	secret, err := openSecret(tx, user_id, stored.String)
+	if err != nil {
+		return err
+	}
+
+	err = checkTwoFactorCode(tx, user_id, secret, code, lastStep)
+	if errors.Is(err, ErrInvalidCode) {
+		_, err := tx.Exec(`
+		UPDATE users SET totp_failures = totp_failures + 1,
+		totp_locked_until = CASE WHEN totp_failures + 1 >= ? THEN ? ELSE totp_locked_until END
+		WHERE id = ?`, twoFactorAttempts, now.Add(twoFactorLockout), user_id)
+		if err != nil {
+			return err
+		}
+		return ErrInvalidCode
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET totp_failures = 0, totp_locked_until = NULL WHERE id = ?", user_id)
+	return err
+}
+
+// checkTwoFactorCode checks code against the TOTP secret and then the
+// user's unused recovery codes
+func checkTwoFactorCode(tx *sql.Tx, user_id int, secret, code string, lastStep int64) error {
+	if step, ok := totp.Validate(secret, code, time.Now(), lastStep); ok {
+		_, err := tx.Exec("UPDATE users SET totp_last_step = ? WHERE id = ?", step, user_id)
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", user_id)
+	if err != nil {
+		return err
+	}
+	normalized := normalizeRecoveryCode(code)
+	var used int64
+	for rows.Next() {
+		var id int64
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return err
+		}
+		if keyMatches(normalized, stored) {
+			used = id
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if used == 0 {
+		return ErrInvalidCode
+	}
+	logger.LogInfo("User %d used recovery code %d", user_id, used)
+	_, err = tx.Exec("UPDATE recovery_codes SET used_at = ? WHERE id = ?", time.Now(), used)
+	return err
+}
+
+// withTwoFactor runs change in a transaction after checking code
+func withTwoFactor(user_id int, code string, change func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := verifyTwoFactor(tx, user_id, code); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			// Keep the count of wrong codes
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication after checking a
+// current code or recovery code
+func DisableTwoFactor(user_id int, code string) error {
+	return withTwoFactor(user_id, code, func(tx *sql.Tx) error {
+		return clearTwoFactor(tx, user_id)
+	})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after
+// checking a current code or recovery code
+func RegenerateRecoveryCodes(user_id int, code string) ([]string, error) {
+	var codes []string
+	err := withTwoFactor(user_id, code, func(tx *sql.Tx) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user_id)
+		return err
+	})
+	return codes, err
+}
+
+func clearTwoFactor(tx *sql.Tx, user_id int) error {
+	_, err := tx.Exec(`
+	UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0, totp_failures = 0, totp_locked_until = NULL
+	WHERE id = ?`, user_id)
+	if err != nil {
+		logger.LogError("Error disabling two-factor authentication: %v", err)
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user_id); err != nil {
+		logger.LogError("Error removing recovery codes: %v", err)
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM login_challenges WHERE user_id = ?", user_id)
+	return err
+}
+
+// ResetTwoFactor turns off two-factor authentication for the user called
+// username without a code, for users who have lost their device and their
+// recovery codes. It also lifts a lock after too many wrong codes.
+func ResetTwoFactor(username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var user_id int
+	err = tx.QueryRow("SELECT id FROM users WHERE username = ? AND is_group = 0", username).Scan(&user_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if err := clearTwoFactor(tx, user_id); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// TwoFactorEnabled reports whether logins for the user need a code
+func TwoFactorEnabled(user_id int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", user_id).Scan(&enabled)
+	return enabled, err
+}
+
+// CreateLoginChallenge records that the user gave the right password and
+// returns a token for the second step of their login
+func CreateLoginChallenge(user_id int) (string, error) {
+	token := generateAPIKey()
+	if token == "" {
+		return "", errors.New("could not generate login challenge")
+	}
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM login_challenges WHERE created_at < ?", now.Add(-challengeLifetime)); err != nil {
+		logger.LogError("Error removing expired login challenges: %v", err)
+		return "", err
+	}
+	_, err := db.Exec("INSERT INTO login_challenges (token_hash, user_id, created_at) VALUES (?, ?, ?)",
+		sha256Key(token), user_id, now)
+	if err != nil {
+		logger.LogError("Error creating login challenge: %v", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// CompleteLoginChallenge checks the code given for a login challenge and
+// returns the user logging in. The challenge is used up by a correct code
+// or by too many wrong ones; it returns sql.ErrNoRows once it is gone.
+func CompleteLoginChallenge(token, code string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var user_id, attempts int
+	err = tx.QueryRow("SELECT id, user_id, attempts FROM login_challenges WHERE token_hash = ? AND created_at >= ?",
+		sha256Key(token), time.Now().Add(-challengeLifetime)).Scan(&id, &user_id, &attempts)
+	if err != nil {
+		return 0, err
+	}
+
+	err = verifyTwoFactor(tx, user_id, code)
+	switch {
+	case err == nil:
+		_, err = tx.Exec("DELETE FROM login_challenges WHERE id = ?", id)
+	case errors.Is(err, ErrInvalidCode) && attempts+1 >= challengeAttempts:
+		logger.LogWarning("Too many two-factor attempts for user %d", user_id)
+		if _, err := tx.Exec("DELETE FROM login_challenges WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, sql.ErrNoRows
+	case errors.Is(err, ErrInvalidCode):
+		if _, err := tx.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, ErrInvalidCode
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	return user_id, nil
+}
+
+// MigrateTOTPSecrets seals TOTP secrets stored in the clear, by older
+// versions or while no master key was configured. It is a no-op without a
+// master key.
+func MigrateTOTPSecrets() error {
+	if !encryption.Enabled() {
+		return nil
+	}
+	ids, err := queryIds(db, "SELECT id FROM users WHERE totp_secret IS NOT NULL AND totp_secret NOT LIKE ?",
+		sealedSecretPrefix+"%")
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	logger.LogInfo("Encrypting stored TOTP secrets...")
+	for _, id := range ids {
+		var secret string
+		if err := db.QueryRow("SELECT totp_secret FROM users WHERE id = ?", id).Scan(&secret); err != nil {
+			return err
+		}
+		stored, err := sealSecret(int(id), secret)
+		if err != nil {
+			return fmt.Errorf("error sealing TOTP secret of user %d: %v", id, err)
+		}
+		if _, err := db.Exec("UPDATE users SET totp_secret = ? WHERE id = ? AND totp_secret = ?", stored, id, secret); err != nil {
+			return err
+		}
+	}
+	logger.LogInfo("Encrypted %d TOTP secrets", len(ids))
+	return nil
+}
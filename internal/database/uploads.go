@@ -0,0 +1,121 @@
+package database
+
+import (
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+func CreateUpload(upload models.Upload) error {
+	_, err := db.Exec(`
+	INSERT INTO uploads (
+		id,
+		user_id,
+		folder_id,
+		file_name,
+		length,
+		upload_offset,
+		metadata,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		upload.Id,
+		upload.UserId,
+		upload.FolderId,
+		upload.FileName,
+		upload.Length,
+		upload.Offset,
+		upload.Metadata,
+		upload.CreatedAt,
+	)
+	if err != nil {
+		logger.LogError("Error creating upload: %v", err)
+	}
+	return err
+}
+
+func GetUpload(id string, user_id int) (models.Upload, error) {
+	var upload models.Upload
+	err := db.QueryRow(`
+	SELECT
+	id,
+	user_id,
+	folder_id,
+	file_name,
+	length,
+	upload_offset,
+	COALESCE(metadata, ''),
+	created_at
+	FROM uploads
+	WHERE id = ?
+	AND user_id = ?`,
+		id, user_id).Scan(
+		&upload.Id,
+		&upload.UserId,
+		&upload.FolderId,
+		&upload.FileName,
+		&upload.Length,
+		&upload.Offset,
+		&upload.Metadata,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		logger.LogError("Error retrieving upload: %v", err)
+		return models.Upload{}, err
+	}
+	return upload, nil
+}
+
+func UpdateUploadOffset(id string, offset int64) error {
+	_, err := db.Exec("UPDATE uploads SET upload_offset = ? WHERE id = ?", offset, id)
+	if err != nil {
+		logger.LogError("Error updating upload offset: %v", err)
+	}
+	return err
+}
+
+func DeleteUpload(id string) error {
+	_, err := db.Exec("DELETE FROM uploads WHERE id = ?", id)
+	if err != nil {
+		logger.LogError("Error deleting upload: %v", err)
+	}
+	return err
+}
+
+// PendingUploadBytes returns the declared length of all unfinished
+// uploads into folders of the user, which are held against their quota
+// until they finish
+func PendingUploadBytes(user_id int) (int64, error) {
+	var total int64
+	err := db.QueryRow(`
+	SELECT COALESCE(SUM(u.length), 0)
+	FROM uploads u
+	JOIN folders f ON f.id = u.folder_id
+	WHERE f.user_id = ?`, user_id).Scan(&total)
+	if err != nil {
+		logger.LogError("Error calculating pending uploads: %v", err)
+		return 0, err
+	}
+	return total, nil
+}
+
+// ExpiredUploads returns the ids of uploads created before the given time
+func ExpiredUploads(before time.Time) ([]string, error) {
+	rows, err := db.Query("SELECT id FROM uploads WHERE created_at < ?", before)
+	if err != nil {
+		logger.LogError("Error retrieving expired uploads: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			logger.LogError("Error scanning upload: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
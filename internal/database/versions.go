@@ -0,0 +1,326 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+// addVersion records blobId as the newest version of a file and makes it
+// the file's current contents. The caller must already hold a reference
+// to the blob for the new version.
+func addVersion(tx *sql.Tx, fileId int64, blobId int64, size int64, createdAt time.Time) (int, error) {
+	var version int
+	err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = ?", fileId).
+		Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO file_versions (file_id, version, blob_id, size, created_at)
+	VALUES (?, ?, ?, ?, ?)`,
+		fileId, version, blobId, size, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE files SET blob_id = ?, size = ?, created_at = ? WHERE id = ?",
+		blobId, size, createdAt, fileId)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// GetVersions lists the versions of a file, newest first
+func GetVersions(fileId int64, user_id int) ([]models.FileVersion, error) {
+	rows, err := db.Query(`
+	SELECT
+	v.version,
+	v.size,
+	b.sha256,
+	v.created_at,
+	v.version = (SELECT MAX(version) FROM file_versions WHERE file_id = f.id)
+	FROM file_versions v
+	JOIN files f ON f.id = v.file_id
+	JOIN blobs b ON b.id = v.blob_id
+	WHERE v.file_id = ?
+	AND f.user_id = ?
+	ORDER BY v.version DESC`,
+		fileId, user_id)
+	if err != nil {
+		logger.LogError("Error retrieving versions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []models.FileVersion
+	for rows.Next() {
+		version := models.FileVersion{FileId: fileId}
+		if err := rows.Scan(&version.Version, &version.Size, &version.Hash, &version.CreatedAt, &version.Current); err != nil {
+			logger.LogError("Error scanning version: %v", err)
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// GetFileVersion returns a file as it was at the given version
+func GetFileVersion(fileId int64, user_id int, version int) (models.File, error) {
+	var file models.File
+	err := db.QueryRow(`
+	SELECT
+	f.id,
+	f.file_name,
+	v.size,
+	v.blob_id,
+	b.storage_key,
+	b.sha256,
+	b.encoding,
+	COALESCE(b.key_user_id, 0),
+	v.created_at
+	FROM files f
+	JOIN file_versions v ON v.file_id = f.id
+	JOIN blobs b ON b.id = v.blob_id
+	WHERE f.id = ?
+	AND f.user_id = ?
+	AND f.deleted_at IS NULL
+	AND v.version = ?`,
+		fileId, user_id, version).Scan(&file.Id, &file.FileName, &file.Size, &file.BlobId, &file.StorageKey,
+		&file.Hash, &file.Encoding, &file.KeyUserId, &file.CreatedAt)
+	if err != nil {
+		logger.LogError("Error retrieving file version: %v", err)
+		return models.File{}, err
+	}
+	return file, nil
+}
+
+// RestoreVersion makes an old version current again by adding it as a new
+// version, so the versions in between stay in the history
+func RestoreVersion(fileId int64, user_id int, version int) (newVersion int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var blobId, size int64
+	err = tx.QueryRow(`
+	SELECT v.blob_id, v.size
+	FROM file_versions v
+	JOIN files f ON f.id = v.file_id
+	WHERE v.file_id = ?
+	AND f.user_id = ?
+	AND v.version = ?`,
+		fileId, user_id, version).Scan(&blobId, &size)
+	if err != nil {
+		logger.LogError("Error retrieving file version: %v", err)
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE id = ?", blobId); err != nil {
+		return 0, err
+	}
+	newVersion, err = addVersion(tx, fileId, blobId, size, time.Now())
+	if err != nil {
+		logger.LogError("Error restoring version: %v", err)
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+// PruneVersions deletes old versions of a file beyond the newest keep
+// versions or older than maxAge. A zero keep or maxAge disables that rule,
+// and the current version is never removed. Storage keys of blobs that are
+// no longer referenced are returned for removal from the blob store.
+func PruneVersions(fileId int64, user_id int, keep int, maxAge time.Duration) (removed int, orphanKeys []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullInt64
+	err = tx.QueryRow(`
+	SELECT MAX(v.version)
+	FROM file_versions v
+	JOIN files f ON f.id = v.file_id
+	WHERE v.file_id = ?
+	AND f.user_id = ?`, fileId, user_id).Scan(&current)
+	if err != nil {
+		logger.LogError("Error retrieving versions: %v", err)
+		return 0, nil, err
+	}
+	if !current.Valid {
+		return 0, nil, sql.ErrNoRows
+	}
+
+	query := "SELECT id, blob_id FROM file_versions WHERE file_id = ? AND version < ? AND ("
+	args := []any{fileId, current.Int64}
+	var rules []string
+	if keep > 0 {
+		rules = append(rules, `version NOT IN (
+			SELECT version FROM file_versions WHERE file_id = ? ORDER BY version DESC LIMIT ?)`)
+		args = append(args, fileId, keep)
+	}
+	if maxAge > 0 {
+		rules = append(rules, "created_at < ?")
+		args = append(args, time.Now().Add(-maxAge))
+	}
+	if len(rules) == 0 {
+		return 0, nil, nil
+	}
+	for i, rule := range rules {
+		if i > 0 {
+			query += " OR "
+		}
+		query += rule
+	}
+	query += ")"
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		logger.LogError("Error selecting versions to prune: %v", err)
+		return 0, nil, err
+	}
+	type prunable struct{ id, blobId int64 }
+	var prune []prunable
+	for rows.Next() {
+		var p prunable
+		if err := rows.Scan(&p.id, &p.blobId); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		prune = append(prune, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	for _, p := range prune {
+		if _, err := tx.Exec("DELETE FROM file_versions WHERE id = ?", p.id); err != nil {
+			logger.LogError("Error deleting version: %v", err)
+			return 0, nil, err
+		}
+		orphanKey, err := releaseBlob(tx, p.blobId)
+		if err != nil {
+			logger.LogError("Error releasing blob %d: %v", p.blobId, err)
+			return 0, nil, err
+		}
+		if orphanKey != "" {
+			orphanKeys = append(orphanKeys, orphanKey)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.LogError("failed to commit transaction: %v", err)
+		return 0, nil, err
+	}
+	return len(prune), orphanKeys, nil
+}
+
+// MigrateVersions gives files from before version history a first version
+// and merges files that share a name in the same folder into one file
+// whose versions are the duplicates in upload order. It then enforces
+// unique names per folder outside the trash.
+func MigrateVersions() error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.LogError("Failed to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	INSERT INTO file_versions (file_id, version, blob_id, size, created_at)
+	SELECT id, 1, blob_id, size, created_at FROM files
+	WHERE id NOT IN (SELECT file_id FROM file_versions)`)
+	if err != nil {
+		return fmt.Errorf("error creating initial versions: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		logger.LogInfo("Created initial versions for %d files", n)
+	}
+
+	rows, err := tx.Query(`
+	SELECT f.id, f.folder_id, f.file_name
+	FROM files f
+	JOIN (
+		SELECT folder_id, file_name FROM files
+		WHERE deleted_at IS NULL
+		GROUP BY folder_id, file_name HAVING COUNT(*) > 1
+	) d ON d.folder_id = f.folder_id AND d.file_name = f.file_name
+	WHERE f.deleted_at IS NULL
+	ORDER BY f.folder_id, f.file_name, f.created_at, f.id`)
+	if err != nil {
+		return fmt.Errorf("error finding duplicate files: %v", err)
+	}
+	type duplicate struct {
+		id       int64
+		folderId int64
+		name     string
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.id, &d.folderId, &d.name); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var keeper duplicate
+	for _, d := range duplicates {
+		if d.folderId != keeper.folderId || d.name != keeper.name {
+			keeper = d
+			continue
+		}
+		// Append the duplicate's versions to the oldest file of the name
+		var offset int
+		err := tx.QueryRow("SELECT MAX(version) FROM file_versions WHERE file_id = ?", keeper.id).Scan(&offset)
+		if err != nil {
+			return fmt.Errorf("error merging file %d: %v", d.id, err)
+		}
+		_, err = tx.Exec("UPDATE file_versions SET file_id = ?, version = version + ? WHERE file_id = ?",
+			keeper.id, offset, d.id)
+		if err != nil {
+			return fmt.Errorf("error merging file %d: %v", d.id, err)
+		}
+		_, err = tx.Exec(`
+		UPDATE files SET (blob_id, size, created_at) = (
+			SELECT blob_id, size, created_at FROM file_versions
+			WHERE file_id = ? ORDER BY version DESC LIMIT 1)
+		WHERE id = ?`, keeper.id, keeper.id)
+		if err != nil {
+			return fmt.Errorf("error merging file %d: %v", d.id, err)
+		}
+		if _, err := tx.Exec("DELETE FROM files WHERE id = ?", d.id); err != nil {
+			return fmt.Errorf("error merging file %d: %v", d.id, err)
+		}
+		logger.LogInfo("Merged duplicate file %d into %d as a new version", d.id, keeper.id)
+	}
+
+	_, err = tx.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_files_active_name ON files(folder_id, file_name)
+	WHERE deleted_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("error creating file name index: %v", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,118 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the length of master and data keys (AES-256)
+const KeySize = 32
+
+var masterKey []byte
+
+// Init sets the master key used to wrap per-user data keys. Encryption at
+// rest stays disabled when key is empty.
+func Init(key []byte) error {
+	if len(key) != 0 && len(key) != KeySize {
+		return fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+// Enabled reports whether a master key is configured
+func Enabled() bool {
+	return len(masterKey) != 0
+}
+
+// MasterKeyId identifies the configured master key so wrapped keys can be
+// checked against it without revealing the key
+func MasterKeyId() string {
+	return KeyId(masterKey)
+}
+
+// KeyId returns a short fingerprint of a key
+func KeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewDataKey generates a random data key
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey seals a data key with the configured master key
+func WrapKey(dataKey []byte) ([]byte, error) {
+	if !Enabled() {
+		return nil, errors.New("no master key configured")
+	}
+	return WrapKeyWith(masterKey, dataKey)
+}
+
+// UnwrapKey opens a data key sealed with the configured master key
+func UnwrapKey(wrapped []byte) ([]byte, error) {
+	if !Enabled() {
+		return nil, errors.New("no master key configured")
+	}
+	return UnwrapKeyWith(masterKey, wrapped)
+}
+
+// WrapKeyWith seals a data key with the given master key
+func WrapKeyWith(master, dataKey []byte) ([]byte, error) {
+	return Seal(master, dataKey)
+}
+
+// UnwrapKeyWith opens a data key sealed by WrapKeyWith
+func UnwrapKeyWith(master, wrapped []byte) ([]byte, error) {
+	dataKey, err := Open(master, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+	return dataKey, nil
+}
+
+// Seal encrypts a short value, such as a data key or a secret kept in the
+// database, with key. The result is the random nonce followed by the
+// AES-GCM ciphertext.
+func Seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a value sealed by Seal
+func Open(key, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,189 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Blobs are sealed in fixed size chunks so they can be encrypted and
+// decrypted as a stream. The layout is
+//
+//	magic (4) | nonce prefix (7) | chunk | chunk | ... | final chunk
+//
+// where each chunk is chunkSize bytes of plaintext sealed with AES-GCM.
+// A chunk's nonce is the prefix, a 32-bit chunk counter and a flag byte
+// that is set only on the final chunk, so reordered, dropped or truncated
+// chunks fail to open.
+
+const (
+	magic       = "WSE1"
+	chunkSize   = 64 * 1024
+	prefixSize  = 7
+	headerSize  = len(magic) + prefixSize
+	sealedChunk = chunkSize + 16
+)
+
+var errTruncated = errors.New("encrypted blob is truncated")
+
+// OpenedSize returns the plaintext size of an encrypted blob of the given
+// stored size
+func OpenedSize(stored int64) int64 {
+	body := stored - int64(headerSize)
+	full, rem := body/sealedChunk, body%sealedChunk
+	if rem == 0 {
+		return full * chunkSize
+	}
+	return full*chunkSize + rem - 16
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt returns a reader of r sealed with dataKey. The encryption runs
+// in a goroutine; close the returned reader if it is not read to the end.
+func Encrypt(r io.Reader, dataKey []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptTo(pw, r, dataKey))
+	}()
+	return pr
+}
+
+func encryptTo(w io.Writer, r io.Reader, dataKey []byte) error {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(magic), prefix...)); err != nil {
+		return err
+	}
+
+	// Read one byte past each chunk to know whether it is the last one
+	br := bufio.NewReaderSize(r, chunkSize+1)
+	buf := make([]byte, chunkSize)
+	sealed := make([]byte, 0, sealedChunk)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(prefix, counter, final), buf[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return errors.New("blob too large to encrypt")
+		}
+	}
+}
+
+// Decrypt wraps a stored blob sealed by Encrypt so reads return the
+// plaintext. Closing the result closes rc.
+func Decrypt(rc io.ReadCloser, dataKey []byte) (io.ReadCloser, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	br := bufio.NewReaderSize(rc, sealedChunk+1)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		rc.Close()
+		return nil, errTruncated
+	}
+	if string(header[:len(magic)]) != magic {
+		rc.Close()
+		return nil, fmt.Errorf("blob is not encrypted")
+	}
+	return &decrypter{
+		aead:   aead,
+		prefix: header[len(magic):],
+		r:      br,
+		rc:     rc,
+		sealed: make([]byte, sealedChunk),
+	}, nil
+}
+
+type decrypter struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	r       *bufio.Reader
+	rc      io.ReadCloser
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decrypter) nextChunk() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errTruncated
+		}
+		return err
+	}
+	final := err != nil
+	if !final {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0], chunkNonce(d.prefix, d.counter, final), d.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("error decrypting blob: %v", err)
+	}
+	d.plain = plain
+	d.done = final
+	d.counter++
+	return nil
+}
+
+func (d *decrypter) Close() error {
+	return d.rc.Close()
+}
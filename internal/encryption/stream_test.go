@@ -0,0 +1,94 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func seal(t *testing.T, plain, key []byte) []byte {
+	t.Helper()
+	sealed, err := io.ReadAll(Encrypt(bytes.NewReader(plain), key))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	return sealed
+}
+
+func open(sealed, key []byte) ([]byte, error) {
+	rc, err := Decrypt(io.NopCloser(bytes.NewReader(sealed)), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := randomBytes(t, 32)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 17} {
+		plain := randomBytes(t, size)
+		sealed := seal(t, plain, key)
+		if got := OpenedSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: OpenedSize = %d", size, got)
+		}
+		opened, err := open(sealed, key)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(opened, plain) {
+			t.Errorf("size %d: contents differ", size)
+		}
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	key := randomBytes(t, 32)
+	sealed := seal(t, randomBytes(t, 3*chunkSize+100), key)
+	chunk := func(i int) []byte {
+		start := headerSize + i*sealedChunk
+		return sealed[start:min(start+sealedChunk, len(sealed))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := sealed[:headerSize]
+	flipped := bytes.Clone(sealed)
+	flipped[headerSize+10] ^= 1
+	other := seal(t, randomBytes(t, 3*chunkSize+100), key)
+
+	tests := map[string][]byte{
+		"header only":          header,
+		"short header":         sealed[:headerSize-1],
+		"cut at a chunk":       join(header, chunk(0), chunk(1)),
+		"cut inside a chunk":   sealed[:headerSize+sealedChunk+100],
+		"last byte missing":    sealed[:len(sealed)-1],
+		"chunk dropped":        join(header, chunk(0), chunk(2), chunk(3)),
+		"chunks swapped":       join(header, chunk(1), chunk(0), chunk(2), chunk(3)),
+		"chunk repeated":       join(header, chunk(0), chunk(0), chunk(1), chunk(2), chunk(3)),
+		"byte flipped":         flipped,
+		"data appended":        join(sealed, chunk(3)),
+		"other blob's chunk":   join(header, other[headerSize:headerSize+sealedChunk], chunk(1), chunk(2), chunk(3)),
+		"other blob's header":  join(other[:headerSize], sealed[headerSize:]),
+		"not encrypted at all": []byte("plain text that is long enough"),
+	}
+	for name, blob := range tests {
+		if _, err := open(blob, key); err == nil {
+			t.Errorf("%s: opened without error", name)
+		}
+	}
+
+	if _, err := open(sealed, randomBytes(t, 32)); err == nil {
+		t.Error("opened with another key")
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+)
+
+// Everything in a drive belongs to the user or group owning its root
+// folder, whoever created it. Handlers check the caller's role on an item
+// and then call the database with the owner's id.
+
+// folderOwner checks that the user has at least role on a folder and
+// returns who owns it
+func folderOwner(folderId int64, userId int, role models.Role) (ownerId int, err error) {
+	ownerId, has, err := database.FolderRole(folderId, userId)
+	if err != nil {
+		return 0, err
+	}
+	if !has.Allows(role) {
+		return 0, database.ErrForbidden
+	}
+	return ownerId, nil
+}
+
+// fileOwner checks that the user has at least role on a file and returns
+// who owns it
+func fileOwner(fileId int64, userId int, role models.Role) (ownerId int, err error) {
+	ownerId, has, err := database.FileRole(fileId, userId)
+	if err != nil {
+		return 0, err
+	}
+	if !has.Allows(role) {
+		return 0, database.ErrForbidden
+	}
+	return ownerId, nil
+}
+
+// targetFolder checks that the user may add items to targetId and that it
+// is in the drive owned by ownerId
+func targetFolder(targetId int64, userId, ownerId int) error {
+	targetOwner, err := folderOwner(targetId, userId, models.RoleEditor)
+	if err != nil {
+		return err
+	}
+	if targetOwner != ownerId {
+		return database.ErrOtherDrive
+	}
+	return nil
+}
+
+// keyAllowed checks that the API key of a request may reach folderId, or
+// the file fileId if it is not 0. Keys restricted to a folder only reach
+// that folder and what is below it. It writes an error response and
+// returns false if not.
+func keyAllowed(w http.ResponseWriter, r *http.Request, folderId, fileId int64) bool {
+	key, _ := r.Context().Value(middleware.APIKeyKey).(models.APIKey)
+	if key.FolderId == 0 {
+		return true
+	}
+	within, err := database.WithinFolder(folderId, fileId, key.FolderId)
+	if err != nil {
+		logger.LogError("Error checking API key folder: %v", err)
+		http.Error(w, "Error checking API key", http.StatusInternalServerError)
+		return false
+	}
+	if !within {
+		http.Error(w, "API key does not allow access to this item", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// uploadDenied rejects an upload into a folder the user cannot upload to
+// and tells the UI why
+func uploadDenied(w http.ResponseWriter, err error) {
+	status, message := http.StatusInternalServerError, "Error checking folder access"
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		status, message = http.StatusNotFound, "Folder not found"
+	case errors.Is(err, database.ErrForbidden):
+		status, message = http.StatusForbidden, "You can only view this folder"
+	default:
+		logger.LogError("Error checking folder access: %v", err)
+	}
+	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"upload" : {"type" : "error", "message" : %q}}`, message))
+	http.Error(w, message, status)
+}
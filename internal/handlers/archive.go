@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/internal/storage"
+)
+
+// DownloadArchiveHandler streams the folders and files selected with
+// repeated folder_id and file_id parameters as a ZIP archive. Each folder
+// becomes a directory in the archive holding its whole subtree.
+func DownloadArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the whole selection before writing anything, so missing
+	// items can still be reported with a proper status
+	var entries []models.TreeEntry
+	var archiveName string
+	used := make(map[string]bool)
+	for _, v := range r.Form["folder_id"] {
+		folderId, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+			return
+		}
+		if !keyAllowed(w, r, folderId, 0) {
+			return
+		}
+		tree, err := database.FolderTree(folderId, userData.UserId)
+		if err != nil {
+			http.Error(w, "Error retrieving folder", http.StatusInternalServerError)
+			return
+		}
+		if len(tree) == 0 {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		top := uniqueArchiveName(tree[0].Path, used)
+		for _, entry := range tree {
+			entry.Path = top + entry.Path[len(tree[0].Path):]
+			entries = append(entries, entry)
+		}
+		archiveName = top
+	}
+	for _, v := range r.Form["file_id"] {
+		fileId, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		if !keyAllowed(w, r, 0, fileId) {
+			return
+		}
+		file, err := database.GetFile(fileId, userData.UserId)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, models.TreeEntry{Path: uniqueArchiveName(file.FileName, used), File: file})
+	}
+	if len(entries) == 0 {
+		http.Error(w, "Nothing selected", http.StatusBadRequest)
+		return
+	}
+
+	// A single folder is named after itself, anything else is generic
+	if len(r.Form["folder_id"]) != 1 || len(r.Form["file_id"]) != 0 {
+		archiveName = "download"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName + ".zip"}))
+
+	if err := writeArchive(r.Context(), w, entries); err != nil {
+		// The status is already sent, so all that is left is to cut the
+		// response short; the client sees an incomplete archive
+		logger.LogError("Error streaming archive: %v", err)
+		return
+	}
+	logger.LogInfo("Streamed archive %s.zip with %d entries", archiveName, len(entries))
+}
+
+// uniqueArchiveName keeps top level names in an archive distinct by
+// numbering repeats, since selected items can come from different folders
+func uniqueArchiveName(name string, used map[string]bool) string {
+	candidate := name
+	for n := 2; used[candidate]; n++ {
+		ext := path.Ext(name)
+		candidate = fmt.Sprintf("%s (%d)%s", name[:len(name)-len(ext)], n, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// writeArchive writes entries to w as a ZIP, reading each file from the
+// blob store as it goes so nothing is buffered beyond one entry's
+// compression window
+func writeArchive(ctx context.Context, w io.Writer, entries []models.TreeEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		if entry.IsDir {
+			if _, err := zw.CreateHeader(&zip.FileHeader{Name: entry.Path + "/", Method: zip.Store}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := &zip.FileHeader{
+			Name:     entry.Path,
+			Method:   zip.Deflate,
+			Modified: entry.File.CreatedAt,
+		}
+		// Already compressed formats gain nothing from deflate
+		if contentType := mime.TypeByExtension(filepath.Ext(entry.Path)); contentType != "" && !storage.ShouldCompress(contentType) {
+			header.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		contents, err := openContents(ctx, entry.File)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %v", entry.Path, err)
+		}
+		_, err = io.Copy(fw, contents)
+		contents.Close()
+		if err != nil {
+			return fmt.Errorf("error writing %s: %v", entry.Path, err)
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/url"
+
+	"webserver/internal/auth"
+	"webserver/internal/database"
+	"webserver/internal/logger"
+)
+
+// authenticators check the passwords typed into the login form, in order
+var authenticators auth.Chain
+
+// configureAuth sets up password login from the loaded config
+func configureAuth() {
+	authenticators = nil
+	if appConfig.PasswordLogin {
+		authenticators = append(authenticators, auth.Local{})
+	}
+	if appConfig.LDAPURL != "" {
+		// LoadConfig has checked the URL parses
+		u, _ := url.Parse(appConfig.LDAPURL)
+		authenticators = append(authenticators, &auth.LDAP{
+			URL:               appConfig.LDAPURL,
+			StartTLS:          appConfig.LDAPStartTLS,
+			TLSConfig:         auth.NewTLSConfig(u.Hostname(), appConfig.LDAPCACert, appConfig.LDAPInsecureSkipVerify),
+			BindDN:            appConfig.LDAPBindDN,
+			BindPassword:      appConfig.LDAPBindPassword,
+			BaseDN:            appConfig.LDAPBaseDN,
+			UserFilter:        appConfig.LDAPUserFilter,
+			UsernameAttribute: appConfig.LDAPUsernameAttribute,
+			IDAttribute:       appConfig.LDAPIDAttribute,
+			GroupBaseDN:       appConfig.LDAPGroupBaseDN,
+			GroupFilter:       appConfig.LDAPGroupFilter,
+			RequiredGroup:     appConfig.LDAPRequiredGroup,
+		})
+		if appConfig.LDAPInsecureSkipVerify {
+			logger.LogWarning("Not checking the certificate of %s", appConfig.LDAPURL)
+		}
+	}
+}
+
+// loginUser returns the name and data of the local user an identity logs
+// in as. Directory users get a user the first time they log in, and their
+// groups mapped to roles every time.
+func loginUser(identity auth.Identity) (string, database.UserData, error) {
+	username := identity.Username
+	if identity.DN != "" {
+		var err error
+		username, err = database.DirectoryUser(identity.Username, identity.ID, identity.DN, appConfig.LDAPLinkExisting)
+		if err != nil {
+			return "", database.UserData{}, err
+		}
+	}
+	// GetUser creates the root folder of new users
+	user, err := database.GetUser(username)
+	if err != nil {
+		return "", database.UserData{}, err
+	}
+	if identity.DN != "" && len(appConfig.LDAPRoleMap) > 0 {
+		roles, managed := mapRoles(appConfig.LDAPRoleMap, identity.InGroup)
+		if err := database.SyncGroupRoles(user.UserId, roles, managed); err != nil {
+			return "", database.UserData{}, err
+		}
+	}
+	return username, user, nil
+}
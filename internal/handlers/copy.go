@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+)
+
+// CopyFileHandler copies file_id into target_id
+func CopyFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := formId(r, "file_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	targetId, err := formId(r, "target_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid target folder ID")
+		return
+	}
+
+	// Viewers can copy what they can see within the same drive
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleViewer)
+	if err == nil {
+		err = targetFolder(targetId, userData.UserId, ownerId)
+	}
+	if err != nil {
+		itemResult(w, err, "copy file")
+		return
+	}
+	file, err := database.GetFile(fileId, userData.UserId)
+	if err != nil {
+		itemResult(w, err, "copy file")
+		return
+	}
+	if !checkCopyQuota(w, ownerId, file.Size, 1) {
+		return
+	}
+
+	newId, err := database.CopyFile(fileId, ownerId, targetId)
+	if itemResult(w, err, "copy file") {
+		logger.LogInfo("Copied file %d into %d as %d", fileId, targetId, newId)
+	}
+}
+
+// CopyFolderHandler copies folder_id and everything in it into target_id
+func CopyFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	folderId, err := formId(r, "folder_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid folder ID")
+		return
+	}
+	targetId, err := formId(r, "target_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid target folder ID")
+		return
+	}
+
+	ownerId, err := folderOwner(folderId, userData.UserId, models.RoleViewer)
+	if err == nil {
+		err = targetFolder(targetId, userData.UserId, ownerId)
+	}
+	if err != nil {
+		itemResult(w, err, "copy folder")
+		return
+	}
+	bytes, files, err := database.FolderSize(folderId, ownerId)
+	if err != nil {
+		itemResult(w, err, "copy folder")
+		return
+	}
+	if !checkCopyQuota(w, ownerId, bytes, files) {
+		return
+	}
+
+	newId, err := database.CopyFolder(folderId, ownerId, targetId)
+	if itemResult(w, err, "copy folder") {
+		logger.LogInfo("Copied folder %d into %d as %d", folderId, targetId, newId)
+	}
+}
+
+// checkCopyQuota rejects a copy that would take the owner of the target
+// drive over quota.
+// Copies share stored contents but are charged like any other file.
+func checkCopyQuota(w http.ResponseWriter, userId int, bytes, files int64) bool {
+	quota, err := userQuota(userId)
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Error checking storage quota")
+		return false
+	}
+	if !quota.AllowsFiles(files) {
+		itemError(w, http.StatusRequestEntityTooLarge, "Copy exceeds file limit")
+		return false
+	}
+	if !quota.AllowsBytes(bytes) {
+		itemError(w, http.StatusRequestEntityTooLarge, "Copy exceeds storage quota")
+		return false
+	}
+	return true
+}
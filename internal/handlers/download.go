@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"webserver/internal/logger"
+	"webserver/internal/models"
+	"webserver/internal/storage"
+)
+
+// serveFile writes a stored file to the response with http.ServeContent,
+// which takes care of HEAD, single and multi-part byte ranges and the
+// If-None-Match, If-Modified-Since and If-Range preconditions. Encrypted
+// blobs are decrypted on the fly. Compressed blobs are sent as is to
+// clients that accept their encoding and decompressed for everyone else.
+func serveFile(w http.ResponseWriter, r *http.Request, file models.File) {
+	stored, storedSize, err := openStored(r.Context(), file)
+	if err != nil {
+		logger.LogError("Error reading file %d from storage: %v", file.Id, err)
+		http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+	if contentType := mime.TypeByExtension(filepath.Ext(file.FileName)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	if file.Encoding != storage.EncodingNone {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// Byte ranges refer to the decoded contents, so only whole-file
+		// requests can be answered with the stored bytes
+		if r.Header.Get("Range") == "" && acceptsEncoding(r, file.Encoding) {
+			defer stored.Close()
+			w.Header().Set("Content-Encoding", file.Encoding)
+			w.Header().Set("ETag", `"`+file.Hash+"-"+file.Encoding+`"`)
+			serveContent(w, r, file, stored, storedSize)
+			return
+		}
+
+		stored, err = storage.Decompress(stored, file.Encoding)
+		if err != nil {
+			logger.LogError("Error decompressing file %d: %v", file.Id, err)
+			http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+			return
+		}
+	}
+	defer stored.Close()
+
+	// The content hash makes a stable strong validator
+	if file.Hash != "" {
+		w.Header().Set("ETag", `"`+file.Hash+`"`)
+	}
+	serveContent(w, r, file, stored, file.Size)
+}
+
+// serveContent hands body to http.ServeContent. Bodies that cannot seek,
+// such as decompressed or decrypted streams, are wrapped in a
+// streamSeeker.
+func serveContent(w http.ResponseWriter, r *http.Request, file models.File, body io.Reader, size int64) {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		seeker = &streamSeeker{r: body, size: size}
+		r = forwardRanges(r, size)
+	}
+	http.ServeContent(w, r, file.FileName, file.CreatedAt, seeker)
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding header
+// allows the given content coding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+				continue
+			}
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, err := strconv.ParseFloat(v, 64)
+				return err == nil && q > 0
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// byteRange is one range of a Range header, resolved against the size of
+// the file
+type byteRange struct {
+	start, length int64
+}
+
+// parseRange parses a Range header the way http.ServeContent does. It
+// returns no ranges for an empty header and an error for one
+// http.ServeContent would answer with 416 Range Not Satisfiable.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []byteRange
+	noOverlap := false
+	for _, part := range strings.Split(spec, ",") {
+		part = textproto.TrimString(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+		var br byteRange
+		if first == "" {
+			// A suffix range such as "-500" means the last 500 bytes
+			if last == "" || last[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			n = min(n, size)
+			br.start = size - n
+			br.length = n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			br.start = start
+			if last == "" {
+				br.length = size - start
+			} else {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || start > end {
+					return nil, errors.New("invalid range")
+				}
+				br.length = min(end, size-1) - start + 1
+			}
+		}
+		ranges = append(ranges, br)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errors.New("range not satisfiable")
+	}
+	return ranges, nil
+}
+
+// forwardRanges returns r without its Range header if the ranges are not
+// in ascending order without overlaps. http.ServeContent sends multiple
+// ranges in the order asked for, which a body that can only be read
+// forwards cannot do; failing part way through would leave the client
+// with a truncated multipart response, so the whole file is sent instead.
+func forwardRanges(r *http.Request, size int64) *http.Request {
+	ranges, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		return r
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].start < ranges[i-1].start+ranges[i-1].length {
+			r = r.Clone(r.Context())
+			r.Header.Del("Range")
+			return r
+		}
+	}
+	return r
+}
+
+// streamSeeker adapts a forward-only stream of known size for
+// http.ServeContent. Seeking to the end reports the size without moving,
+// and seeking forward discards bytes; seeking backwards after reading
+// fails. That covers whole-file responses and ascending byte ranges, which
+// forwardRanges makes sure of.
+type streamSeeker struct {
+	r    io.Reader
+	size int64
+	pos  int64
+}
+
+func (s *streamSeeker) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *streamSeeker) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = s.pos + offset
+	case io.SeekEnd:
+		if offset == 0 {
+			return s.size, nil
+		}
+		target = s.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if target < s.pos {
+		return 0, errors.New("cannot seek backwards in stream")
+	}
+	if _, err := io.CopyN(io.Discard, s, target-s.pos); err != nil {
+		return 0, err
+	}
+	return s.pos, nil
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"webserver/internal/models"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    bool
+	}{
+		{"", nil, false},
+		{"bytes=0-9", []byteRange{{0, 10}}, false},
+		{"bytes=90-", []byteRange{{90, 10}}, false},
+		{"bytes=-10", []byteRange{{90, 10}}, false},
+		{"bytes=-500", []byteRange{{0, 100}}, false},
+		{"bytes=50-500", []byteRange{{50, 50}}, false},
+		{"bytes=0-0, 10-19", []byteRange{{0, 1}, {10, 10}}, false},
+		{"bytes=10-19,0-0", []byteRange{{10, 10}, {0, 1}}, false},
+		{"bytes= 0-9 ,,", []byteRange{{0, 10}}, false},
+		{"bytes=0-9,200-300", []byteRange{{0, 10}}, false},
+		{"bytes=200-300", nil, true},
+		{"bytes=100-", nil, true},
+		{"bytes=9-0", nil, true},
+		{"bytes=-", nil, true},
+		{"bytes=--5", nil, true},
+		{"bytes=-1-5", nil, true},
+		{"bytes=a-5", nil, true},
+		{"bytes=5", nil, true},
+		{"items=0-9", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 100)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseRange(%q) = %v, want an error", tt.header, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%q): %v", tt.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestForwardRanges(t *testing.T) {
+	tests := []struct {
+		header string
+		kept   bool
+	}{
+		{"", true},
+		{"bytes=0-9", true},
+		{"bytes=-10", true},
+		{"bytes=0-9,10-19", true},
+		{"bytes=0-9,50-59,-10", true},
+		{"bytes=50-59,0-9", false},
+		{"bytes=0-9,5-14", false},
+		{"bytes=0-9,9-9", false},
+		{"bytes=-10,0-9", false},
+		{"bytes=0-,10-19", false},
+		// Left for http.ServeContent to reject
+		{"bytes=200-300", true},
+		{"bytes=junk", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Range", tt.header)
+		}
+		got := forwardRanges(r, 100).Header.Get("Range")
+		if tt.kept && got != tt.header {
+			t.Errorf("forwardRanges(%q) dropped the header", tt.header)
+		}
+		if !tt.kept && got != "" {
+			t.Errorf("forwardRanges(%q) kept the header", tt.header)
+		}
+		if r.Header.Get("Range") != tt.header {
+			t.Errorf("forwardRanges(%q) changed the original request", tt.header)
+		}
+	}
+}
+
+// forwardOnly hides the Seek method of the reader it wraps
+type forwardOnly struct{ io.Reader }
+
+func TestServeContentFromStream(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10))
+	file := models.File{FileName: "digits.txt", CreatedAt: time.Now()}
+
+	serve := func(header string, body io.Reader) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Range", header)
+		}
+		w := httptest.NewRecorder()
+		serveContent(w, r, file, body, int64(len(content)))
+		return w
+	}
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"bytes=10-19", http.StatusPartialContent},
+		{"bytes=-5", http.StatusPartialContent},
+		{"bytes=0-4,20-24,-5", http.StatusPartialContent},
+		{"bytes=20-24,0-4", http.StatusOK},
+		{"bytes=0-9,5-14", http.StatusOK},
+		{"bytes=200-300", http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		stream := serve(tt.header, forwardOnly{bytes.NewReader(content)})
+		if stream.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.header, stream.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusPartialContent {
+			if tt.status == http.StatusOK && !bytes.Equal(stream.Body.Bytes(), content) {
+				t.Errorf("%q: body is not the whole file", tt.header)
+			}
+			continue
+		}
+
+		// Ascending ranges come out of the stream the same as out of a
+		// seekable body, apart from the multipart boundary
+		seekable := serve(tt.header, bytes.NewReader(content))
+		want := seekable.Body.String()
+		got := stream.Body.String()
+		if boundary := boundaryOf(seekable); boundary != "" {
+			want = strings.ReplaceAll(want, boundary, "BOUNDARY")
+			got = strings.ReplaceAll(got, boundaryOf(stream), "BOUNDARY")
+		}
+		if got != want {
+			t.Errorf("%q: body %q, want %q", tt.header, got, want)
+		}
+	}
+}
+
+func boundaryOf(w *httptest.ResponseRecorder) string {
+	_, boundary, _ := strings.Cut(w.Header().Get("Content-Type"), "boundary=")
+	return boundary
+}
+
+func TestStreamSeeker(t *testing.T) {
+	s := &streamSeeker{r: strings.NewReader("0123456789"), size: 10}
+	if n, err := s.Seek(0, io.SeekEnd); err != nil || n != 10 {
+		t.Fatalf("Seek to the end = %d, %v", n, err)
+	}
+	if n, err := s.Seek(4, io.SeekStart); err != nil || n != 4 {
+		t.Fatalf("Seek forward = %d, %v", n, err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(s, b); err != nil || string(b) != "45" {
+		t.Fatalf("Read after seeking = %q, %v", b, err)
+	}
+	if n, err := s.Seek(-3, io.SeekEnd); err != nil || n != 7 {
+		t.Fatalf("Seek from the end = %d, %v", n, err)
+	}
+	if _, err := s.Seek(0, io.SeekStart); err == nil {
+		t.Fatal("Seek backwards succeeded")
+	}
+}
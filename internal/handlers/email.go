@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/mail"
+	"webserver/internal/middleware"
+	"webserver/templates/components"
+	"webserver/templates/emails"
+	"webserver/templates/pages"
+
+	"github.com/a-h/templ"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mailer sends the emails for verifying addresses and resetting passwords
+var mailer mail.Mailer = mail.Log{}
+
+// configureMail sets up sending emails from the loaded config
+func configureMail() {
+	if appConfig.SMTPHost == "" {
+		logger.LogWarning("SMTP_HOST is not set, emails are written to the log")
+		mailer = mail.Log{}
+		return
+	}
+	mailer = &mail.SMTP{
+		Host:     appConfig.SMTPHost,
+		Port:     appConfig.SMTPPort,
+		Username: appConfig.SMTPUsername,
+		Password: appConfig.SMTPPassword,
+		From:     appConfig.SMTPFrom,
+		TLS:      appConfig.SMTPTLS,
+	}
+}
+
+// sendEmail sends an email in the background, so that how long the mail
+// server takes does not hold up the response or show whether an address
+// belongs to a user
+func sendEmail(to, subject, text string, html templ.Component) {
+	var buf bytes.Buffer
+	if err := html.Render(context.Background(), &buf); err != nil {
+		logger.LogError("Error rendering email: %v", err)
+		return
+	}
+	msg := mail.Message{To: to, Subject: subject, Text: text, HTML: buf.String()}
+	go func() {
+		if err := mailer.Send(context.Background(), msg); err != nil {
+			logger.LogError("Error sending email to %s: %v", to, err)
+			return
+		}
+		logger.LogInfo("Sent %q to %s", subject, to)
+	}()
+}
+
+// sendVerification emails a link to verify that email is the user's
+// address. It returns database.ErrTokenRecent without sending anything if
+// a link was sent less than a minute ago, and database.ErrEmailTaken if
+// another user verified the address, whose owner is not sent links they
+// did not ask for.
+func sendVerification(userId int, username, email string) error {
+	taken, err := database.EmailTaken(email, userId)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return database.ErrEmailTaken
+	}
+	token, err := database.CreateEmailToken(userId, database.TokenVerifyEmail, email, appConfig.EmailVerifyTTL)
+	if err != nil {
+		return err
+	}
+	link := appConfig.PublicURL + "/verify?token=" + url.QueryEscape(token)
+	ttl := appConfig.EmailVerifyTTL
+	sendEmail(email, emails.VerifyEmailSubject, emails.VerifyEmailText(username, link, ttl),
+		emails.VerifyEmail(username, link, ttl))
+	return nil
+}
+
+// emailUnverified reports whether a user must verify their email address
+// before logging in, sending them a new link if so. Users without an
+// address, such as those from before addresses were asked for, need not.
+func emailUnverified(userId int, username string) (bool, error) {
+	if !appConfig.RequireEmailVerification {
+		return false, nil
+	}
+	email, verified, err := database.GetEmail(userId)
+	if err != nil || email == "" || verified {
+		return false, err
+	}
+	err = sendVerification(userId, username, email)
+	if errors.Is(err, database.ErrTokenRecent) || errors.Is(err, database.ErrEmailTaken) {
+		err = nil
+	}
+	return true, err
+}
+
+// VerifyEmailHandler is where the link in verification emails leads
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := database.VerifyEmail(r.URL.Query().Get("token"))
+	if errors.Is(err, database.ErrInvalidToken) {
+		renderNotice(w, r, http.StatusBadRequest, "Link expired",
+			"This link is invalid or has expired. Log in to get a new one.")
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		renderNotice(w, r, http.StatusConflict, "Address in use",
+			"Another account verified this email address first.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error verifying email address", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("User %s verified their email address", username)
+	renderNotice(w, r, http.StatusOK, "Email verified", "Your email address is verified, you can now log in.")
+}
+
+// passwordResetOff answers with 404 and returns true if password reset
+// links cannot be sent. Without a mail server emails only go to the log,
+// where anyone who can read it could use them to take over accounts.
+func passwordResetOff(w http.ResponseWriter) bool {
+	if passwordLoginOff(w) {
+		return true
+	}
+	if appConfig.SMTPHost != "" {
+		return false
+	}
+	http.Error(w, "Password reset needs a mail server", http.StatusNotFound)
+	return true
+}
+
+// ShowForgotPage renders the form asking for the address to send a
+// password reset link to
+func ShowForgotPage(w http.ResponseWriter, r *http.Request) {
+	if passwordResetOff(w) {
+		return
+	}
+	if err := pages.ForgotPassword().Render(r.Context(), w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ForgotPasswordHandler emails a password reset link to the email form
+// value if it is the verified address of a user with a password. The
+// response is the same either way, so it does not show who has an
+// account.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if passwordResetOff(w) {
+		return
+	}
+	email, err := mail.Address(r.FormValue("email"))
+	if err != nil {
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"forgot" : {"type" : "error", "message" : %q}}`, "Invalid email address"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userId, username, email, err := database.ResetUser(email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		logger.LogWarning("Password reset asked for unknown address %s", email)
+	case err != nil:
+		logger.LogError("Error finding user for password reset: %v", err)
+		http.Error(w, "Error sending reset link", http.StatusInternalServerError)
+		return
+	default:
+		token, err := database.CreateEmailToken(userId, database.TokenResetPassword, email, appConfig.PasswordResetTTL)
+		if errors.Is(err, database.ErrTokenRecent) {
+			logger.LogWarning("Password reset for %s asked for again too soon", username)
+			break
+		}
+		if err != nil {
+			http.Error(w, "Error sending reset link", http.StatusInternalServerError)
+			return
+		}
+		link := appConfig.PublicURL + "/reset?token=" + url.QueryEscape(token)
+		ttl := appConfig.PasswordResetTTL
+		sendEmail(email, emails.ResetPasswordSubject, emails.ResetPasswordText(username, link, ttl),
+			emails.ResetPassword(username, link, ttl))
+		logger.LogInfo("Password reset asked for by user %s", username)
+	}
+	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"forgot" : {"type" : "success", "message" : %q}}`,
+		"If an account has this address, a reset link is on its way"))
+}
+
+// ResetPasswordPageHandler is where the link in password reset emails
+// leads. It shows the form for a new password without using up the link.
+func ResetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if passwordResetOff(w) {
+		return
+	}
+	// Keep the token out of the Referer header of anything the page loads
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	token := r.URL.Query().Get("token")
+	err := database.CheckResetToken(token)
+	if errors.Is(err, database.ErrInvalidToken) {
+		renderNotice(w, r, http.StatusBadRequest, "Link expired",
+			"This link is invalid or has expired. Ask for a new one from the login page.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error checking reset link", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := pages.ResetPassword(token).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering password reset page: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// ResetPasswordHandler sets the password form value as the user's password
+// with the token from a reset link, which then stops working
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if passwordResetOff(w) {
+		return
+	}
+	password := r.FormValue("password")
+	if password == "" {
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"reset" : {"type" : "error", "message" : %q}}`, "Enter a new password"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := database.ResetPassword(r.FormValue("token"), string(hash))
+	if errors.Is(err, database.ErrInvalidToken) {
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"reset" : {"type" : "error", "message" : %q}}`,
+			"This link is invalid or has expired, ask for a new one"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("User %s reset their password", username)
+	w.Header().Set("HX-Trigger", `{"reset" : {"type" : "success"}}`)
+}
+
+// EmailHandler shows the user's email address
+func EmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	renderEmail(w, r, userData.UserId)
+}
+
+// ChangeEmailHandler sends a link to verify the email form value. It
+// becomes the user's address once they follow the link, until then they
+// keep their current one.
+func ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	email, err := mail.Address(r.FormValue("email"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid email address")
+		return
+	}
+
+	if !verificationSent(w, r, userData.UserId, email) {
+		return
+	}
+	logger.LogInfo("User %d asked to change their email address", userData.UserId)
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderEmail(w, r, userData.UserId)
+}
+
+// ResendVerificationHandler sends the link to verify the user's pending
+// or unverified address again
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	email, verified, err := database.GetEmail(userData.UserId)
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Could not send verification email")
+		return
+	}
+	pending, err := database.PendingEmail(userData.UserId)
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Could not send verification email")
+		return
+	}
+	if pending != "" {
+		email = pending
+	} else if email == "" || verified {
+		itemError(w, http.StatusConflict, "There is no address to verify")
+		return
+	}
+	if !verificationSent(w, r, userData.UserId, email) {
+		return
+	}
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderEmail(w, r, userData.UserId)
+}
+
+// verificationSent sends a link to verify email for the user, writing the
+// error response and returning false if it could not be sent
+func verificationSent(w http.ResponseWriter, r *http.Request, userId int, email string) bool {
+	username, err := database.GetUsername(userId)
+	if err == nil {
+		err = sendVerification(userId, username, email)
+	}
+	if errors.Is(err, database.ErrTokenRecent) {
+		itemError(w, http.StatusTooManyRequests, "A link was just sent, wait a minute before asking for another")
+		return false
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		itemError(w, http.StatusConflict, "This email address is already in use")
+		return false
+	}
+	if err != nil {
+		logger.LogError("Error sending verification email: %v", err)
+		itemError(w, http.StatusInternalServerError, "Could not send verification email")
+		return false
+	}
+	return true
+}
+
+func renderEmail(w http.ResponseWriter, r *http.Request, userId int) {
+	email, verified, err := database.GetEmail(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving email address", http.StatusInternalServerError)
+		return
+	}
+	pending, err := database.PendingEmail(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving email address", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.Email(email, verified, pending).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering email settings: %v", err)
+		http.Error(w, "Error rendering email settings", http.StatusInternalServerError)
+	}
+}
+
+func renderNotice(w http.ResponseWriter, r *http.Request, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := pages.Notice(title, message).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering page: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
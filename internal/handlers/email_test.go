@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"webserver/internal/middleware"
+	"webserver/pkg/config"
+)
+
+// sentMail is an email the stand-in mail server received
+type sentMail struct {
+	to   string
+	text string
+}
+
+// mailServer is a local SMTP server that accepts every message and hands
+// it to the test
+type mailServer struct {
+	net.Listener
+	received chan sentMail
+}
+
+// newMailServer starts a mail server and points the config at it
+func newMailServer(t *testing.T) *mailServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mailServer{Listener: ln, received: make(chan sentMail, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	t.Cleanup(configureMail)
+	withConfig(t, func(cfg *config.Config) {
+		cfg.SMTPHost = host
+		cfg.SMTPPort = port
+		cfg.SMTPFrom = "files@example.org"
+		cfg.SMTPTLS = "none"
+		cfg.PublicURL = "https://files.example.org"
+		cfg.RequireEmailVerification = true
+	})
+	configureMail()
+	return s
+}
+
+// serve speaks just enough SMTP for net/smtp to deliver a message
+func (s *mailServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ready")
+	var to string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			_, to, _ = strings.Cut(arg, ":")
+			to = strings.Trim(to, "<> ")
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			text, err := plainText(data)
+			if err != nil {
+				t.Errorf("reading message: %v", err)
+			}
+			s.received <- sentMail{to: to, text: text}
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// plainText returns the text/plain part of a multipart/alternative message
+func plainText(data []byte) (string, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(data))))
+	if err != nil {
+		return "", err
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return "", err
+	}
+	text, err := io.ReadAll(part)
+	return string(text), err
+}
+
+// link waits for an email to the address and returns the token of the
+// link to path in it
+func (s *mailServer) link(t *testing.T, to, path string) string {
+	t.Helper()
+	select {
+	case m := <-s.received:
+		if m.to != to {
+			t.Fatalf("email went to %s, want %s", m.to, to)
+		}
+		found := regexp.MustCompile(`https://\S+`).FindString(m.text)
+		u, err := url.Parse(found)
+		if err != nil || u.Host != "files.example.org" || u.Path != path {
+			t.Fatalf("no link to %s in %q", path, m.text)
+		}
+		return u.Query().Get("token")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no email to %s", to)
+		return ""
+	}
+}
+
+// none fails if an email arrives within a short while
+func (s *mailServer) none(t *testing.T) {
+	t.Helper()
+	select {
+	case m := <-s.received:
+		t.Fatalf("unexpected email to %s: %q", m.to, m.text)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func post(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func register(username, email string) *httptest.ResponseRecorder {
+	return post(RegisterHandler, "/register", url.Values{"username": {username}, "password": {"secret"}, "email": {email}})
+}
+
+// loggedIn reports whether logging in with the password starts a session
+func loggedIn(username, password string) (bool, int) {
+	w := post(LoginHandler, "/login", url.Values{"username": {username}, "password": {password}})
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == middleware.SessionCookie && cookie.Value != "" {
+			return true, w.Code
+		}
+	}
+	return false, w.Code
+}
+
+func TestRegisterAndVerify(t *testing.T) {
+	s := newMailServer(t)
+
+	if w := register("alice", "alice@example.org"); w.Code != http.StatusOK {
+		t.Fatalf("register: status %d", w.Code)
+	}
+	token := s.link(t, "alice@example.org", "/verify")
+
+	if ok, status := loggedIn("alice", "secret"); ok || status != http.StatusForbidden {
+		t.Fatalf("unverified login: session %v, status %d", ok, status)
+	}
+	// The link just sent still works, so no new one is sent
+	s.none(t)
+
+	if w := get(VerifyEmailHandler, "/verify?token="+url.QueryEscape(token)); w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d", w.Code)
+	}
+	if w := get(VerifyEmailHandler, "/verify?token="+url.QueryEscape(token)); w.Code != http.StatusBadRequest {
+		t.Errorf("verify again: status %d", w.Code)
+	}
+	if ok, _ := loggedIn("alice", "secret"); !ok {
+		t.Fatal("verified user could not log in")
+	}
+
+	// Registering with a verified address looks the same as with a new
+	// one, and sends its owner nothing
+	squatter := register("mallory", "alice@example.org")
+	fresh := register("carol", "carol@example.org")
+	s.link(t, "carol@example.org", "/verify")
+	squatterReply := strings.NewReplacer("alice@example.org", "ADDRESS", "mallory", "USER").Replace(squatter.Header().Get("HX-Trigger"))
+	freshReply := strings.NewReplacer("carol@example.org", "ADDRESS", "carol", "USER").Replace(fresh.Header().Get("HX-Trigger"))
+	if squatter.Code != fresh.Code || squatterReply != freshReply {
+		t.Errorf("registration shows the address is taken: %d %s", squatter.Code, squatter.Header().Get("HX-Trigger"))
+	}
+	s.none(t)
+	if ok, status := loggedIn("mallory", "secret"); ok || status != http.StatusForbidden {
+		t.Errorf("user with a taken address: session %v, status %d", ok, status)
+	}
+}
+
+func TestVerifyLinkExpires(t *testing.T) {
+	s := newMailServer(t)
+	withConfig(t, func(cfg *config.Config) { cfg.EmailVerifyTTL = 100 * time.Millisecond })
+
+	register("dave", "dave@example.org")
+	token := s.link(t, "dave@example.org", "/verify")
+	time.Sleep(200 * time.Millisecond)
+	if w := get(VerifyEmailHandler, "/verify?token="+url.QueryEscape(token)); w.Code != http.StatusBadRequest {
+		t.Errorf("expired link: status %d", w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newMailServer(t)
+	register("erin", "erin@example.org")
+	get(VerifyEmailHandler, "/verify?token="+url.QueryEscape(s.link(t, "erin@example.org", "/verify")))
+
+	known := post(ForgotPasswordHandler, "/forgot", url.Values{"email": {"erin@example.org"}})
+	token := s.link(t, "erin@example.org", "/reset")
+	unknown := post(ForgotPasswordHandler, "/forgot", url.Values{"email": {"nobody@example.org"}})
+	s.none(t)
+	if known.Code != unknown.Code || known.Header().Get("HX-Trigger") != unknown.Header().Get("HX-Trigger") {
+		t.Errorf("reset shows who has an account: %d %s", unknown.Code, unknown.Header().Get("HX-Trigger"))
+	}
+
+	// Looking at the form does not use up the link
+	for range 2 {
+		if w := get(ResetPasswordPageHandler, "/reset?token="+url.QueryEscape(token)); w.Code != http.StatusOK {
+			t.Fatalf("reset page: status %d", w.Code)
+		}
+	}
+	reset := url.Values{"token": {token}, "password": {"changed"}}
+	if w := post(ResetPasswordHandler, "/reset", reset); w.Code != http.StatusOK {
+		t.Fatalf("reset: status %d", w.Code)
+	}
+	if ok, _ := loggedIn("erin", "changed"); !ok {
+		t.Error("could not log in with the new password")
+	}
+	if ok, _ := loggedIn("erin", "secret"); ok {
+		t.Error("logged in with the old password")
+	}
+
+	reset.Set("password", "again")
+	if w := post(ResetPasswordHandler, "/reset", reset); w.Code != http.StatusBadRequest {
+		t.Errorf("reset with a used link: status %d", w.Code)
+	}
+	if w := get(ResetPasswordPageHandler, "/reset?token="+url.QueryEscape(token)); w.Code != http.StatusBadRequest {
+		t.Errorf("reset page with a used link: status %d", w.Code)
+	}
+}
+
+func TestResetLinkExpires(t *testing.T) {
+	s := newMailServer(t)
+	withConfig(t, func(cfg *config.Config) { cfg.PasswordResetTTL = 100 * time.Millisecond })
+	register("frank", "frank@example.org")
+	get(VerifyEmailHandler, "/verify?token="+url.QueryEscape(s.link(t, "frank@example.org", "/verify")))
+
+	post(ForgotPasswordHandler, "/forgot", url.Values{"email": {"frank@example.org"}})
+	token := s.link(t, "frank@example.org", "/reset")
+	time.Sleep(200 * time.Millisecond)
+	if w := get(ResetPasswordPageHandler, "/reset?token="+url.QueryEscape(token)); w.Code != http.StatusBadRequest {
+		t.Errorf("reset page with an expired link: status %d", w.Code)
+	}
+	if w := post(ResetPasswordHandler, "/reset", url.Values{"token": {token}, "password": {"changed"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("reset with an expired link: status %d", w.Code)
+	}
+	if ok, _ := loggedIn("frank", "secret"); !ok {
+		t.Error("an expired link changed the password")
+	}
+}
+
+func TestPasswordResetNeedsMailServer(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) { cfg.SMTPHost = "" })
+	if w := get(ShowForgotPage, "/forgot"); w.Code != http.StatusNotFound {
+		t.Errorf("forgot page: status %d", w.Code)
+	}
+	if w := post(ForgotPasswordHandler, "/forgot", url.Values{"email": {"alice@example.org"}}); w.Code != http.StatusNotFound {
+		t.Errorf("forgot: status %d", w.Code)
+	}
+	if w := get(ResetPasswordPageHandler, "/reset?token=x"); w.Code != http.StatusNotFound {
+		t.Errorf("reset page: status %d", w.Code)
+	}
+	if w := post(ResetPasswordHandler, "/reset", url.Values{"token": {"x"}, "password": {"y"}}); w.Code != http.StatusNotFound {
+		t.Errorf("reset: status %d", w.Code)
+	}
+}
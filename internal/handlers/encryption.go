@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"webserver/internal/database"
+	"webserver/internal/encryption"
+	"webserver/internal/models"
+	"webserver/internal/storage"
+)
+
+// userDataKey returns the user's data key, creating one on first use
+func userDataKey(userId int) ([]byte, error) {
+	if !encryption.Enabled() {
+		return nil, errors.New("file is encrypted but no master key is configured")
+	}
+	return database.UserDataKey(userId)
+}
+
+// openStored opens a file's blob, decrypting it if needed. The result is
+// still in the blob's content encoding; size is its length in bytes.
+func openStored(ctx context.Context, file models.File) (rc io.ReadCloser, size int64, err error) {
+	info, err := storage.Store.Stat(ctx, file.StorageKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, err = storage.Store.Get(ctx, file.StorageKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if file.KeyUserId == 0 {
+		return rc, info.Size, nil
+	}
+
+	dataKey, err := userDataKey(file.KeyUserId)
+	if err != nil {
+		rc.Close()
+		return nil, 0, err
+	}
+	rc, err = encryption.Decrypt(rc, dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, encryption.OpenedSize(info.Size), nil
+}
+
+// openContents opens a file's original contents, decrypting and
+// decompressing as needed
+func openContents(ctx context.Context, file models.File) (io.ReadCloser, error) {
+	rc, _, err := openStored(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	return storage.Decompress(rc, file.Encoding)
+}
@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/models"
+)
+
+var errArchiveLimit = errors.New("archive exceeds extraction limits")
+
+// extractResult reports what happened to one archive entry
+type extractResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"` // "stored", "folder", "skipped" or "failed"
+	Size   int64  `json:"size,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// archiveFormat returns "zip", "tar" or "tar.gz" for archive file names
+// that can be extracted, or "" for anything else
+func archiveFormat(fileName string) string {
+	name := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// extractor recreates an archive's directory structure below a folder
+// and stores its files, enforcing the configured limits and the user's
+// quota as it goes
+type extractor struct {
+	ctx     context.Context
+	userId  int
+	rootId  int64
+	quota   models.Quota
+	folders map[string]int64
+	entries int
+	total   int64
+	ratio   *ratioReader
+	results []extractResult
+}
+
+func newExtractor(ctx context.Context, userId int, rootId int64, quota models.Quota) *extractor {
+	return &extractor{
+		ctx:     ctx,
+		userId:  userId,
+		rootId:  rootId,
+		quota:   quota,
+		folders: map[string]int64{".": rootId},
+	}
+}
+
+// cleanEntryPath turns an archive entry name into a relative slash
+// separated path, rejecting names that would escape the target folder
+func cleanEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errors.New("absolute path")
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", errors.New("path leaves the target folder")
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", errors.New("empty path")
+	}
+	for _, element := range strings.Split(cleaned, "/") {
+		if _, err := validateName(element); err != nil {
+			return "", err
+		}
+	}
+	return cleaned, nil
+}
+
+// folder returns the id of the folder for dir, creating it and any missing
+// parents
+func (x *extractor) folder(dir string) (int64, error) {
+	if id, ok := x.folders[dir]; ok {
+		return id, nil
+	}
+	parentId, err := x.folder(path.Dir(dir))
+	if err != nil {
+		return 0, err
+	}
+	id, err := database.EnsureFolder(x.userId, parentId, strings.TrimSpace(path.Base(dir)))
+	if err != nil {
+		return 0, err
+	}
+	x.folders[dir] = id
+	return id, nil
+}
+
+// count registers an entry and fails once there are too many
+func (x *extractor) count() error {
+	x.entries++
+	if x.entries > appConfig.ExtractMaxEntries {
+		return fmt.Errorf("%w: more than %d entries", errArchiveLimit, appConfig.ExtractMaxEntries)
+	}
+	return nil
+}
+
+func (x *extractor) addDir(name string) error {
+	if err := x.count(); err != nil {
+		return err
+	}
+	dir, err := cleanEntryPath(name)
+	if err != nil {
+		x.results = append(x.results, extractResult{Path: name, Status: "skipped", Error: err.Error()})
+		return nil
+	}
+	if _, err := x.folder(dir); err != nil {
+		logger.LogError("Error creating folder %s: %v", dir, err)
+		x.results = append(x.results, extractResult{Path: dir, Status: "failed", Error: "could not create folder"})
+		return nil
+	}
+	x.results = append(x.results, extractResult{Path: dir, Status: "folder"})
+	return nil
+}
+
+func (x *extractor) skip(name, reason string) error {
+	if err := x.count(); err != nil {
+		return err
+	}
+	x.results = append(x.results, extractResult{Path: name, Status: "skipped", Error: reason})
+	return nil
+}
+
+// addFile stores one file entry. Problems with the entry itself are
+// recorded in the results; going over a limit or the quota stops the
+// whole extraction and is returned.
+func (x *extractor) addFile(name string, r io.Reader) error {
+	if err := x.count(); err != nil {
+		return err
+	}
+	filePath, err := cleanEntryPath(name)
+	if err != nil {
+		x.results = append(x.results, extractResult{Path: name, Status: "skipped", Error: err.Error()})
+		return nil
+	}
+	folderId, err := x.folder(path.Dir(filePath))
+	if err != nil {
+		logger.LogError("Error creating folder for %s: %v", filePath, err)
+		x.results = append(x.results, extractResult{Path: filePath, Status: "failed", Error: "could not create folder"})
+		return nil
+	}
+	fileName := strings.TrimSpace(path.Base(filePath))
+	allowed, isNew, err := allowsFile(x.quota, x.userId, folderId, fileName)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errQuotaExceeded
+	}
+
+	// Count what is actually read rather than trusting sizes in headers
+	limited := &limitReader{r: r, remaining: appConfig.ExtractMaxBytes - x.total, err: errArchiveLimit}
+	quota := &quotaReader{r: limited, remaining: x.quota.RemainingBytes()}
+	fileData, err := storeUpload(x.ctx, x.userId, folderId, fileName, quota)
+	x.total += limited.read
+	switch {
+	case limited.exceeded:
+		return fmt.Errorf("%w: more than %d bytes", errArchiveLimit, appConfig.ExtractMaxBytes)
+	case quota.exceeded:
+		return errQuotaExceeded
+	case x.ratio != nil && x.ratio.err != nil:
+		return x.ratio.err
+	case err != nil:
+		logger.LogError("Error extracting %s: %v", filePath, err)
+		x.results = append(x.results, extractResult{Path: filePath, Status: "failed", Error: "could not store file"})
+		return nil
+	}
+	x.quota.UsedBytes += fileData.Size
+	if isNew {
+		x.quota.UsedFiles++
+	}
+	x.results = append(x.results, extractResult{Path: filePath, Status: "stored", Size: fileData.Size})
+	return nil
+}
+
+// extractZip spools a ZIP archive to a temporary file, since its
+// directory is at the end, then extracts it
+func (x *extractor) extractZip(r io.Reader) error {
+	tmp, err := os.CreateTemp("", "extract-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	limited := &limitReader{r: r, remaining: appConfig.ExtractMaxBytes, err: errArchiveLimit}
+	size, err := io.Copy(tmp, limited)
+	if limited.exceeded {
+		return fmt.Errorf("%w: archive larger than %d bytes", errArchiveLimit, appConfig.ExtractMaxBytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %v", err)
+	}
+	if len(zr.File) > appConfig.ExtractMaxEntries {
+		return fmt.Errorf("%w: more than %d entries", errArchiveLimit, appConfig.ExtractMaxEntries)
+	}
+
+	for _, f := range zr.File {
+		switch {
+		case f.FileInfo().IsDir():
+			err = x.addDir(f.Name)
+		case !f.Mode().IsRegular():
+			err = x.skip(f.Name, "not a regular file")
+		case f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > uint64(appConfig.ExtractMaxRatio):
+			return fmt.Errorf("%w: %s has a compression ratio above %d", errArchiveLimit, f.Name, appConfig.ExtractMaxRatio)
+		default:
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err != nil {
+				x.results = append(x.results, extractResult{Path: f.Name, Status: "failed", Error: err.Error()})
+				err = nil
+				continue
+			}
+			err = x.addFile(f.Name, rc)
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTar streams a tar archive, gunzipping it first if compressed
+func (x *extractor) extractTar(r io.Reader, compressed bool) error {
+	if compressed {
+		counted := &limitReader{r: r, remaining: -1}
+		gz, err := gzip.NewReader(counted)
+		if err != nil {
+			return fmt.Errorf("invalid gzip stream: %v", err)
+		}
+		defer gz.Close()
+		x.ratio = &ratioReader{r: gz, compressed: counted, ratio: appConfig.ExtractMaxRatio}
+		r = x.ratio
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, errArchiveLimit) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %v", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.addDir(header.Name)
+		case tar.TypeReg:
+			err = x.addFile(header.Name, tr)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			err = x.skip(header.Name, "not a regular file")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// limitReader fails with err once more than remaining bytes are read. A
+// negative remaining only counts.
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+	read      int64
+	exceeded  bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.remaining >= 0 && l.read > l.remaining {
+		l.exceeded = true
+		return n, l.err
+	}
+	return n, err
+}
+
+// ratioReader fails when the decompressed output grows more than ratio
+// times the compressed input, with some slack for small archives
+type ratioReader struct {
+	r          io.Reader
+	compressed *limitReader
+	ratio      int64
+	read       int64
+	err        error
+}
+
+func (c *ratioReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.read > c.ratio*c.compressed.read+1<<20 {
+		c.err = fmt.Errorf("%w: compression ratio above %d", errArchiveLimit, c.ratio)
+		return n, c.err
+	}
+	return n, err
+}
+
+// extractArchive unpacks an archive of the given format into folderId. The
+// returned extractor holds the per-entry results and updated quota even
+// when extraction stops early.
+func extractArchive(ctx context.Context, userId int, folderId int64, quota models.Quota, format string, r io.Reader) (*extractor, error) {
+	x := newExtractor(ctx, userId, folderId, quota)
+	if _, err := database.GetFolder(folderId, userId); err != nil {
+		return x, err
+	}
+	if format == "zip" {
+		return x, x.extractZip(r)
+	}
+	return x, x.extractTar(r, format == "tar.gz")
+}
+
+// extractFailed reports an extraction that stopped early along with the
+// results of the entries handled so far
+func extractFailed(w http.ResponseWriter, fileName string, err error, results []extractResult) {
+	status, message := http.StatusUnprocessableEntity, fmt.Sprintf("Could not extract %s: %v", fileName, err)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		status, message = http.StatusNotFound, "Folder not found"
+	case errors.Is(err, errQuotaExceeded):
+		status, message = http.StatusRequestEntityTooLarge, "Upload exceeds storage quota"
+	case errors.Is(err, errArchiveLimit):
+		logger.LogWarning("Extraction of %s stopped: %v", fileName, err)
+	default:
+		logger.LogError("Error extracting %s: %v", fileName, err)
+	}
+	trigger, _ := json.Marshal(map[string]any{
+		"upload":       map[string]string{"type": "error", "message": message},
+		"triggerItems": "",
+	})
+	writeExtractResults(w, status, string(trigger), results)
+}
+
+func writeExtractResults(w http.ResponseWriter, status int, trigger string, results []extractResult) {
+	if results == nil {
+		results = []extractResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("HX-Trigger", trigger)
+	w.Header().Set("HX-Reswap", "none")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]any{"results": results}); err != nil {
+		logger.LogError("Error writing extraction results: %v", err)
+	}
+}
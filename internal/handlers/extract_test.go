@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"webserver/internal/database"
+	"webserver/internal/models"
+	"webserver/pkg/config"
+)
+
+func TestCleanEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", "a.txt"},
+		{"dir/a.txt", "dir/a.txt"},
+		{"./dir//a.txt", "dir/a.txt"},
+		{"dir/", "dir"},
+		{`dir\a.txt`, "dir/a.txt"},
+		{"/etc/passwd", ""},
+		{`\windows\win.ini`, ""},
+		{"C:/boot.ini", ""},
+		{`c:boot.ini`, ""},
+		{"../a.txt", ""},
+		{`..\a.txt`, ""},
+		{"dir/../../a.txt", ""},
+		{"dir/../a.txt", ""},
+		{"dir/..", ""},
+		{"", ""},
+		{".", ""},
+		{"./", ""},
+		{"dir/ /a.txt", ""},
+		{"dir/a\x00.txt", ""},
+		{"dir/" + strings.Repeat("a", maxNameLength+1), ""},
+	}
+	for _, tt := range tests {
+		got, err := cleanEntryPath(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("cleanEntryPath(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cleanEntryPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+func zipArchive(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, compressed bool, entries ...archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	var tw *tar.Writer
+	if compressed {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(e.name, "/") {
+			header.Typeflag, header.Size = tar.TypeDir, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(e.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func files(n int, size int) []archiveEntry {
+	entries := make([]archiveEntry, n)
+	for i := range entries {
+		entries[i] = archiveEntry{name: "f" + strings.Repeat("x", i) + ".txt", data: bytes.Repeat([]byte{byte('a' + i%26)}, size)}
+	}
+	return entries
+}
+
+// extract unpacks an archive into the root folder of a new user and
+// returns the extractor along with the number of files stored there
+func extract(t *testing.T, format string, archive []byte) (*extractor, int, error) {
+	t.Helper()
+	userId, rootId := newTestUser(t)
+	x, err := extractArchive(context.Background(), userId, rootId, models.Quota{}, format, bytes.NewReader(archive))
+	stored, listErr := database.GetFiles(rootId, userId)
+	if listErr != nil {
+		t.Fatalf("GetFiles: %v", listErr)
+	}
+	return x, len(stored), err
+}
+
+func TestExtractStoresEntries(t *testing.T) {
+	entries := []archiveEntry{
+		{"docs/", nil},
+		{"docs/a.txt", []byte("a")},
+		{"b.txt", []byte("bb")},
+		{"../escape.txt", []byte("no")},
+		{"/abs.txt", []byte("no")},
+	}
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		var archive []byte
+		if format == "zip" {
+			archive = zipArchive(t, entries...)
+		} else {
+			archive = tarArchive(t, format == "tar.gz", entries...)
+		}
+		x, stored, err := extract(t, format, archive)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if stored != 1 {
+			t.Errorf("%s: %d files in the root folder, want 1", format, stored)
+		}
+		statuses := map[string]string{}
+		for _, result := range x.results {
+			statuses[result.Path] = result.Status
+		}
+		want := map[string]string{
+			"docs": "folder", "docs/a.txt": "stored", "b.txt": "stored",
+			"../escape.txt": "skipped", "/abs.txt": "skipped",
+		}
+		for path, status := range want {
+			if statuses[path] != status {
+				t.Errorf("%s: %s is %q, want %q", format, path, statuses[path], status)
+			}
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) {
+		cfg.ExtractMaxEntries = 3
+		cfg.ExtractMaxBytes = 10 << 20
+		cfg.ExtractMaxRatio = 100
+	})
+	zeros := []archiveEntry{{"zeros.bin", make([]byte, 8<<20)}}
+	noise := []archiveEntry{{"noise.bin", make([]byte, 12<<20)}}
+	rand.Read(noise[0].data)
+
+	tests := []struct {
+		name    string
+		format  string
+		archive []byte
+		// stored is how many files are kept before the limit is hit
+		stored int
+	}{
+		{"zip with too many entries", "zip", zipArchive(t, files(4, 1)...), 0},
+		{"tar with too many entries", "tar", tarArchive(t, false, files(4, 1)...), 3},
+		{"tar with too many bytes", "tar", tarArchive(t, false, files(3, 4<<20)...), 2},
+		{"zip too large", "zip", zipArchive(t, noise...), 0},
+		{"zip with a high ratio", "zip", zipArchive(t, zeros...), 0},
+		{"tar.gz with a high ratio", "tar.gz", tarArchive(t, true, zeros...), 0},
+	}
+	for _, tt := range tests {
+		x, stored, err := extract(t, tt.format, tt.archive)
+		if !errors.Is(err, errArchiveLimit) {
+			t.Errorf("%s: error %v, want the archive limit", tt.name, err)
+		}
+		if stored != tt.stored {
+			t.Errorf("%s: %d files stored, want %d", tt.name, stored, tt.stored)
+		}
+		if x.total > appConfig.ExtractMaxBytes+1<<20 {
+			t.Errorf("%s: read %d bytes of a %d byte limit", tt.name, x.total, appConfig.ExtractMaxBytes)
+		}
+	}
+}
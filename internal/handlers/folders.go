@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+const maxNameLength = 255
+
+// validateName trims a file or folder name and checks that it can be
+// used as a single path element
+func validateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errors.New("name cannot be empty")
+	case len(name) > maxNameLength:
+		return "", fmt.Errorf("name cannot be longer than %d bytes", maxNameLength)
+	case name == "." || name == "..":
+		return "", errors.New("name cannot be . or ..")
+	case strings.ContainsAny(name, `/\`):
+		return "", errors.New("name cannot contain / or \\")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return "", errors.New("name cannot contain control characters")
+	}
+	return name, nil
+}
+
+// itemError rejects a folder or file operation and tells the UI why
+func itemError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"item" : {"type" : "error", "message" : %q}}`, message))
+	http.Error(w, message, status)
+}
+
+// itemResult maps errors from the folder and file operations to responses.
+// It reports whether the operation succeeded.
+func itemResult(w http.ResponseWriter, err error, action string) bool {
+	switch {
+	case err == nil:
+		w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}, "triggerItems" : ""}`)
+		w.WriteHeader(http.StatusOK)
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		itemError(w, http.StatusNotFound, "Item not found")
+	case errors.Is(err, database.ErrNameConflict):
+		itemError(w, http.StatusConflict, "An item with this name already exists")
+	case errors.Is(err, database.ErrCycle):
+		itemError(w, http.StatusConflict, "A folder cannot be moved or copied into itself")
+	case errors.Is(err, database.ErrOtherDrive):
+		itemError(w, http.StatusConflict, "Items can only be moved or copied within the same drive")
+	case errors.Is(err, database.ErrForbidden):
+		itemError(w, http.StatusForbidden, "You do not have permission to "+action)
+	default:
+		logger.LogError("Error trying to %s: %v", action, err)
+		itemError(w, http.StatusInternalServerError, "Could not "+action)
+	}
+	return false
+}
+
+// formId parses an id form value
+func formId(r *http.Request, key string) (int64, error) {
+	return strconv.ParseInt(r.FormValue(key), 10, 64)
+}
+
+// CreateFolderModalHandler renders the form for a new folder inside
+// folder_id
+func CreateFolderModalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parentId, err := formId(r, "folder_id")
+	if err != nil {
+		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.CreateFolderModal(parentId).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering modal: %v", err)
+		http.Error(w, "Error rendering modal", http.StatusInternalServerError)
+	}
+}
+
+// RenameModalHandler renders the rename form for file_id or folder_id
+func RenameModalHandler(w http.ResponseWriter, r *http.Request) {
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	item, err := formItem(r, userData.UserId)
+	if err != nil {
+		itemResult(w, err, "find item")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.RenameModal(item).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering modal: %v", err)
+		http.Error(w, "Error rendering modal", http.StatusInternalServerError)
+	}
+}
+
+// MoveModalHandler renders the move form for file_id or folder_id
+func MoveModalHandler(w http.ResponseWriter, r *http.Request) {
+	destinationModal(w, r, "move")
+}
+
+// CopyModalHandler renders the copy form for file_id or folder_id
+func CopyModalHandler(w http.ResponseWriter, r *http.Request) {
+	destinationModal(w, r, "copy")
+}
+
+func destinationModal(w http.ResponseWriter, r *http.Request, action string) {
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	item, err := formItem(r, userData.UserId)
+	if err != nil {
+		itemResult(w, err, "find item")
+		return
+	}
+	folders, err := destinations(item, userData.UserId)
+	if err != nil {
+		http.Error(w, "Error retrieving folders", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.DestinationModal(item, folders, action).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering modal: %v", err)
+		http.Error(w, "Error rendering modal", http.StatusInternalServerError)
+	}
+}
+
+// destinations lists the folders an item can be moved or copied into: the
+// folders of the drive it is in that the user can add items to
+func destinations(item models.Item, userId int) ([]models.FolderPath, error) {
+	var ownerId int
+	var err error
+	if item.IsFolder() {
+		ownerId, _, err = database.FolderRole(item.GetID(), userId)
+	} else {
+		ownerId, _, err = database.FileRole(item.GetID(), userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	folders, err := database.GetFolderPaths(ownerId)
+	if err != nil {
+		return nil, err
+	}
+	role, err := database.AccountRole(ownerId, userId)
+	if err != nil || role.Allows(models.RoleEditor) {
+		return folders, err
+	}
+
+	// Users with access to only part of the drive see the folders they
+	// were made editors of
+	editable := folders[:0]
+	for _, folder := range folders {
+		_, role, err := database.FolderRole(folder.Id, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if role.Allows(models.RoleEditor) {
+			editable = append(editable, folder)
+		}
+	}
+	return editable, nil
+}
+
+// formItem loads the file or folder named by the file_id or folder_id
+// form value
+func formItem(r *http.Request, userId int) (models.Item, error) {
+	if r.FormValue("folder_id") != "" {
+		folderId, err := formId(r, "folder_id")
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		return database.GetFolder(folderId, userId)
+	}
+	fileId, err := formId(r, "file_id")
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return database.GetFile(fileId, userId)
+}
+
+// CreateFolderHandler creates a folder called name inside folder_id
+func CreateFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	parentId, err := formId(r, "folder_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid folder ID")
+		return
+	}
+	name, err := validateName(r.FormValue("name"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !keyAllowed(w, r, parentId, 0) {
+		return
+	}
+	// Folders created inside a shared folder belong to its owner
+	ownerId, err := folderOwner(parentId, userData.UserId, models.RoleEditor)
+	if err != nil {
+		itemResult(w, err, "create folder")
+		return
+	}
+	folder, err := database.CreateFolder(ownerId, parentId, name)
+	if itemResult(w, err, "create folder") {
+		logger.LogInfo("Created folder %d (%s) in %d", folder.Id, name, parentId)
+	}
+}
+
+// RenameFolderHandler renames folder_id to name
+func RenameFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	folderId, err := formId(r, "folder_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid folder ID")
+		return
+	}
+	name, err := validateName(r.FormValue("name"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ownerId, err := folderOwner(folderId, userData.UserId, models.RoleEditor)
+	if err != nil {
+		itemResult(w, err, "rename folder")
+		return
+	}
+	if itemResult(w, database.RenameFolder(folderId, ownerId, name), "rename folder") {
+		logger.LogInfo("Renamed folder %d to %s", folderId, name)
+	}
+}
+
+// MoveFolderHandler moves folder_id into target_id
+func MoveFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	folderId, err := formId(r, "folder_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid folder ID")
+		return
+	}
+	targetId, err := formId(r, "target_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid target folder ID")
+		return
+	}
+
+	ownerId, err := folderOwner(folderId, userData.UserId, models.RoleEditor)
+	if err == nil {
+		err = targetFolder(targetId, userData.UserId, ownerId)
+	}
+	if err != nil {
+		itemResult(w, err, "move folder")
+		return
+	}
+	if itemResult(w, database.MoveFolder(folderId, ownerId, targetId), "move folder") {
+		logger.LogInfo("Moved folder %d into %d", folderId, targetId)
+	}
+}
+
+// RenameFileHandler renames file_id to name
+func RenameFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := formId(r, "file_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	name, err := validateName(r.FormValue("name"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleEditor)
+	if err != nil {
+		itemResult(w, err, "rename file")
+		return
+	}
+	if itemResult(w, database.RenameFile(fileId, ownerId, name), "rename file") {
+		logger.LogInfo("Renamed file %d to %s", fileId, name)
+	}
+}
+
+// MoveFileHandler moves file_id into target_id
+func MoveFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := formId(r, "file_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	targetId, err := formId(r, "target_id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid target folder ID")
+		return
+	}
+
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleEditor)
+	if err == nil {
+		err = targetFolder(targetId, userData.UserId, ownerId)
+	}
+	if err != nil {
+		itemResult(w, err, "move file")
+		return
+	}
+	if itemResult(w, database.MoveFile(fileId, ownerId, targetId), "move file") {
+		logger.LogInfo("Moved file %d into %d", fileId, targetId)
+	}
+}
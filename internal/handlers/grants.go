@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+// GrantsHandler lists who folder_id or file_id is shared with
+func GrantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	item, err := formItem(r, userData.UserId)
+	if err != nil {
+		itemError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	renderGrants(w, r, item, userData.UserId)
+}
+
+// CreateGrantHandler shares folder_id or file_id with the user or group
+// called username as role, or changes the role they have on it
+func CreateGrantHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	item, err := formItem(r, userData.UserId)
+	if err != nil {
+		itemError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	role := models.Role(r.FormValue("role"))
+	if role.Rank() == 0 {
+		itemError(w, http.StatusBadRequest, "Role must be viewer, editor or owner")
+		return
+	}
+	username := r.FormValue("username")
+
+	grant := models.Grant{Role: role, GrantedBy: userData.UserId}
+	if item.IsFolder() {
+		grant.FolderId = item.GetID()
+	} else {
+		grant.FileId = item.GetID()
+	}
+	err = database.SaveGrant(grant, username)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		itemError(w, http.StatusNotFound, "Item not found")
+		return
+	case errors.Is(err, database.ErrForbidden):
+		itemError(w, http.StatusForbidden, "Only owners can share this item")
+		return
+	case errors.Is(err, database.ErrUnknownUser):
+		itemError(w, http.StatusNotFound, fmt.Sprintf("There is no user or group called %s", username))
+		return
+	case errors.Is(err, database.ErrGrantOwner):
+		itemError(w, http.StatusConflict, fmt.Sprintf("%s owns this item", username))
+		return
+	case err != nil:
+		itemError(w, http.StatusInternalServerError, "Could not share item")
+		return
+	}
+	logger.LogInfo("User %d shared %s %d with %s as %s", userData.UserId, itemKind(item), item.GetID(), username, role)
+
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderGrants(w, r, item, userData.UserId)
+}
+
+// RevokeGrantHandler removes the grant id. Owners of the item use it to
+// stop sharing; the user the item was shared with uses it to leave.
+func RevokeGrantHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := formId(r, "id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid grant ID")
+		return
+	}
+	grant, err := database.RevokeGrant(id, userData.UserId)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		itemError(w, http.StatusNotFound, "Grant not found")
+		return
+	case errors.Is(err, database.ErrForbidden):
+		itemError(w, http.StatusForbidden, "Only owners can stop sharing this item")
+		return
+	case err != nil:
+		itemError(w, http.StatusInternalServerError, "Could not stop sharing")
+		return
+	}
+	logger.LogInfo("User %d revoked grant %d", userData.UserId, id)
+
+	if grant.UserId == userData.UserId {
+		renderSharedWithMe(w, r, userData.UserId)
+		return
+	}
+	var item models.Item
+	if grant.IsFolder() {
+		item, err = database.GetFolder(grant.FolderId, userData.UserId)
+	} else {
+		item, err = database.GetFile(grant.FileId, userData.UserId)
+	}
+	if err != nil {
+		itemError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	renderGrants(w, r, item, userData.UserId)
+}
+
+// SharedHandler lists the files and folders shared with the user or their
+// groups
+func SharedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	renderSharedWithMe(w, r, userData.UserId)
+}
+
+func itemKind(item models.Item) string {
+	if item.IsFolder() {
+		return "folder"
+	}
+	return "file"
+}
+
+func renderGrants(w http.ResponseWriter, r *http.Request, item models.Item, userId int) {
+	var folderId, fileId int64
+	if item.IsFolder() {
+		folderId = item.GetID()
+	} else {
+		fileId = item.GetID()
+	}
+	grants, err := database.GetGrants(folderId, fileId, userId)
+	if errors.Is(err, database.ErrForbidden) {
+		itemError(w, http.StatusForbidden, "Only owners can share this item")
+		return
+	}
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Error retrieving access")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.Grants(item, grants).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering grants: %v", err)
+		http.Error(w, "Error rendering grants", http.StatusInternalServerError)
+	}
+}
+
+func renderSharedWithMe(w http.ResponseWriter, r *http.Request, userId int) {
+	grants, err := database.GetSharedWithMe(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving shared items", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.SharedWithMe(grants, userId).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering shared items: %v", err)
+		http.Error(w, "Error rendering shared items", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+// groupResult maps errors from the group operations to responses. It
+// reports whether the operation succeeded.
+func groupResult(w http.ResponseWriter, err error, action string) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		itemError(w, http.StatusNotFound, "Group not found")
+	case errors.Is(err, database.ErrForbidden):
+		itemError(w, http.StatusForbidden, "Only group owners can "+action)
+	case errors.Is(err, database.ErrNameTaken):
+		itemError(w, http.StatusConflict, "A user or group with this name already exists")
+	case errors.Is(err, database.ErrLastOwner):
+		itemError(w, http.StatusConflict, "A group needs at least one owner")
+	case errors.Is(err, database.ErrUnknownUser):
+		itemError(w, http.StatusNotFound, "User not found")
+	default:
+		logger.LogError("Error trying to %s: %v", action, err)
+		itemError(w, http.StatusInternalServerError, "Could not "+action)
+	}
+	return false
+}
+
+// GroupsHandler lists the groups the user belongs to
+func GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	renderGroups(w, r, userData.UserId)
+}
+
+// CreateGroupHandler creates a group called name with its own team drive
+// and makes the user its owner
+func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	// The name is also the name of the team drive's root folder
+	name, err := validateName(r.FormValue("name"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	group, err := database.CreateGroup(name, userData.UserId)
+	if !groupResult(w, err, "create group") {
+		return
+	}
+	logger.LogInfo("User %d created group %d (%s)", userData.UserId, group.Id, name)
+
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderGroups(w, r, userData.UserId)
+}
+
+// GroupMembersHandler lists the members of group_id
+func GroupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	groupId, err := strconv.Atoi(r.FormValue("group_id"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+	renderGroupMembers(w, r, groupId, userData.UserId)
+}
+
+// AddGroupMemberHandler adds the user called username to group_id as
+// role, or changes the role of an existing member
+func AddGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	groupId, err := strconv.Atoi(r.FormValue("group_id"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+	role := models.Role(r.FormValue("role"))
+	if role.Rank() == 0 {
+		itemError(w, http.StatusBadRequest, "Role must be viewer, editor or owner")
+		return
+	}
+	username := r.FormValue("username")
+
+	err = database.SaveGroupMember(groupId, username, role, userData.UserId)
+	if errors.Is(err, database.ErrUnknownUser) {
+		itemError(w, http.StatusNotFound, fmt.Sprintf("There is no user called %s", username))
+		return
+	}
+	if !groupResult(w, err, "change members") {
+		return
+	}
+	logger.LogInfo("User %d added %s to group %d as %s", userData.UserId, username, groupId, role)
+
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderGroupMembers(w, r, groupId, userData.UserId)
+}
+
+// RemoveGroupMemberHandler takes user_id out of group_id. Owners use it to
+// remove members; members use it to leave.
+func RemoveGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	groupId, err := strconv.Atoi(r.FormValue("group_id"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+	userId, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if !groupResult(w, database.RemoveGroupMember(groupId, userId, userData.UserId), "change members") {
+		return
+	}
+	logger.LogInfo("User %d removed user %d from group %d", userData.UserId, userId, groupId)
+
+	w.Header().Set("HX-Trigger", `{"triggerItems" : ""}`)
+	if userId == userData.UserId {
+		renderGroups(w, r, userData.UserId)
+		return
+	}
+	renderGroupMembers(w, r, groupId, userData.UserId)
+}
+
+func renderGroups(w http.ResponseWriter, r *http.Request, userId int) {
+	groups, err := database.GetGroups(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving groups", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.Groups(groups).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering groups: %v", err)
+		http.Error(w, "Error rendering groups", http.StatusInternalServerError)
+	}
+}
+
+func renderGroupMembers(w http.ResponseWriter, r *http.Request, groupId, userId int) {
+	group, err := database.GetGroup(groupId, userId)
+	if !groupResult(w, err, "view group") {
+		return
+	}
+	members, err := database.GetGroupMembers(groupId, userId)
+	if !groupResult(w, err, "view group") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.GroupMembers(group, members, userId).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering group members: %v", err)
+		http.Error(w, "Error rendering group members", http.StatusInternalServerError)
+	}
+}
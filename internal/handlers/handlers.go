@@ -1,16 +1,28 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"webserver/internal/auth"
 	"webserver/internal/database"
+	"webserver/internal/encryption"
 	"webserver/internal/logger"
+	"webserver/internal/mail"
 	"webserver/internal/middleware"
 	"webserver/internal/models"
+	"webserver/internal/storage"
 	"webserver/pkg/config"
 	"webserver/templates/components"
 	"webserver/templates/pages"
@@ -20,9 +32,41 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// HomeHandler handles requests for the home page.
+// appConfig holds the settings loaded at startup
+var appConfig = &config.Config{}
+
+// Configure passes the loaded config to the handlers
+func Configure(cfg *config.Config) {
+	appConfig = cfg
+	configureAuth()
+	configureOIDC()
+	configureMail()
+}
+
+// passwordLoginOff rejects registration when passwords kept by this server
+// are turned off
+func passwordLoginOff(w http.ResponseWriter) bool {
+	if appConfig.PasswordLogin {
+		return false
+	}
+	http.Error(w, "Password login is turned off, use single sign-on", http.StatusForbidden)
+	return true
+}
+
+// HomeHandler handles requests for the home page. Users with a session
+// go straight to their files, so reloading the page keeps them logged in.
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	err := pages.Index(time.Now()).Render(r.Context(), w)
+	if userData, session, ok := currentSession(r); ok {
+		renderHome(w, r, userData.Username, session)
+		return
+	}
+	options := pages.LoginOptions{
+		Password: len(authenticators) > 0,
+		Register: appConfig.PasswordLogin,
+		Reset:    appConfig.PasswordLogin && appConfig.SMTPHost != "",
+		SSO:      oidcProvider != nil,
+	}
+	err := pages.Index(time.Now(), options).Render(r.Context(), w)
 	if err != nil {
 		logger.LogError("Error parsing template: ", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -31,13 +75,24 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func DevHomeHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := startSession(w, config.DevUser.UserId)
+	if err != nil {
+		logger.LogError("Error starting dev session: %v", err)
+		http.Error(w, "Error starting session", http.StatusInternalServerError)
+		return
+	}
+	quota, err := userQuota(config.DevUser.UserId)
+	if err != nil {
+		logger.LogError("Error retrieving quota: %v", err)
+	}
 	data := pages.PageData{
-		Username: config.DevUser.Username,
-		Key:      config.DevUser.APIKey,
-		FolderId: config.DevUser.FolderId,
+		Username:  config.DevUser.Username,
+		CSRFToken: session.CSRFToken,
+		FolderId:  config.DevUser.FolderId,
+		Usage:     quota,
 	}
 
-	err := pages.Main(data).Render(r.Context(), w)
+	err = pages.Main(data).Render(r.Context(), w)
 	if err != nil {
 		logger.LogError("Error rendering dev page: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -45,12 +100,42 @@ func DevHomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// renderHome renders the whole page for a user who already has a session
+func renderHome(w http.ResponseWriter, r *http.Request, username string, session models.Session) {
+	user, err := database.GetUser(username)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+	quota, err := userQuota(user.UserId)
+	if err != nil {
+		logger.LogError("Error retrieving quota: %v", err)
+	}
+	data := pages.PageData{
+		Username:  username,
+		CSRFToken: session.CSRFToken,
+		FolderId:  user.FolderId,
+		Usage:     quota,
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := pages.Home(data).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering home page: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// LoginHandler checks a username and password with each authenticator in
+// turn, local passwords first and then the directory if configured.
 // TODO work on responses for user not found and incorrect password
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if len(authenticators) == 0 {
+		http.Error(w, "Password login is turned off, use single sign-on", http.StatusForbidden)
+		return
+	}
 
 	err := r.ParseForm()
 	if err != nil {
@@ -63,33 +148,96 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	logger.LogInfo("Login request received for user: %s", login.Username)
 
-	user, err := database.GetUser(login.Username)
-	if err != nil {
+	identity, err := authenticators.Authenticate(r.Context(), login.Username, login.Password)
+	switch {
+	case errors.Is(err, auth.ErrUnknownUser):
 		logger.LogWarning("User not found: %s", login.Username)
 		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"login" : {"username" : "%s", "type" : "error"}}`, login.Username))
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusNotFound)
 		return
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		logger.LogWarning("Incorrect password for user %s: %v", login.Username, err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"login" : {"username" : "%s", "type" : "error"}}`, login.Username))
+		// w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		logger.LogError("Error checking password of %s: %v", login.Username, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	username, user, err := loginUser(identity)
+	if errors.Is(err, database.ErrNameTaken) {
+		logger.LogWarning("Directory user %s clashes with an existing account", identity.Username)
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"login" : {"username" : "%s", "type" : "error", "message" : "An account called %s already exists"}}`, identity.Username, identity.Username))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.LogError("Error logging in %s: %v", identity.Username, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
 	}
 
-	// Compare password with stored hash
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(login.Password))
+	// Users who registered with an email address verify it first
+	unverified, err := emailUnverified(user.UserId, username)
 	if err != nil {
-		logger.LogWarning("Incorrect password for user: %s", login.Username)
+		logger.LogError("Error checking email address of %s: %v", username, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	if unverified {
+		logger.LogWarning("User %s has not verified their email address", username)
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"login" : {"username" : "%s", "type" : "error", "message" : %q}}`,
+			username, "Verify your email address with the link we sent to it, then log in"))
 		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"login" : {"username" : "%s", "type" : "error"}}`, login.Username))
-		// w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Users with two-factor authentication get a second step first
+	enabled, err := database.TwoFactorEnabled(user.UserId)
+	if err != nil {
+		logger.LogError("Error checking two-factor authentication: %v", err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		logger.LogInfo("Asking user %s for a two-factor code", username)
+		renderTwoFactorLogin(w, r, user.UserId, false)
+		return
+	}
+	finishLogin(w, r, username, user)
+}
+
+// finishLogin starts a session for a user who has passed every step of
+// logging in and renders their page
+func finishLogin(w http.ResponseWriter, r *http.Request, username string, user database.UserData) {
+	quota, err := userQuota(user.UserId)
+	if err != nil {
+		logger.LogError("Error retrieving quota: %v", err)
+	}
+
+	// The page authenticates its requests with the session cookie
+	session, err := startSession(w, user.UserId)
+	if err != nil {
+		logger.LogError("Error starting session: %v", err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
 	data := pages.PageData{
-		Username: login.Username,
-		Key:      user.APIKey,
-		FolderId: user.FolderId,
+		Username:  username,
+		CSRFToken: session.CSRFToken,
+		FolderId:  user.FolderId,
+		Usage:     quota,
 	}
 
-	logger.LogInfo("Logged in user: %s", login.Username)
+	logger.LogInfo("Logged in user: %s", username)
 	err = pages.Main(data).Render(r.Context(), w)
 
 	if err != nil {
@@ -97,11 +245,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	logger.LogInfo("User logged in successfully: %s", login.Username)
+	logger.LogInfo("User logged in successfully: %s", username)
 
 }
 
 func ShowRegisterPage(w http.ResponseWriter, r *http.Request) {
+	if passwordLoginOff(w) {
+		return
+	}
 	err := pages.Register().Render(r.Context(), w)
 	fmt.Println("Show register page request received!!", err)
 	if err != nil {
@@ -115,6 +266,9 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if passwordLoginOff(w) {
+		return
+	}
 	fmt.Println("Register request received!!")
 	err := r.ParseForm()
 	if err != nil {
@@ -126,6 +280,14 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		Username: r.FormValue("username"),
 		Password: r.FormValue("password"),
 	}
+	email, err := mail.Address(r.FormValue("email"))
+	if err != nil {
+		logger.LogWarning("Invalid email address for %s: %v", register.Username, err)
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"register" : {"username" : "%s", "type" : "error", "message" : %q}}`,
+			register.Username, "Invalid email address"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	exists := database.UsernameExists(register.Username)
 	if exists {
@@ -143,15 +305,24 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	register.Password = string(hashedPassword)
 
-	err = database.CreateUser(register.Username, register.Password)
+	userId, err := database.CreateUser(register.Username, register.Password, email)
 	if err != nil {
 		logger.LogError("Error creating user: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// The reply is the same whether or not the address belongs to someone
+	// else, so it shows nobody which addresses have accounts
+	err = sendVerification(userId, register.Username, email)
+	if errors.Is(err, database.ErrEmailTaken) {
+		logger.LogWarning("User %s registered with the verified address of another user", register.Username)
+	} else if err != nil {
+		logger.LogError("Error sending verification email: %v", err)
+	}
 
 	logger.LogInfo("User created successfully: %s", register.Username)
-	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"register" : {"username" : "%s", "type" : "success"}}`, register.Username))
+	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"register" : {"username" : "%s", "type" : "success", "message" : %q}}`,
+		register.Username, "Account created, check "+email+" for a link to verify it"))
 	w.Write([]byte(""))
 }
 
@@ -172,7 +343,14 @@ func FilePathHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !keyAllowed(w, r, folderId, 0) {
+		return
+	}
 	filePath, err := database.FilePath(folderId, userData.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		logger.LogError("Error retrieving file path: %v", err)
 		http.Error(w, "Error retrieving file path", http.StatusInternalServerError)
@@ -192,13 +370,24 @@ func ItemsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	folderId, err := extractFolderId(r)
+	// Opening a folder passes it as folder_id, otherwise the current
+	// folder comes from the header
+	var folderId int64
+	var err error
+	if r.FormValue("folder_id") != "" {
+		folderId, err = formId(r, "folder_id")
+	} else {
+		folderId, err = extractFolderId(r)
+	}
 	if err != nil {
 		logger.LogError("Error parsing folder ID: %v", err)
 		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
 		return
 	}
 
+	if !keyAllowed(w, r, folderId, 0) {
+		return
+	}
 	files, err := database.GetFiles(folderId, userData.UserId)
 	if err != nil {
 		logger.LogError("Error retrieving files for user %d, folder %d: %v",
@@ -253,55 +442,231 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse the multipart form (64MB max)
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		logger.LogError("Error parsing multipart form: %v", err)
-		http.Error(w, "Error processing file upload", http.StatusBadRequest)
+	// Files uploaded into a folder shared with the user belong to the
+	// folder's owner and count towards their quota
+	if !keyAllowed(w, r, folderId, 0) {
 		return
 	}
-
-	// Get the file from form data
-	file, header, err := r.FormFile("file")
+	ownerId, err := folderOwner(folderId, userData.UserId, models.RoleEditor)
 	if err != nil {
-		logger.LogError("Error retrieving file from form: %v", err)
-		http.Error(w, "No file provided", http.StatusBadRequest)
+		uploadDenied(w, err)
 		return
 	}
-	defer file.Close()
 
-	// Read file contents
-	fileBytes, err := io.ReadAll(file)
+	// Reject uploads that cannot fit before reading any of the body. The
+	// request length includes multipart framing, so this is only a first
+	// check; the exact size is enforced while reading each file.
+	quota, err := userQuota(ownerId)
 	if err != nil {
-		logger.LogError("Error reading file: %v", err)
-		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		http.Error(w, "Error checking storage quota", http.StatusInternalServerError)
 		return
 	}
-
-	// Create file record in database
-	fileData := models.UploadFile{
-		UserId:    userData.UserId,
-		FileName:  header.Filename,
-		FolderId:  folderId,
-		Content:   fileBytes,
-		Size:      header.Size,
-		CreatedAt: time.Now(),
+	if r.ContentLength > 0 && !quota.AllowsBytes(r.ContentLength) {
+		quotaExceeded(w, "Upload exceeds storage quota")
+		return
 	}
 
-	// implementing upload function
-	err = database.SaveFile(fileData)
+	// Read the multipart stream part by part so file contents go straight
+	// to storage instead of being buffered in memory or temp files
+	reader, err := r.MultipartReader()
 	if err != nil {
-		logger.LogError("Error saving file to database: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		logger.LogError("Error reading multipart form: %v", err)
+		http.Error(w, "Error processing file upload", http.StatusBadRequest)
 		return
 	}
 
-	logger.LogInfo("File uploaded successfully: %s", header.Filename)
+	// With extract=true, archives are unpacked into the folder instead of
+	// being stored as one file
+	extract := r.URL.Query().Get("extract") == "true"
+	var results []extractResult
+
+	uploaded := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.LogError("Error reading multipart part: %v", err)
+			http.Error(w, "Error processing file upload", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		if format := archiveFormat(part.FileName()); extract && format != "" {
+			x, err := extractArchive(r.Context(), ownerId, folderId, quota, format, part)
+			part.Close()
+			results = append(results, x.results...)
+			quota = x.quota
+			if err != nil {
+				extractFailed(w, part.FileName(), err, results)
+				return
+			}
+			logger.LogInfo("Extracted %s: %d entries", part.FileName(), len(x.results))
+			uploaded++
+			continue
+		}
+
+		allowed, isNew, err := allowsFile(quota, ownerId, folderId, part.FileName())
+		if err != nil {
+			part.Close()
+			http.Error(w, "Error checking storage quota", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			part.Close()
+			quotaExceeded(w, "File limit reached")
+			return
+		}
+
+		body := &quotaReader{r: part, remaining: quota.RemainingBytes()}
+		fileData, err := storeUpload(r.Context(), ownerId, folderId, part.FileName(), body)
+		part.Close()
+		if body.exceeded {
+			logger.LogWarning("Upload %s exceeds quota of user %d", part.FileName(), ownerId)
+			quotaExceeded(w, "Upload exceeds storage quota")
+			return
+		}
+		if err != nil {
+			logger.LogError("Error saving upload %s: %v", part.FileName(), err)
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			return
+		}
+		logger.LogInfo("File uploaded successfully: %s (%d bytes, sha256 %s)",
+			fileData.FileName, fileData.Size, fileData.Hash)
+		quota.UsedBytes += fileData.Size
+		if isNew {
+			quota.UsedFiles++
+		}
+		uploaded++
+	}
+
+	if uploaded == 0 {
+		logger.LogError("No file found in upload request")
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+
+	if extract {
+		writeExtractResults(w, http.StatusOK, `{"upload" : "success"}`, results)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("HX-Trigger", `{"upload" : "success"}`)
 	w.WriteHeader(http.StatusOK)
 }
 
+// storeUpload streams r into the blob store and records it as a file in
+// folderId. The size and SHA-256 of the contents are computed on the way
+// through so the data is only read once, then used to deduplicate.
+// Contents are compressed with the configured encoding unless their type
+// shows they are already compressed, and encrypted when a master key is
+// configured.
+func storeUpload(ctx context.Context, userId int, folderId int64, fileName string, r io.Reader) (models.UploadFile, error) {
+	// Sniff the start of the data to decide whether to compress it
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(512)
+	encoding := storage.EncodingNone
+	if appConfig.Compression != "none" && storage.ShouldCompress(detectContentType(fileName, head)) {
+		encoding = appConfig.Compression
+	}
+
+	hash := sha256.New()
+	var size countingWriter
+	var body io.Reader = io.TeeReader(br, io.MultiWriter(hash, &size))
+	if encoding != storage.EncodingNone {
+		compressed := storage.Compress(body, encoding)
+		defer compressed.Close()
+		body = compressed
+	}
+
+	// Seal the (compressed) contents with the owner's data key
+	keyUserId := 0
+	if encryption.Enabled() {
+		dataKey, err := userDataKey(userId)
+		if err != nil {
+			return models.UploadFile{}, fmt.Errorf("error loading data key: %v", err)
+		}
+		encrypted := encryption.Encrypt(body, dataKey)
+		defer encrypted.Close()
+		body = encrypted
+		keyUserId = userId
+	}
+
+	storageKey := storage.NewKey()
+	stored, err := storage.Store.Put(ctx, storageKey, body)
+	if err != nil {
+		return models.UploadFile{}, fmt.Errorf("error writing file to storage: %v", err)
+	}
+	if encoding != storage.EncodingNone {
+		logger.LogDebug("Compressed %s with %s: %d -> %d bytes", fileName, encoding, int64(size), stored)
+	}
+
+	fileData := models.UploadFile{
+		UserId:     userId,
+		FileName:   fileName,
+		FolderId:   folderId,
+		StorageKey: storageKey,
+		Size:       int64(size),
+		Hash:       hex.EncodeToString(hash.Sum(nil)),
+		Encoding:   encoding,
+		KeyUserId:  keyUserId,
+		CreatedAt:  time.Now(),
+	}
+
+	fileId, version, reused, err := database.SaveFile(fileData)
+	if err != nil || reused {
+		// Either the record was not saved or identical contents are
+		// already stored, so this copy is not needed
+		if err := storage.Store.Delete(ctx, storageKey); err != nil {
+			logger.LogError("Error removing unused blob %s: %v", storageKey, err)
+		}
+	}
+	if err != nil {
+		return models.UploadFile{}, fmt.Errorf("error saving file to database: %v", err)
+	}
+	if reused {
+		logger.LogDebug("Contents of %s already stored, linked to existing blob", fileName)
+	}
+
+	if version > 1 {
+		logger.LogInfo("Saved %s as version %d of file %d", fileName, version, fileId)
+		pruneVersions(ctx, fileId, userId, appConfig.VersionsKeep, appConfig.VersionsMaxAge)
+	}
+	return fileData, nil
+}
+
+// deleteBlobs removes blobs that are no longer referenced from the store.
+// Failures are only logged since the database no longer points at them.
+func deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := storage.Store.Delete(ctx, key); err != nil {
+			logger.LogError("Error removing unused blob %s: %v", key, err)
+		}
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// detectContentType guesses a file's MIME type from its extension, falling
+// back to sniffing the first bytes of its contents
+func detectContentType(fileName string, head []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(fileName)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(head)
+}
+
 func extractFolderId(r *http.Request) (int64, error) {
 	folderIdStr := r.Header.Get("X-Folder-ID")
 	if folderIdStr == "" {
@@ -316,9 +681,15 @@ func extractFolderId(r *http.Request) (int64, error) {
 	return folderId, nil
 }
 
-// TODO work through this
+// DownloadHandler serves a file's contents. Range requests, conditional
+// requests and HEAD are handled by serveFile.
 func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	logger.LogInfo("Download request received")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
 	logger.LogDebug("Download: user data retrieved from context: %v", userData)
 	if !ok || userData.UserId == 0 {
@@ -336,21 +707,34 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileData, err := database.GetFile(fileId, userData.UserId)
-	if err != nil {
-		logger.LogError("Error retrieving file from database: %v", err)
-		http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+	if !keyAllowed(w, r, 0, fileId) {
 		return
 	}
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileData.FileName))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-
-	_, err = w.Write(fileData.Content)
+	// An optional ?version=N serves an older version of the file
+	var fileData models.File
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, parseErr := strconv.Atoi(v)
+		if parseErr != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		var ownerId int
+		if ownerId, err = fileOwner(fileId, userData.UserId, models.RoleViewer); err == nil {
+			fileData, err = database.GetFileVersion(fileId, ownerId, version)
+		}
+	} else {
+		fileData, err = database.GetFile(fileId, userData.UserId)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		logger.LogError("Error writing file to response: %v", err)
-		http.Error(w, "Error writing file to response", http.StatusInternalServerError)
+		logger.LogError("Error retrieving file from database: %v", err)
+		http.Error(w, "Error retrieving file", http.StatusInternalServerError)
 		return
 	}
+
+	serveFile(w, r, fileData)
 }
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+const maxKeyNameLength = 100
+
+// KeysHandler lists the user's API keys
+func KeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	renderKeys(w, r, userData, "")
+}
+
+// CreateKeyHandler generates an API key called name and shows it once.
+// The "Generate API Key" button asks for the name with hx-prompt, which
+// htmx sends in the HX-Prompt header. The optional scope (read, upload or
+// admin, the default) limits what the key can do, folder_id limits a read
+// or upload key to one folder and what is below it, and expires_in (a
+// duration such as "720h") makes the key stop working after that long.
+func CreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		name = r.Header.Get("HX-Prompt")
+	}
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		itemError(w, http.StatusBadRequest, "Key name cannot be empty")
+		return
+	case len(name) > maxKeyNameLength:
+		itemError(w, http.StatusBadRequest, "Key name is too long")
+		return
+	}
+
+	key := models.APIKey{Name: name, Scope: models.ScopeAdmin}
+	if v := r.FormValue("scope"); v != "" {
+		key.Scope = models.Scope(v)
+		if !key.Scope.Valid() {
+			itemError(w, http.StatusBadRequest, "Invalid scope")
+			return
+		}
+	}
+	if v := r.FormValue("folder_id"); v != "" && v != "0" {
+		folderId, err := formId(r, "folder_id")
+		if err != nil {
+			itemError(w, http.StatusBadRequest, "Invalid folder ID")
+			return
+		}
+		// Admin keys can manage keys and sharing, which no folder limits
+		if key.Scope == models.ScopeAdmin {
+			itemError(w, http.StatusBadRequest, "Admin keys cannot be limited to a folder")
+			return
+		}
+		role := models.RoleViewer
+		if key.Scope == models.ScopeUpload {
+			role = models.RoleEditor
+		}
+		if _, err := folderOwner(folderId, userData.UserId, role); err != nil {
+			itemResult(w, err, "create a key for this folder")
+			return
+		}
+		key.FolderId = folderId
+	}
+	if v := r.FormValue("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			itemError(w, http.StatusBadRequest, "Invalid expiry")
+			return
+		}
+		key.ExpiresAt = time.Now().Add(d)
+	}
+
+	key, secret, err := database.CreateAPIKey(userData.UserId, key)
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Could not create API key")
+		return
+	}
+	logger.LogInfo("User %d created %s API key %d (%s)", userData.UserId, key.Scope, key.Id, name)
+
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderKeys(w, r, userData, secret)
+}
+
+// RevokeKeyHandler deletes the API key id. The key the request was made
+// with cannot be revoked this way, so the web interface keeps working.
+func RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := formId(r, "id")
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid key ID")
+		return
+	}
+	if id == userData.KeyId {
+		itemError(w, http.StatusConflict, "This key is in use by the current session")
+		return
+	}
+	err = database.RevokeAPIKey(id, userData.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		itemError(w, http.StatusNotFound, "Key not found")
+		return
+	}
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Could not revoke API key")
+		return
+	}
+	logger.LogInfo("User %d revoked API key %d", userData.UserId, id)
+	renderKeys(w, r, userData, "")
+}
+
+// renderKeys lists the user's keys, showing newKey above them if one was
+// just created
+func renderKeys(w http.ResponseWriter, r *http.Request, userData database.UserData, newKey string) {
+	keys, err := database.GetAPIKeys(userData.UserId)
+	if err != nil {
+		http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+		return
+	}
+	folders, err := database.GetFolderPaths(userData.UserId)
+	if err != nil {
+		http.Error(w, "Error retrieving folders", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.APIKeys(keys, folders, userData.KeyId, newKey).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering API keys: %v", err)
+		http.Error(w, "Error rendering API keys", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/storage"
+	"webserver/pkg/config"
+)
+
+// TestMain runs the tests against a fresh database and blob store in a
+// temporary directory, with the config the environment gives
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "handlers-test-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := func() int {
+		defer os.RemoveAll(dir)
+		if err := os.Chdir(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := logger.InitLogger("FATAL"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := database.InitDB(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer database.DB().Close()
+		if err := storage.InitStore(cfg, database.DB()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		Configure(cfg)
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+var testUsers atomic.Int64
+
+// newTestUser creates a user with a root folder and returns its id and
+// the id of the root folder
+func newTestUser(t *testing.T) (int, int64) {
+	t.Helper()
+	username := fmt.Sprintf("user%d", testUsers.Add(1))
+	if _, err := database.CreateUser(username, "", ""); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	userData, err := database.GetUser(username)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	return userData.UserId, userData.FolderId
+}
+
+// withConfig runs the test with changes to the config, restoring it
+// afterwards
+func withConfig(t *testing.T, change func(cfg *config.Config)) {
+	t.Helper()
+	saved := *appConfig
+	change(appConfig)
+	t.Cleanup(func() { *appConfig = saved })
+}
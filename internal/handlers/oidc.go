@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/models"
+	"webserver/internal/oidc"
+	"webserver/pkg/config"
+)
+
+// oidcProvider signs users in with single sign-on, nil when it is not
+// configured
+var oidcProvider *oidc.Provider
+
+// oidcStateCookie ties a sign-in to the browser that started it, so a
+// callback with someone else's state cannot log a user in as them
+const oidcStateCookie = "oidc_state"
+
+// configureOIDC sets up single sign-on from the loaded config
+func configureOIDC() {
+	oidcProvider = nil
+	if appConfig.OIDCIssuer == "" {
+		return
+	}
+	oidcProvider = oidc.NewProvider(appConfig.OIDCIssuer, appConfig.OIDCClientID,
+		appConfig.OIDCClientSecret, appConfig.OIDCScopes)
+}
+
+// oidcRedirectURL is the callback address registered with the provider
+func oidcRedirectURL(r *http.Request) string {
+	if appConfig.OIDCRedirectURL != "" {
+		return appConfig.OIDCRedirectURL
+	}
+	return baseURL(r) + "/oidc/callback"
+}
+
+func setStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   appConfig.CookieSecure,
+		// Lax so the cookie comes back on the provider's redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCLoginHandler starts single sign-on by sending the browser to the
+// provider with a new state, nonce and PKCE challenge
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if oidcProvider == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := oidc.RandomString()
+		if err != nil {
+			logger.LogError("Error generating sign-in state: %v", err)
+			http.Error(w, "Error starting sign-in", http.StatusInternalServerError)
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := oidcProvider.AuthURL(r.Context(), oidcRedirectURL(r), state, nonce, verifier)
+	if err != nil {
+		logger.LogError("Error contacting identity provider: %v", err)
+		http.Error(w, "Could not reach the identity provider", http.StatusBadGateway)
+		return
+	}
+	if err := database.SaveOIDCLogin(state, nonce, verifier); err != nil {
+		http.Error(w, "Error starting sign-in", http.StatusInternalServerError)
+		return
+	}
+	setStateCookie(w, state, 600)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler finishes single sign-on. It redeems the code the
+// provider sent back, creates the user the first time they sign in, maps
+// their role claim to group roles and starts a session.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if oidcProvider == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		logger.LogWarning("Identity provider returned %s: %s", e, query.Get("error_description"))
+		http.Error(w, "Sign-in was not completed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		logger.LogWarning("Sign-in callback with a state this browser did not start")
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	setStateCookie(w, "", -1)
+	nonce, verifier, err := database.TakeOIDCLogin(state)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error finishing sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := oidcProvider.Exchange(r.Context(), oidcRedirectURL(r), query.Get("code"), verifier, nonce)
+	if err != nil {
+		logger.LogError("Error redeeming sign-in code: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	// New users are named after the configured claim; later sign-ins find
+	// them by subject even if the claim changes
+	emailVerified := claims.Bool("email_verified")
+	name := claims.String(appConfig.OIDCUsernameClaim)
+	if name == "" && emailVerified {
+		name = claims.String("email")
+	}
+	if name == "" {
+		name = claims.String("sub")
+	}
+	// Existing accounts are only linked on a claim the provider vouches
+	// for, never on a name users may be able to pick at the provider
+	var linkName, linkEmail string
+	if appConfig.OIDCLinkExisting {
+		if appConfig.OIDCLinkClaim == "email" {
+			if emailVerified {
+				linkEmail = claims.String("email")
+			}
+		} else {
+			linkName = claims.String(appConfig.OIDCLinkClaim)
+		}
+	}
+	username, err := database.OIDCUser(claims.String("iss"), claims.String("sub"), name, linkName, linkEmail)
+	if errors.Is(err, database.ErrNameTaken) {
+		logger.LogWarning("Single sign-on user %s clashes with an existing account", name)
+		http.Error(w, "An account called "+name+" already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error finishing sign-in", http.StatusInternalServerError)
+		return
+	}
+	user, err := database.GetUser(username)
+	if err != nil {
+		http.Error(w, "Error finishing sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	if len(appConfig.OIDCRoleMap) > 0 {
+		values := claims.Strings(appConfig.OIDCRoleClaim)
+		roles, managed := mapRoles(appConfig.OIDCRoleMap, func(value string) bool {
+			return slices.Contains(values, value)
+		})
+		if err := database.SyncGroupRoles(user.UserId, roles, managed); err != nil {
+			http.Error(w, "Error finishing sign-in", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Accounts that turned on two-factor authentication here, such as
+	// local ones linked on their first sign-on, still need their code
+	enabled, err := database.TwoFactorEnabled(user.UserId)
+	if err != nil {
+		logger.LogError("Error checking two-factor authentication: %v", err)
+		http.Error(w, "Error finishing sign-in", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		logger.LogInfo("Asking single sign-on user %s for a two-factor code", username)
+		renderTwoFactorLogin(w, r, user.UserId, true)
+		return
+	}
+	if _, err := startSession(w, user.UserId); err != nil {
+		logger.LogError("Error starting session: %v", err)
+		http.Error(w, "Error finishing sign-in", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("User %s signed in with single sign-on", username)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// mapRoles works out the role in each mapped group given which values,
+// such as a user's role claim or directory groups, the user has, keeping
+// the highest when several match. managed lists every group the mapping
+// mentions.
+func mapRoles(mapping []config.RoleMapping, has func(value string) bool) (roles map[string]models.Role, managed []string) {
+	roles = make(map[string]models.Role)
+	for _, m := range mapping {
+		if !slices.Contains(managed, m.Group) {
+			managed = append(managed, m.Group)
+		}
+		if !has(m.Value) {
+			continue
+		}
+		if role := models.Role(m.Role); role.Rank() > roles[m.Group].Rank() {
+			roles[m.Group] = role
+		}
+	}
+	return roles, managed
+}
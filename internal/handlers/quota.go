@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// userQuota returns the user's limits and usage, using the configured
+// defaults for limits the user does not have
+func userQuota(userId int) (models.Quota, error) {
+	return database.GetQuota(userId, appConfig.QuotaBytes, appConfig.QuotaFiles)
+}
+
+// quotaExceeded rejects an upload with 413 and tells the UI why
+func quotaExceeded(w http.ResponseWriter, message string) {
+	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"upload" : {"type" : "error", "message" : %q}}`, message))
+	http.Error(w, message, http.StatusRequestEntityTooLarge)
+}
+
+// allowsFile reports whether storing fileName in the folder fits the
+// file limit, and whether it would be a new file. Uploading a name that
+// already exists only adds a version, so it is always allowed.
+func allowsFile(quota models.Quota, ownerId int, folderId int64, fileName string) (allowed, isNew bool, err error) {
+	exists, err := database.FileExists(folderId, fileName, ownerId)
+	if err != nil {
+		return false, false, err
+	}
+	return exists || quota.AllowsFiles(1), !exists, nil
+}
+
+// quotaReader fails once more than remaining bytes are read from r, so an
+// upload stops as soon as it goes over quota. A negative remaining means
+// no limit.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	read      int64
+	exceeded  bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.read += int64(n)
+	if q.remaining >= 0 && q.read > q.remaining {
+		q.exceeded = true
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// UsageHandler renders the user's storage usage
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	quota, err := userQuota(userData.UserId)
+	if err != nil {
+		http.Error(w, "Error retrieving usage", http.StatusInternalServerError)
+		return
+	}
+	if err := components.Usage(quota).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering usage: %v", err)
+		http.Error(w, "Error rendering usage", http.StatusInternalServerError)
+	}
+}
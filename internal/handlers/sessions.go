@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+)
+
+// startSession logs the user in and sets the session cookie. The cookie is
+// HttpOnly so scripts on the page cannot read the token.
+func startSession(w http.ResponseWriter, userId int) (models.Session, error) {
+	token, session, err := database.CreateSession(userId)
+	if err != nil {
+		return models.Session{}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.SessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(appConfig.SessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   appConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	logger.LogInfo("Started session %d for user %d", session.Id, userId)
+	return session, nil
+}
+
+// currentSession returns the session of the request's cookie, if it has a
+// valid one
+func currentSession(r *http.Request) (database.UserData, models.Session, bool) {
+	cookie, err := r.Cookie(middleware.SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return database.UserData{}, models.Session{}, false
+	}
+	userData, session, err := database.GetUserBySession(cookie.Value)
+	if err != nil {
+		return database.UserData{}, models.Session{}, false
+	}
+	return userData, session, true
+}
+
+// LogoutHandler ends the session of the request and clears its cookie,
+// sending the page back to the login form
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(middleware.SessionCookie); err == nil && cookie.Value != "" {
+		if err := database.DeleteSession(cookie.Value); err != nil {
+			http.Error(w, "Error logging out", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   appConfig.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("HX-Redirect", "/")
+	w.WriteHeader(http.StatusOK)
+}
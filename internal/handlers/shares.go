@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+	"webserver/templates/pages"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newShareToken returns a random, URL safe share link token
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// A counted download of a shared file sets a cookie that lets the same
+// browser ask for the rest of it with Range requests for a while without
+// using up more downloads
+const (
+	shareDownloadCookie = "share_download"
+	shareDownloadTTL    = time.Hour
+)
+
+// shareDownloadSecret signs download cookies. It is made anew on every
+// start, so downloads resumed across a restart count again.
+var shareDownloadSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// shareDownloadMAC signs the link token and expiry of a download cookie
+func shareDownloadMAC(token string, expires int64) string {
+	mac := hmac.New(sha256.New, shareDownloadSecret)
+	mac.Write([]byte(token + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setShareDownloadCookie marks the download of a share link as counted
+func setShareDownloadCookie(w http.ResponseWriter, link models.ShareLink) {
+	expires := time.Now().Add(shareDownloadTTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareDownloadCookie,
+		Value:    strconv.FormatInt(expires, 10) + "." + shareDownloadMAC(link.Token, expires),
+		Path:     "/s/" + link.Token + "/",
+		MaxAge:   int(shareDownloadTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   appConfig.CookieSecure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// resumedDownload reports whether a request continues a download of the
+// link with the given token that was already counted: it asks for a range
+// and carries a valid download cookie
+func resumedDownload(r *http.Request, token string) bool {
+	if r.Header.Get("Range") == "" {
+		return false
+	}
+	cookie, err := r.Cookie(shareDownloadCookie)
+	if err != nil {
+		return false
+	}
+	expiresStr, mac, _ := strings.Cut(cookie.Value, ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(shareDownloadMAC(token, expires)))
+}
+
+// baseURL returns the address share links point at: the configured public
+// URL, or the scheme and host the request came in on
+func baseURL(r *http.Request) string {
+	if appConfig.PublicURL != "" {
+		return appConfig.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// ShareModalHandler renders the form for a new share link to folder_id or
+// file_id
+func ShareModalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	item, err := formItem(r, userData.UserId)
+	if err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.ShareModal(item).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering share modal: %v", err)
+		http.Error(w, "Error rendering share modal", http.StatusInternalServerError)
+	}
+}
+
+// CreateShareHandler creates a share link to folder_id or file_id and
+// responds with it as JSON. The optional expires_in (a duration such as
+// 24h), max_downloads and password restrict the link.
+func CreateShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	link := models.ShareLink{CreatedBy: userData.UserId}
+	var err error
+	if r.FormValue("folder_id") != "" {
+		link.FolderId, err = formId(r, "folder_id")
+	} else {
+		link.FileId, err = formId(r, "file_id")
+	}
+	if err != nil {
+		itemError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	// Links make an item public, so only its owners may create them. The
+	// link belongs to the drive the item is in.
+	if link.IsFolder() {
+		link.UserId, err = folderOwner(link.FolderId, userData.UserId, models.RoleOwner)
+	} else {
+		link.UserId, err = fileOwner(link.FileId, userData.UserId, models.RoleOwner)
+	}
+	if err != nil {
+		itemResult(w, err, "share this item")
+		return
+	}
+	if v := r.FormValue("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			itemError(w, http.StatusBadRequest, "Invalid expiry")
+			return
+		}
+		link.ExpiresAt = time.Now().Add(d)
+	}
+	if v := r.FormValue("max_downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			itemError(w, http.StatusBadRequest, "Invalid maximum downloads")
+			return
+		}
+		link.MaxDownloads = n
+	}
+	if password := r.FormValue("password"); password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			logger.LogError("Error hashing share link password: %v", err)
+			itemError(w, http.StatusInternalServerError, "Could not create link")
+			return
+		}
+		link.PasswordHash = string(hash)
+	}
+	if link.Token, err = newShareToken(); err != nil {
+		logger.LogError("Error generating share token: %v", err)
+		itemError(w, http.StatusInternalServerError, "Could not create link")
+		return
+	}
+
+	link.Id, err = database.CreateShareLink(link)
+	if errors.Is(err, sql.ErrNoRows) {
+		itemError(w, http.StatusNotFound, "Item not found")
+		return
+	}
+	if err != nil {
+		itemError(w, http.StatusInternalServerError, "Could not create link")
+		return
+	}
+	logger.LogInfo("User %d created share link %d", userData.UserId, link.Id)
+
+	response := map[string]any{"id": link.Id, "link": baseURL(r) + "/s/" + link.Token}
+	if !link.ExpiresAt.IsZero() {
+		response["expires_at"] = link.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.LogError("Error writing share link: %v", err)
+	}
+}
+
+// SharesHandler lists the user's active share links
+func SharesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	renderShareLinks(w, r, userData.UserId)
+}
+
+// RevokeShareHandler revokes the share link id and renders the remaining
+// links
+func RevokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := formId(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid link ID", http.StatusBadRequest)
+		return
+	}
+	err = database.RevokeShareLink(id, userData.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking link", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("User %d revoked share link %d", userData.UserId, id)
+	renderShareLinks(w, r, userData.UserId)
+}
+
+func renderShareLinks(w http.ResponseWriter, r *http.Request, userId int) {
+	links, err := database.GetShareLinks(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving share links", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.ShareLinks(links, baseURL(r)).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering share links: %v", err)
+		http.Error(w, "Error rendering share links", http.StatusInternalServerError)
+	}
+}
+
+// sharedLink looks up the share link in the request path, rendering the
+// unavailable page if it cannot be used. A started download may finish
+// after the link ran out of downloads.
+func sharedLink(w http.ResponseWriter, r *http.Request, started bool) (models.ShareLink, bool) {
+	link, err := database.GetShareLink(r.PathValue("token"), started)
+	if err == nil && link.IsFolder() {
+		link.Size, _, err = database.FolderSize(link.FolderId, link.UserId)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		renderSharePage(w, r, http.StatusNotFound, models.ShareLink{}, "")
+		return link, false
+	}
+	if err != nil {
+		logger.LogError("Error retrieving share link: %v", err)
+		http.Error(w, "Error retrieving link", http.StatusInternalServerError)
+		return link, false
+	}
+	return link, true
+}
+
+// PublicShareHandler renders the landing page of a share link. It needs no
+// API key.
+func PublicShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	link, ok := sharedLink(w, r, false)
+	if !ok {
+		return
+	}
+	renderSharePage(w, r, http.StatusOK, link, "")
+}
+
+// ShareDownloadHandler serves the item behind a share link: a file as is,
+// a folder as a ZIP archive. Links with a password must be downloaded with
+// a POST carrying it, and are locked for a while after too many wrong
+// passwords. Each download counts towards the link's limit, except HEAD
+// requests and Range requests resuming a download that was counted.
+func ShareDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Resumed downloads were counted, and had their password checked,
+	// when they started
+	resumed := r.Method != http.MethodHead && resumedDownload(r, r.PathValue("token"))
+	link, ok := sharedLink(w, r, resumed)
+	if !ok {
+		return
+	}
+
+	if link.HasPassword() && !resumed && !sharePasswordAccepted(w, r, link) {
+		return
+	}
+
+	if !link.IsFolder() {
+		file, err := database.GetFile(link.FileId, link.UserId)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodHead && !resumed {
+			if !useShareLink(w, r, link) {
+				return
+			}
+			setShareDownloadCookie(w, link)
+		}
+		serveFile(w, r, file)
+		return
+	}
+
+	// Archives are built anew for every request and ignore Range, so each
+	// one is a whole download
+	if r.Method != http.MethodHead && !useShareLink(w, r, link) {
+		return
+	}
+	entries, err := database.FolderTree(link.FolderId, link.UserId)
+	if err != nil || len(entries) == 0 {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": link.Name + ".zip"}))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := writeArchive(r.Context(), w, entries); err != nil {
+		logger.LogError("Error streaming shared folder: %v", err)
+	}
+}
+
+// sharePasswordAccepted checks the password posted for a share link,
+// rendering the share page with an error if it is wrong or the link is
+// locked
+func sharePasswordAccepted(w http.ResponseWriter, r *http.Request, link models.ShareLink) bool {
+	if r.Method != http.MethodPost {
+		renderSharePage(w, r, http.StatusUnauthorized, link, "Incorrect password")
+		return false
+	}
+	err := database.ShareLinkAttempt(link.Id)
+	if errors.Is(err, database.ErrShareLinkLocked) {
+		logger.LogWarning("Password attempt on locked share link %d", link.Id)
+		renderSharePage(w, r, http.StatusTooManyRequests, link, "Too many wrong passwords, try again later")
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving link", http.StatusInternalServerError)
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(r.PostFormValue("password"))) != nil {
+		logger.LogWarning("Wrong password for share link %d", link.Id)
+		renderSharePage(w, r, http.StatusUnauthorized, link, "Incorrect password")
+		return false
+	}
+	if err := database.ShareLinkPasswordAccepted(link.Id); err != nil {
+		http.Error(w, "Error retrieving link", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// useShareLink counts a download of a share link, rendering the
+// unavailable page if it has run out
+func useShareLink(w http.ResponseWriter, r *http.Request, link models.ShareLink) bool {
+	err := database.UseShareLink(link.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		renderSharePage(w, r, http.StatusGone, models.ShareLink{}, "")
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving link", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func renderSharePage(w http.ResponseWriter, r *http.Request, status int, link models.ShareLink, message string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := pages.Share(link, message).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering share page: %v", err)
+	}
+}
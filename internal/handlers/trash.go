@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+// DeleteFileHandler moves a file into the trash
+func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleEditor)
+	if err == nil {
+		err = database.TrashFile(fileId, ownerId)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "You do not have permission to delete this file", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("Moved file %d to the trash", fileId)
+
+	w.Header().Set("HX-Trigger", `{"delete" : {"type" : "success"}}`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteFolderHandler moves a folder and its contents into the trash
+func DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	folderId, err := strconv.ParseInt(r.FormValue("folder_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		return
+	}
+
+	ownerId, err := folderOwner(folderId, userData.UserId, models.RoleEditor)
+	if err == nil {
+		err = database.TrashFolder(folderId, ownerId)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "You do not have permission to delete this folder", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting folder", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("Moved folder %d to the trash", folderId)
+
+	w.Header().Set("HX-Trigger", `{"delete" : {"type" : "success"}}`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// trashOwner works out whose trash a request is about and checks that the
+// user has at least role on that drive. Requests name the drive with
+// owner_id, or with folder_id for any folder in it, and default to the
+// user's own drive.
+func trashOwner(r *http.Request, userId int, role models.Role) (int, error) {
+	ownerId := userId
+	if v := r.FormValue("owner_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, sql.ErrNoRows
+		}
+		ownerId = id
+	} else if v := r.FormValue("folder_id"); v != "" {
+		folderId, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, sql.ErrNoRows
+		}
+		if ownerId, _, err = database.FolderRole(folderId, userId); err != nil {
+			return 0, err
+		}
+	}
+
+	// Being granted access to part of a drive is not enough to see
+	// everything deleted from it
+	has, err := database.AccountRole(ownerId, userId)
+	if err != nil {
+		return 0, err
+	}
+	if has == "" {
+		return 0, sql.ErrNoRows
+	}
+	if !has.Allows(role) {
+		return 0, database.ErrForbidden
+	}
+	return ownerId, nil
+}
+
+// trashDenied rejects a request for a trash the user cannot use
+func trashDenied(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Trash not found", http.StatusNotFound)
+	case errors.Is(err, database.ErrForbidden):
+		w.Header().Set("HX-Trigger", `{"restore" : {"type" : "error", "message" : "You do not have permission to do this"}}`)
+		http.Error(w, "You do not have permission to do this", http.StatusForbidden)
+	default:
+		logger.LogError("Error checking trash access: %v", err)
+		http.Error(w, "Error checking trash access", http.StatusInternalServerError)
+	}
+}
+
+// TrashHandler renders the trash of the user's drive, or of the team drive
+// containing folder_id
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	ownerId, err := trashOwner(r, userData.UserId, models.RoleEditor)
+	if err != nil {
+		trashDenied(w, err)
+		return
+	}
+	renderTrash(w, r, ownerId, userData.UserId)
+}
+
+// RestoreTrashHandler takes a file or folder out of the trash. The form
+// sets either file_id or folder_id.
+func RestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	ownerId, err := trashOwner(r, userData.UserId, models.RoleEditor)
+	if err != nil {
+		trashDenied(w, err)
+		return
+	}
+
+	if v := r.FormValue("folder_id"); v != "" {
+		folderId, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+			return
+		}
+		_, err = database.RestoreFolder(folderId, ownerId)
+	} else {
+		fileId, parseErr := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+		if parseErr != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		_, err = database.RestoreFile(fileId, ownerId)
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Item not found in trash", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrNameConflict):
+		w.Header().Set("HX-Trigger", `{"restore" : {"type" : "error", "message" : "An item with this name already exists"}}`)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Error restoring item", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Trigger", `{"restore" : {"type" : "success"}, "triggerItems" : ""}`)
+	renderTrash(w, r, ownerId, userData.UserId)
+}
+
+// EmptyTrashHandler permanently deletes everything in the trash of the
+// user's drive, or of a team drive they own
+func EmptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	ownerId, err := trashOwner(r, userData.UserId, models.RoleOwner)
+	if err != nil {
+		trashDenied(w, err)
+		return
+	}
+
+	removed, orphanKeys, err := database.EmptyTrash(ownerId)
+	if err != nil {
+		http.Error(w, "Error emptying trash", http.StatusInternalServerError)
+		return
+	}
+	deleteBlobs(r.Context(), orphanKeys)
+	logger.LogInfo("Emptied trash of user %d, %d items removed", ownerId, removed)
+
+	w.Header().Set("HX-Trigger", `{"triggerItems" : ""}`)
+	renderTrash(w, r, ownerId, userData.UserId)
+}
+
+// renderTrash renders the trash of ownerId's drive as seen by userId
+func renderTrash(w http.ResponseWriter, r *http.Request, ownerId, userId int) {
+	files, folders, err := database.GetTrash(ownerId)
+	if err != nil {
+		http.Error(w, "Error retrieving trash", http.StatusInternalServerError)
+		return
+	}
+	role, err := database.AccountRole(ownerId, userId)
+	if err != nil {
+		http.Error(w, "Error checking trash access", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.Trash(files, folders, ownerId, role.Allows(models.RoleOwner)).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering trash: %v", err)
+		http.Error(w, "Error rendering trash", http.StatusInternalServerError)
+	}
+}
+
+// PurgeTrash permanently deletes items that have been in the trash for
+// longer than the configured retention, checking every interval until ctx
+// is cancelled
+func PurgeTrash(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removed, orphanKeys, err := database.PurgeTrash(time.Now().Add(-appConfig.TrashRetention))
+		if err != nil {
+			logger.LogError("Error purging trash: %v", err)
+		} else if removed > 0 {
+			deleteBlobs(ctx, orphanKeys)
+			logger.LogInfo("Purged %d items from the trash", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/internal/storage"
+)
+
+// Resumable uploads implement the tus 1.0 protocol (https://tus.io) with
+// the creation, termination and checksum extensions. Upload state lives in
+// the uploads table and partial data in TusUploadDir so an upload can be
+// resumed after a server restart.
+
+const tusVersion = "1.0.0"
+
+// statusChecksumMismatch is the tus specific status for a failed checksum
+const statusChecksumMismatch = 460
+
+var tusChecksums = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// tusLocks serializes PATCH and DELETE requests for the same upload
+var tusLocks sync.Map
+
+func lockUpload(id string) func() {
+	mu, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func uploadPath(id string) string {
+	return filepath.Join(appConfig.TusUploadDir, id)
+}
+
+// TusOptionsHandler answers tus discovery requests. It does not require
+// an API key so clients can probe the server before authenticating.
+func TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,checksum")
+	w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+	if appConfig.TusMaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(appConfig.TusMaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusHandler serves the tus upload collection (/tus/) and individual
+// uploads (/tus/{id})
+func TusHandler(w http.ResponseWriter, r *http.Request) {
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Clients behind proxies that only allow GET and POST tunnel the
+	// real method through this header. Only API key clients may, since
+	// sessions are checked for a CSRF token by the request's own method.
+	method := r.Method
+	_, withKey := r.Context().Value(middleware.APIKeyKey).(models.APIKey)
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && withKey {
+		method = override
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+	if id == "" {
+		if method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUpload(w, r, userData)
+		return
+	}
+
+	upload, err := database.GetUpload(id, userData.UserId)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Metadata != "" {
+			w.Header().Set("Upload-Metadata", upload.Metadata)
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		patchTusUpload(w, r, upload)
+	case http.MethodDelete:
+		unlock := lockUpload(upload.Id)
+		defer unlock()
+		if err := removeTusUpload(upload.Id); err != nil {
+			http.Error(w, "Error terminating upload", http.StatusInternalServerError)
+			return
+		}
+		logger.LogInfo("Upload %s terminated", upload.Id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createTusUpload(w http.ResponseWriter, r *http.Request, userData database.UserData) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if appConfig.TusMaxSize > 0 && length > appConfig.TusMaxSize {
+		http.Error(w, "Upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	rawMetadata := r.Header.Get("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		logger.LogError("Error parsing upload metadata: %v", err)
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+	fileName = filepath.Base(fileName)
+	if fileName == "" || fileName == "." || fileName == string(filepath.Separator) {
+		http.Error(w, "Upload-Metadata must include a filename", http.StatusBadRequest)
+		return
+	}
+
+	// The target folder comes from metadata, falling back to the header
+	// used by the regular upload endpoint
+	folderIdStr := metadata["folder_id"]
+	if folderIdStr == "" {
+		folderIdStr = r.Header.Get("X-Folder-ID")
+	}
+	folderId, err := strconv.ParseInt(folderIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid folder ID", http.StatusBadRequest)
+		return
+	}
+
+	// Uploads into a shared folder count towards its owner's quota
+	if !keyAllowed(w, r, folderId, 0) {
+		return
+	}
+	ownerId, err := folderOwner(folderId, userData.UserId, models.RoleEditor)
+	if err != nil {
+		uploadDenied(w, err)
+		return
+	}
+	quota, err := userQuota(ownerId)
+	if err != nil {
+		http.Error(w, "Error checking storage quota", http.StatusInternalServerError)
+		return
+	}
+	allowed, _, err := allowsFile(quota, ownerId, folderId, fileName)
+	if err != nil {
+		http.Error(w, "Error checking storage quota", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		quotaExceeded(w, "File limit reached")
+		return
+	}
+	// Unfinished uploads hold their whole length, so that many of them
+	// can't together go over the quota
+	pending, err := database.PendingUploadBytes(ownerId)
+	if err != nil {
+		http.Error(w, "Error checking storage quota", http.StatusInternalServerError)
+		return
+	}
+	if !quota.AllowsBytes(pending + length) {
+		quotaExceeded(w, "Upload exceeds storage quota")
+		return
+	}
+
+	upload := models.Upload{
+		Id:        storage.NewKey(),
+		UserId:    userData.UserId,
+		FolderId:  folderId,
+		FileName:  fileName,
+		Length:    length,
+		Metadata:  rawMetadata,
+		CreatedAt: time.Now(),
+	}
+
+	if err := os.MkdirAll(appConfig.TusUploadDir, 0o750); err != nil {
+		logger.LogError("Error creating upload directory: %v", err)
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Create(uploadPath(upload.Id))
+	if err != nil {
+		logger.LogError("Error creating partial upload file: %v", err)
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := database.CreateUpload(upload); err != nil {
+		os.Remove(uploadPath(upload.Id))
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("Created upload %s for %s (%d bytes)", upload.Id, upload.FileName, upload.Length)
+
+	w.Header().Set("Location", "/tus/"+upload.Id)
+
+	// An empty file is complete as soon as it is created
+	if upload.Length == 0 {
+		if err := finishTusUpload(r, upload); err == errQuotaExceeded {
+			quotaExceeded(w, "Upload exceeds storage quota")
+			return
+		} else if errors.Is(err, sql.ErrNoRows) || errors.Is(err, database.ErrForbidden) {
+			uploadDenied(w, err)
+			return
+		} else if err != nil {
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func patchTusUpload(w http.ResponseWriter, r *http.Request, upload models.Upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	unlock := lockUpload(upload.Id)
+	defer unlock()
+
+	// Re-read the offset now that no other request can change it
+	upload, err := database.GetUpload(upload.Id, upload.UserId)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, value, _ := strings.Cut(header, " ")
+		newHash, ok := tusChecksums[algorithm]
+		if !ok {
+			http.Error(w, "Unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+		expected, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			http.Error(w, "Invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+		checksum = newHash()
+	}
+
+	f, err := os.OpenFile(uploadPath(upload.Id), os.O_WRONLY, 0)
+	if err != nil {
+		logger.LogError("Error opening partial upload %s: %v", upload.Id, err)
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		logger.LogError("Error seeking partial upload %s: %v", upload.Id, err)
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Never accept more bytes than the declared length
+	var body io.Reader = io.LimitReader(r.Body, upload.Length-upload.Offset)
+	if checksum != nil {
+		body = io.TeeReader(body, checksum)
+	}
+	written, copyErr := io.Copy(f, body)
+
+	if checksum != nil && (copyErr != nil || string(checksum.Sum(nil)) != string(expected)) {
+		// The chunk is only usable if it verifies, so drop whatever was
+		// written and leave the offset where it was
+		if err := f.Truncate(upload.Offset); err != nil {
+			logger.LogError("Error truncating partial upload %s: %v", upload.Id, err)
+		}
+		if copyErr != nil {
+			logger.LogError("Error receiving upload %s: %v", upload.Id, copyErr)
+			http.Error(w, "Error writing upload", http.StatusInternalServerError)
+			return
+		}
+		logger.LogWarning("Checksum mismatch for upload %s", upload.Id)
+		http.Error(w, "Checksum mismatch", statusChecksumMismatch)
+		return
+	}
+
+	// Without a checksum every byte received is kept, even if the
+	// connection dropped, so the client can resume from there
+	upload.Offset += written
+	if err := database.UpdateUploadOffset(upload.Id, upload.Offset); err != nil {
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		logger.LogWarning("Upload %s interrupted at offset %d: %v", upload.Id, upload.Offset, copyErr)
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if err := f.Close(); err != nil {
+			logger.LogError("Error closing partial upload %s: %v", upload.Id, err)
+		}
+		if err := finishTusUpload(r, upload); err == errQuotaExceeded {
+			quotaExceeded(w, "Upload exceeds storage quota")
+			return
+		} else if errors.Is(err, sql.ErrNoRows) || errors.Is(err, database.ErrForbidden) {
+			uploadDenied(w, err)
+			return
+		} else if err != nil {
+			http.Error(w, "Error saving file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves a completed upload into the files table and blob
+// store, then removes the partial upload. The quota is checked again since
+// other uploads may have finished after this one was created; an upload
+// that no longer fits is discarded and errQuotaExceeded returned.
+func finishTusUpload(r *http.Request, upload models.Upload) error {
+	// Access to a shared folder may have been revoked in the meantime
+	ownerId, err := folderOwner(upload.FolderId, upload.UserId, models.RoleEditor)
+	if err != nil {
+		if err := removeTusUpload(upload.Id); err != nil {
+			logger.LogError("Error cleaning up upload %s: %v", upload.Id, err)
+		}
+		return err
+	}
+	quota, err := userQuota(ownerId)
+	if err != nil {
+		return err
+	}
+	allowed, _, err := allowsFile(quota, ownerId, upload.FolderId, upload.FileName)
+	if err != nil {
+		return err
+	}
+	if !allowed || !quota.AllowsBytes(upload.Length) {
+		logger.LogWarning("Upload %s exceeds quota of user %d", upload.Id, ownerId)
+		if err := removeTusUpload(upload.Id); err != nil {
+			logger.LogError("Error cleaning up upload %s: %v", upload.Id, err)
+		}
+		return errQuotaExceeded
+	}
+
+	f, err := os.Open(uploadPath(upload.Id))
+	if err != nil {
+		logger.LogError("Error opening completed upload %s: %v", upload.Id, err)
+		return err
+	}
+	defer f.Close()
+
+	fileData, err := storeUpload(r.Context(), ownerId, upload.FolderId, upload.FileName, f)
+	if err != nil {
+		logger.LogError("Error saving completed upload %s: %v", upload.Id, err)
+		return err
+	}
+	logger.LogInfo("File uploaded successfully: %s (%d bytes, sha256 %s)",
+		fileData.FileName, fileData.Size, fileData.Hash)
+
+	if err := removeTusUpload(upload.Id); err != nil {
+		logger.LogError("Error cleaning up upload %s: %v", upload.Id, err)
+	}
+	return nil
+}
+
+func removeTusUpload(id string) error {
+	if err := database.DeleteUpload(id); err != nil {
+		return err
+	}
+	if err := os.Remove(uploadPath(id)); err != nil && !os.IsNotExist(err) {
+		logger.LogError("Error removing partial upload %s: %v", id, err)
+		return err
+	}
+	tusLocks.Delete(id)
+	return nil
+}
+
+// ExpireUploads deletes unfinished uploads older than the configured TTL
+// along with their partial data, checking every interval until ctx is
+// cancelled
+func ExpireUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ids, err := database.ExpiredUploads(time.Now().Add(-appConfig.TusUploadTTL))
+		if err != nil {
+			logger.LogError("Error expiring uploads: %v", err)
+		}
+		for _, id := range ids {
+			unlock := lockUpload(id)
+			err := removeTusUpload(id)
+			unlock()
+			if err != nil {
+				logger.LogError("Error expiring upload %s: %v", id, err)
+				continue
+			}
+			logger.LogInfo("Upload %s expired", id)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header of comma separated
+// "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for metadata key %s: %v", key, err)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/totp"
+	"webserver/templates/components"
+	"webserver/templates/pages"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// qrSize is the width and height of enrollment QR codes in pixels
+const qrSize = 256
+
+// twoFactorResult maps errors from the two-factor operations to responses
+func twoFactorResult(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, database.ErrInvalidCode):
+		itemError(w, http.StatusBadRequest, "Invalid code")
+	case errors.Is(err, database.ErrTwoFactorLocked):
+		itemError(w, http.StatusTooManyRequests, "Too many invalid codes, try again later")
+	case errors.Is(err, database.ErrTwoFactorEnabled), errors.Is(err, database.ErrTwoFactorDisabled):
+		itemError(w, http.StatusConflict, err.Error())
+	default:
+		logger.LogError("Error trying to %s: %v", action, err)
+		itemError(w, http.StatusInternalServerError, "Could not "+action)
+	}
+}
+
+// TwoFactorHandler shows whether two-factor authentication is on
+func TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+	renderTwoFactor(w, r, userData.UserId)
+}
+
+// StartTwoFactorHandler generates a TOTP secret and shows it as a QR code
+// and provisioning URI to add to an authenticator app. Two-factor
+// authentication is only turned on once EnableTwoFactorHandler gets a
+// code from the app.
+func StartTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := database.StartTwoFactor(userData.UserId)
+	if err != nil {
+		twoFactorResult(w, err, "start two-factor setup")
+		return
+	}
+	username, err := database.GetUsername(userData.UserId)
+	if err != nil {
+		twoFactorResult(w, err, "start two-factor setup")
+		return
+	}
+	uri := totp.URI(appConfig.TOTPIssuer, username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrSize)
+	if err != nil {
+		twoFactorResult(w, err, "create QR code")
+		return
+	}
+	qr := "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.TwoFactorSetup(secret, uri, qr).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering two-factor setup: %v", err)
+		http.Error(w, "Error rendering two-factor setup", http.StatusInternalServerError)
+	}
+}
+
+// EnableTwoFactorHandler turns on two-factor authentication once the
+// code form value shows the app was set up, and shows the recovery codes
+func EnableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := database.EnableTwoFactor(userData.UserId, r.FormValue("code"))
+	if err != nil {
+		twoFactorResult(w, err, "enable two-factor authentication")
+		return
+	}
+	logger.LogInfo("User %d enabled two-factor authentication", userData.UserId)
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderRecoveryCodes(w, r, codes)
+}
+
+// DisableTwoFactorHandler turns off two-factor authentication. The code
+// form value must be a current code or an unused recovery code.
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	if err := database.DisableTwoFactor(userData.UserId, r.FormValue("code")); err != nil {
+		twoFactorResult(w, err, "disable two-factor authentication")
+		return
+	}
+	logger.LogInfo("User %d disabled two-factor authentication", userData.UserId)
+	w.Header().Set("HX-Trigger", `{"item" : {"type" : "success"}}`)
+	renderTwoFactor(w, r, userData.UserId)
+}
+
+// RecoveryCodesHandler replaces the user's recovery codes, checking the
+// code form value like DisableTwoFactorHandler
+func RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := database.RegenerateRecoveryCodes(userData.UserId, r.FormValue("code"))
+	if err != nil {
+		twoFactorResult(w, err, "create recovery codes")
+		return
+	}
+	logger.LogInfo("User %d created new recovery codes", userData.UserId)
+	renderRecoveryCodes(w, r, codes)
+}
+
+// LoginTwoFactorHandler is the second step of logging in for users with
+// two-factor authentication. It takes the challenge token LoginHandler
+// gave out and a code from the user's app or a recovery code.
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userId, err := database.CompleteLoginChallenge(r.FormValue("challenge"), r.FormValue("code"))
+	switch {
+	case errors.Is(err, database.ErrInvalidCode):
+		logger.LogWarning("Incorrect two-factor code")
+		w.Header().Set("HX-Trigger", `{"twofactor" : {"type" : "error", "message" : "Invalid code"}}`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case errors.Is(err, database.ErrTwoFactorLocked):
+		w.Header().Set("HX-Trigger", `{"twofactor" : {"type" : "error", "message" : "Too many invalid codes, try again later"}}`)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.LogWarning("Expired or unknown login challenge")
+		w.Header().Set("HX-Trigger", `{"twofactor" : {"type" : "error", "message" : "Login expired, please log in again"}}`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case err != nil:
+		logger.LogError("Error checking two-factor code: %v", err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := database.GetUsername(userId)
+	if err != nil {
+		logger.LogError("Error retrieving user %d: %v", userId, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	user, err := database.GetUser(username)
+	if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	finishLogin(w, r, username, user)
+}
+
+// renderTwoFactorLogin asks for the second factor of a login, as a whole
+// page if fullPage is set
+func renderTwoFactorLogin(w http.ResponseWriter, r *http.Request, userId int, fullPage bool) {
+	challenge, err := database.CreateLoginChallenge(userId)
+	if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	page := pages.TwoFactorLogin(challenge)
+	if fullPage {
+		page = pages.TwoFactorLoginPage(challenge)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := page.Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering two-factor login: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+func renderTwoFactor(w http.ResponseWriter, r *http.Request, userId int) {
+	status, err := database.GetTwoFactor(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving two-factor settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.TwoFactor(status).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering two-factor settings: %v", err)
+		http.Error(w, "Error rendering two-factor settings", http.StatusInternalServerError)
+	}
+}
+
+func renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.RecoveryCodes(codes).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering recovery codes: %v", err)
+		http.Error(w, "Error rendering recovery codes", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"webserver/internal/database"
+	"webserver/internal/logger"
+	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/templates/components"
+)
+
+// pruneVersions applies a retention policy to a file's versions and
+// removes blobs that are no longer needed
+func pruneVersions(ctx context.Context, fileId int64, userId int, keep int, maxAge time.Duration) (int, error) {
+	if keep == 0 && maxAge == 0 {
+		return 0, nil
+	}
+	removed, orphanKeys, err := database.PruneVersions(fileId, userId, keep, maxAge)
+	if err != nil {
+		logger.LogError("Error pruning versions of file %d: %v", fileId, err)
+		return 0, err
+	}
+	if removed > 0 {
+		logger.LogInfo("Pruned %d versions of file %d", removed, fileId)
+	}
+	deleteBlobs(ctx, orphanKeys)
+	return removed, nil
+}
+
+// VersionsHandler lists the versions of a file
+func VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	if !keyAllowed(w, r, 0, fileId) {
+		return
+	}
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleViewer)
+	if err != nil {
+		versionsDenied(w, err)
+		return
+	}
+	renderVersions(w, r, fileId, ownerId)
+}
+
+// versionsDenied rejects a request about the versions of a file the user
+// cannot access or change
+func versionsDenied(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errors.Is(err, database.ErrForbidden):
+		http.Error(w, "You do not have permission to change this file", http.StatusForbidden)
+	default:
+		logger.LogError("Error checking file access: %v", err)
+		http.Error(w, "Error checking file access", http.StatusInternalServerError)
+	}
+}
+
+// RestoreVersionHandler makes an older version the current one
+func RestoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleEditor)
+	if err != nil {
+		versionsDenied(w, err)
+		return
+	}
+	newVersion, err := database.RestoreVersion(fileId, ownerId, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring version", http.StatusInternalServerError)
+		return
+	}
+	logger.LogInfo("Restored version %d of file %d as version %d", version, fileId, newVersion)
+
+	w.Header().Set("HX-Trigger", `{"triggerItems" : ""}`)
+	renderVersions(w, r, fileId, ownerId)
+}
+
+// PruneVersionsHandler deletes old versions of a file. The keep and
+// max_age form values override the configured retention policy.
+func PruneVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userData, ok := r.Context().Value(middleware.UserDataKey).(database.UserData)
+	if !ok || userData.UserId == 0 {
+		logger.LogError("User data not found or invalid in context")
+		http.Error(w, "User data not found", http.StatusInternalServerError)
+		return
+	}
+
+	fileId, err := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	keep, maxAge := appConfig.VersionsKeep, appConfig.VersionsMaxAge
+	if v := r.FormValue("keep"); v != "" {
+		if keep, err = strconv.Atoi(v); err != nil || keep < 0 {
+			http.Error(w, "Invalid keep", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("max_age"); v != "" {
+		if maxAge, err = time.ParseDuration(v); err != nil || maxAge < 0 {
+			http.Error(w, "Invalid max_age", http.StatusBadRequest)
+			return
+		}
+	}
+	if keep == 0 && maxAge == 0 {
+		http.Error(w, "No retention policy configured", http.StatusBadRequest)
+		return
+	}
+
+	ownerId, err := fileOwner(fileId, userData.UserId, models.RoleEditor)
+	if err != nil {
+		versionsDenied(w, err)
+		return
+	}
+	if _, err := pruneVersions(r.Context(), fileId, ownerId, keep, maxAge); errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error pruning versions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Trigger", `{"triggerItems" : ""}`)
+	renderVersions(w, r, fileId, ownerId)
+}
+
+// renderVersions lists the versions of a file owned by ownerId
+func renderVersions(w http.ResponseWriter, r *http.Request, fileId int64, ownerId int) {
+	file, err := database.GetFile(fileId, ownerId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving file", http.StatusInternalServerError)
+		return
+	}
+	versions, err := database.GetVersions(fileId, ownerId)
+	if err != nil {
+		http.Error(w, "Error retrieving versions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := components.Versions(file, versions).Render(r.Context(), w); err != nil {
+		logger.LogError("Error rendering versions: %v", err)
+		http.Error(w, "Error rendering versions", http.StatusInternalServerError)
+	}
+}
@@ -3,9 +3,11 @@ package middleware
 import (
 	// "log"
 	"context"
+	"crypto/subtle"
 	"net/http"
 	"webserver/internal/database"
 	"webserver/internal/logger"
+	"webserver/internal/models"
 )
 
 // LoggingMiddleware logs the details of each request
@@ -34,6 +36,21 @@ type contextKey string
 
 const UserDataKey contextKey = "userData"
 
+// APIKeyKey holds the models.APIKey a request was authenticated with
+const APIKeyKey contextKey = "apiKey"
+
+// SessionKey holds the models.Session of requests from the web interface
+const SessionKey contextKey = "session"
+
+// SessionCookie is the name of the cookie holding the session token
+const SessionCookie = "session"
+
+// CSRFHeader carries the session's CSRF token on state-changing requests
+const CSRFHeader = "X-CSRF-Token"
+
+// RequireAPIKey authenticates a request with the X-API-Key header or, for
+// the web interface, the session cookie. Requests that use the session
+// and could change something must also send the session's CSRF token.
 func RequireAPIKey(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		logger.LogInfo("Retrieving API key from request header")
@@ -44,22 +61,79 @@ func RequireAPIKey(next http.Handler) http.Handler {
 
 		apiKey := r.Header.Get("X-API-Key")
 		if apiKey == "" {
+			if cookie, err := r.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+				requireSession(next, w, r, cookie.Value)
+				return
+			}
 			logger.LogWarning("No API key provided")
 			http.Error(w, "API key required", http.StatusUnauthorized)
 			return
 		}
 
 		// Get user data associated with API key
-		userData, err := database.GetUserByAPIKey(apiKey)
+		userData, key, err := database.GetUserByAPIKey(apiKey)
 		if err != nil {
 			logger.LogError("Error validating API key: %v", err)
 			http.Error(w, "Invalid API key", http.StatusUnauthorized)
 			return
 		}
-		logger.LogInfo("UserData: %v", userData)
+		logger.LogInfo("User %d authenticated with API key %d (%s)", userData.UserId, key.Id, key.Scope)
 
-		// Add user data to request context
+		// Add user data and the key's restrictions to request context
 		ctx := context.WithValue(r.Context(), UserDataKey, userData)
+		ctx = context.WithValue(ctx, APIKeyKey, key)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// requireSession authenticates a request with the session token from its
+// cookie. The cookie is sent with requests other sites cause the browser to
+// make, so anything but a read also needs the CSRF token, which only the
+// page itself can see.
+func requireSession(next http.Handler, w http.ResponseWriter, r *http.Request, token string) {
+	userData, session, err := database.GetUserBySession(token)
+	if err != nil {
+		logger.LogWarning("Invalid or expired session: %v", err)
+		http.Error(w, "Session expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		csrf := r.Header.Get(CSRFHeader)
+		if subtle.ConstantTimeCompare([]byte(csrf), []byte(session.CSRFToken)) != 1 {
+			logger.LogWarning("Missing or invalid CSRF token from user %d for %s %s", userData.UserId, r.Method, r.URL.Path)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+	}
+	logger.LogInfo("User %d authenticated with session %d", userData.UserId, session.Id)
+
+	ctx := context.WithValue(r.Context(), UserDataKey, userData)
+	ctx = context.WithValue(ctx, SessionKey, session)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireScope rejects requests made with an API key that has none of
+// scopes. Admin keys and sessions are allowed through, so routes without
+// scopes are for admin keys only. It must run after RequireAPIKey.
+func RequireScope(next http.Handler, scopes ...models.Scope) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(SessionKey).(models.Session); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok := r.Context().Value(APIKeyKey).(models.APIKey)
+		if !ok {
+			logger.LogError("API key not found in context")
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		if !key.Allows(scopes...) {
+			logger.LogWarning("API key %d with scope %s used for %s %s", key.Id, key.Scope, r.Method, r.URL.Path)
+			http.Error(w, "API key does not allow this request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
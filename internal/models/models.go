@@ -13,26 +13,101 @@ type Folder struct {
 	FolderName string
 	ParentId   int64
 	CreatedAt  time.Time
+	DeletedAt  time.Time
 }
 
 // todo make this match how files are stored in the database
 type File struct {
-	Id        int64
-	FileName  string
+	Id         int64
+	FileName   string
+	Size       int64
+	CreatedAt  time.Time
+	BlobId     int64
+	StorageKey string
+	Hash       string
+	Encoding   string
+	// KeyUserId is the user whose data key encrypted the contents, 0 when
+	// they are stored in plaintext
+	KeyUserId int
+	DeletedAt time.Time
+}
+
+type UploadFile struct {
+	UserId     int
+	FileName   string
+	FolderId   int64
+	StorageKey string
+	Size       int64
+	Hash       string
+	Encoding   string
+	KeyUserId  int
+	CreatedAt  time.Time
+}
+
+// FileVersion is one stored revision of a file
+type FileVersion struct {
+	FileId    int64
+	Version   int
 	Size      int64
+	Hash      string
 	CreatedAt time.Time
-	Content   []byte
+	Current   bool
 }
 
-type UploadFile struct {
+// Upload is an in-progress resumable upload
+type Upload struct {
+	Id        string
 	UserId    int
-	FileName  string
 	FolderId  int64
-	Content   []byte
-	Size      int64
+	FileName  string
+	Length    int64
+	Offset    int64
+	Metadata  string
 	CreatedAt time.Time
 }
 
+// FolderPath is a folder with its full path from the user's root
+type FolderPath struct {
+	Id   int64
+	Path string
+}
+
+// TreeEntry is a folder or file inside a folder tree, with its path from
+// the top of the tree
+type TreeEntry struct {
+	Path  string
+	IsDir bool
+	File  File
+}
+
+// Quota is a user's storage limits and current usage. A limit of 0 means
+// unlimited.
+type Quota struct {
+	MaxBytes  int64
+	MaxFiles  int64
+	UsedBytes int64
+	UsedFiles int64
+}
+
+// RemainingBytes returns how many more bytes may be stored, or -1 when
+// there is no byte limit
+func (q Quota) RemainingBytes() int64 {
+	if q.MaxBytes == 0 {
+		return -1
+	}
+	return max(q.MaxBytes-q.UsedBytes, 0)
+}
+
+// AllowsFiles reports whether n more files fit in the quota
+func (q Quota) AllowsFiles(n int64) bool {
+	return q.MaxFiles == 0 || q.UsedFiles+n <= q.MaxFiles
+}
+
+// AllowsBytes reports whether size more bytes fit in the quota
+func (q Quota) AllowsBytes(size int64) bool {
+	return q.MaxBytes == 0 || q.UsedBytes+size <= q.MaxBytes
+}
+
 type Item interface {
 	GetName() string
 	GetSize() int64
@@ -53,3 +128,186 @@ func (f File) GetSize() int64          { return f.Size }
 func (f File) GetCreatedAt() time.Time { return f.CreatedAt }
 func (f File) GetID() int64            { return f.Id }
 func (f File) IsFolder() bool          { return false }
+
+// ShareLink gives anyone with its token access to a file or folder.
+// Exactly one of FileId and FolderId is set.
+type ShareLink struct {
+	Id     int64
+	Token  string
+	UserId int
+	// CreatedBy is the user who made the link, which differs from UserId
+	// for links to items in a team drive
+	CreatedBy    int
+	FileId       int64
+	FolderId     int64
+	PasswordHash string
+	ExpiresAt    time.Time // zero for no expiry
+	MaxDownloads int       // 0 for no limit
+	Downloads    int
+	CreatedAt    time.Time
+
+	// Name and Size describe the shared item
+	Name string
+	Size int64
+}
+
+func (s ShareLink) IsFolder() bool {
+	return s.FolderId != 0
+}
+
+func (s ShareLink) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// RemainingDownloads returns how many more downloads are allowed, or -1
+// without a limit
+func (s ShareLink) RemainingDownloads() int {
+	if s.MaxDownloads == 0 {
+		return -1
+	}
+	return s.MaxDownloads - s.Downloads
+}
+
+// Role is the access a grant gives to a file or folder. Each role includes
+// everything the lower ones allow.
+type Role string
+
+const (
+	// RoleViewer can list and download
+	RoleViewer Role = "viewer"
+	// RoleEditor can also upload and create folders
+	RoleEditor Role = "editor"
+	// RoleOwner can also share the item with others
+	RoleOwner Role = "owner"
+)
+
+// Rank orders roles from no access (0) to owner
+func (r Role) Rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleOwner:
+		return 3
+	}
+	return 0
+}
+
+// Allows reports whether r includes everything other allows
+func (r Role) Allows(other Role) bool {
+	return r.Rank() >= other.Rank()
+}
+
+// Grant gives a user a role on another user's file or folder and
+// everything inside it. Exactly one of FileId and FolderId is set.
+type Grant struct {
+	Id        int64
+	FileId    int64
+	FolderId  int64
+	UserId    int
+	Username  string
+	Role      Role
+	GrantedBy int
+	CreatedAt time.Time
+
+	// Name is the item's name and Owner the username it belongs to
+	Name  string
+	Owner string
+}
+
+func (g Grant) IsFolder() bool {
+	return g.FolderId != 0
+}
+
+// Group is a team of users sharing a team drive. Its Role is the current
+// user's role in it.
+type Group struct {
+	Id        int
+	Name      string
+	RootId    int64
+	Role      Role
+	Members   int
+	CreatedAt time.Time
+}
+
+// GroupMember is a user's membership in a group. Viewers can browse the
+// team drive, editors can change it and owners also manage members.
+type GroupMember struct {
+	UserId    int
+	Username  string
+	Role      Role
+	CreatedAt time.Time
+}
+
+// Scope limits what an API key can be used for
+type Scope string
+
+const (
+	// ScopeRead allows listing and downloading
+	ScopeRead Scope = "read"
+	// ScopeUpload allows uploading files and creating folders
+	ScopeUpload Scope = "upload"
+	// ScopeAdmin allows everything the user can do
+	ScopeAdmin Scope = "admin"
+)
+
+// Valid reports whether s is one of the known scopes
+func (s Scope) Valid() bool {
+	return s == ScopeRead || s == ScopeUpload || s == ScopeAdmin
+}
+
+// APIKey describes one of a user's API keys. The key itself is only shown
+// when it is created; Hint is enough of it to tell keys apart.
+type APIKey struct {
+	Id    int64
+	Name  string
+	Hint  string
+	Scope Scope
+	// FolderId restricts the key to a folder and everything below it, 0
+	// for no restriction. FolderPath is set when listing keys.
+	FolderId   int64
+	FolderPath string
+	ExpiresAt  time.Time // zero for no expiry
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero if never used
+}
+
+// Allows reports whether the key may be used for a request that needs
+// one of scopes. Admin keys are allowed everything.
+func (k APIKey) Allows(scopes ...Scope) bool {
+	if k.Scope == ScopeAdmin {
+		return true
+	}
+	for _, scope := range scopes {
+		if k.Scope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key has passed its expiry
+func (k APIKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && !k.ExpiresAt.After(time.Now())
+}
+
+// Session is a browser login. The cookie holding its token is HttpOnly, so
+// state-changing requests also send CSRFToken, which the page can read.
+type Session struct {
+	Id         int64
+	UserId     int
+	CSRFToken  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// TwoFactor describes a user's two-factor authentication settings
+type TwoFactor struct {
+	Enabled bool
+	// Pending is set between starting enrollment and confirming it with a
+	// first code
+	Pending bool
+	// RecoveryCodes is how many unused recovery codes are left
+	RecoveryCodes int
+}
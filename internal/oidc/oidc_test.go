@@ -0,0 +1,261 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn is a local OpenID Connect provider. It signs ID tokens with
+// its current key, publishes every key it has and checks PKCE when codes
+// are redeemed.
+type standIn struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	current string
+	// codes maps authorization codes to the PKCE challenge and the
+	// claims of the ID token they are redeemed for
+	codes map[string]pendingCode
+}
+
+type pendingCode struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newStandIn(t *testing.T) *standIn {
+	t.Helper()
+	s := &standIn{keys: make(map[string]*rsa.PrivateKey), codes: make(map[string]pendingCode)}
+	s.rotate(t, "k1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var keys []map[string]string
+		for kid, key := range s.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "use": "sig", "kid": kid,
+				"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		pending, ok := s.codes[r.PostFormValue("code")]
+		delete(s.codes, r.PostFormValue("code"))
+		s.mu.Unlock()
+		if !ok || codeChallenge(r.PostFormValue("code_verifier")) != pending.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": s.sign(t, s.current, pending.claims)})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// rotate makes a new key with id kid the one tokens are signed with,
+// keeping the old ones published
+func (s *standIn) rotate(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+	s.current = kid
+}
+
+func (s *standIn) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	s.mu.Lock()
+	key := s.keys[kid]
+	s.mu.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+// claims returns valid claims for the client with the given nonce
+func (s *standIn) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":   s.URL,
+		"sub":   "user-1",
+		"aud":   "files",
+		"nonce": nonce,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func TestVerifyChecksClaims(t *testing.T) {
+	s := newStandIn(t)
+	p := NewProvider(s.URL, "files", "", []string{"openid"})
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]any)
+		ok     bool
+	}{
+		{"valid", func(map[string]any) {}, true},
+		{"other issuer", func(c map[string]any) { c["iss"] = "https://evil.example" }, false},
+		{"other audience", func(c map[string]any) { c["aud"] = "other" }, false},
+		{"audience list", func(c map[string]any) { c["aud"] = []string{"other", "files"}; c["azp"] = "files" }, true},
+		{"audience list without azp", func(c map[string]any) { c["aud"] = []string{"other", "files"} }, false},
+		{"azp of another client", func(c map[string]any) { c["azp"] = "other" }, false},
+		{"wrong nonce", func(c map[string]any) { c["nonce"] = "other" }, false},
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-2 * clockSkew).Unix() }, false},
+		{"no expiry", func(c map[string]any) { delete(c, "exp") }, false},
+		{"issued in the future", func(c map[string]any) { c["iat"] = time.Now().Add(2 * clockSkew).Unix() }, false},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := s.claims("n1")
+			tt.change(claims)
+			_, err := p.Verify(ctx, s.sign(t, s.current, claims), "n1")
+			if tt.ok && err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("Verify accepted the token")
+			}
+		})
+	}
+}
+
+func TestVerifyChecksSignature(t *testing.T) {
+	s := newStandIn(t)
+	p := NewProvider(s.URL, "files", "", []string{"openid"})
+	ctx := context.Background()
+	token := s.sign(t, s.current, s.claims("n1"))
+
+	parts := strings.Split(token, ".")
+	forged := s.claims("n1")
+	forged["sub"] = "admin"
+	payload, _ := json.Marshal(forged)
+	if _, err := p.Verify(ctx, parts[0]+"."+b64(payload)+"."+parts[2], "n1"); err == nil {
+		t.Error("Verify accepted changed claims")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "k1"})
+	if _, err := p.Verify(ctx, b64(header)+"."+parts[1]+".", "n1"); err == nil {
+		t.Error("Verify accepted an unsigned token")
+	}
+
+	// A key the provider does not publish
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, other, crypto.SHA256, digest[:])
+	if _, err := p.Verify(ctx, parts[0]+"."+parts[1]+"."+b64(signature), "n1"); err == nil {
+		t.Error("Verify accepted a token signed with another key")
+	}
+}
+
+func TestVerifyFindsRotatedKeys(t *testing.T) {
+	s := newStandIn(t)
+	p := NewProvider(s.URL, "files", "", []string{"openid"})
+	ctx := context.Background()
+
+	if _, err := p.Verify(ctx, s.sign(t, "k1", s.claims("n1")), "n1"); err != nil {
+		t.Fatalf("Verify with the first key: %v", err)
+	}
+
+	// Unknown keys are only fetched once a minute
+	s.rotate(t, "k2")
+	if _, err := p.Verify(ctx, s.sign(t, "k2", s.claims("n1")), "n1"); err == nil {
+		t.Fatal("keys were fetched again right away")
+	}
+	p.mu.Lock()
+	p.keysAt = time.Now().Add(-keyRefreshInterval)
+	p.mu.Unlock()
+	if _, err := p.Verify(ctx, s.sign(t, "k2", s.claims("n1")), "n1"); err != nil {
+		t.Fatalf("Verify with the rotated key: %v", err)
+	}
+	if _, err := p.Verify(ctx, s.sign(t, "k1", s.claims("n1")), "n1"); err != nil {
+		t.Fatalf("Verify with the old key still published: %v", err)
+	}
+}
+
+func TestExchangeUsesPKCE(t *testing.T) {
+	s := newStandIn(t)
+	p := NewProvider(s.URL, "files", "", []string{"openid"})
+	ctx := context.Background()
+
+	authURL, err := p.AuthURL(ctx, "http://localhost/callback", "state", "n1", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") != "n1" || q.Get("state") != "state" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	issue := func(code string) {
+		s.mu.Lock()
+		s.codes[code] = pendingCode{challenge: q.Get("code_challenge"), claims: s.claims("n1")}
+		s.mu.Unlock()
+	}
+
+	issue("c1")
+	if _, err := p.Exchange(ctx, "http://localhost/callback", "c1", "other", "n1"); err == nil {
+		t.Error("Exchange succeeded with the wrong verifier")
+	}
+	issue("c2")
+	claims, err := p.Exchange(ctx, "http://localhost/callback", "c2", "verifier", "n1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.String("sub") != "user-1" {
+		t.Errorf("sub = %q", claims.String("sub"))
+	}
+	if _, err := p.Exchange(ctx, "http://localhost/callback", "c2", "verifier", "n1"); err == nil {
+		t.Error("a code was redeemed twice")
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings a blob can be stored with. The names match the HTTP
+// Content-Encoding tokens so stored data can be sent to clients as is.
+const (
+	EncodingNone = ""
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// compressedTypes are MIME types whose data is already compressed, so
+// compressing them again wastes CPU for little or no gain
+var compressedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/java-archive",
+	"application/epub+zip",
+	"application/vnd.openxmlformats-",
+	"application/vnd.oasis.opendocument.",
+	"application/pdf",
+}
+
+// ShouldCompress reports whether data of the given MIME type is worth
+// compressing at rest
+func ShouldCompress(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	// SVG and BMP are uncompressed image formats
+	if strings.HasPrefix(contentType, "image/svg") || strings.HasPrefix(contentType, "image/bmp") {
+		return true
+	}
+	for _, prefix := range compressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidEncoding reports whether encoding is one the store can write
+func ValidEncoding(encoding string) bool {
+	return encoding == EncodingNone || encoding == EncodingGzip || encoding == EncodingZstd
+}
+
+// Compress returns a reader of r compressed with the given encoding. The
+// compression runs in a goroutine; close the returned reader if it is not
+// read to the end so the goroutine can exit.
+func Compress(r io.Reader, encoding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		switch encoding {
+		case EncodingGzip:
+			w = gzip.NewWriter(pw)
+		case EncodingZstd:
+			enc, err := zstd.NewWriter(pw)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			w = enc
+		default:
+			pw.CloseWithError(fmt.Errorf("unsupported encoding: %q", encoding))
+			return
+		}
+
+		if _, err := io.Copy(w, r); err != nil {
+			w.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr
+}
+
+// Decompress wraps a stored blob so reads return the original contents.
+// Closing the result closes rc.
+func Decompress(rc io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingNone:
+		return rc, nil
+	case EncodingGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("error reading gzip blob: %v", err)
+		}
+		return &decompressor{Reader: zr, close: func() { zr.Close() }, rc: rc}, nil
+	case EncodingZstd:
+		zr, err := zstd.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("error reading zstd blob: %v", err)
+		}
+		return &decompressor{Reader: zr, close: zr.Close, rc: rc}, nil
+	default:
+		rc.Close()
+		return nil, fmt.Errorf("unsupported encoding: %q", encoding)
+	}
+}
+
+type decompressor struct {
+	io.Reader
+	close func()
+	rc    io.ReadCloser
+}
+
+func (d *decompressor) Close() error {
+	d.close()
+	return d.rc.Close()
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SQLiteStore keeps blobs in a table of the application database. This is
+// the original storage behavior; the whole blob is held in memory on Put
+// and Get since SQLite has no streaming BLOB API in database/sql.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	createBlobTable := `
+	CREATE TABLE IF NOT EXISTS blob_store (
+		key TEXT PRIMARY KEY,
+		contents BLOB NOT NULL,
+		size INTEGER NOT NULL,
+		created_at TIMESTAMP
+	);`
+	if _, err := db.Exec(createBlobTable); err != nil {
+		return nil, fmt.Errorf("error creating blob table: %v", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// bytesBlob lets an in-memory blob be returned as an io.ReadCloser
+type bytesBlob struct {
+	*bytes.Reader
+}
+
+func (bytesBlob) Close() error { return nil }
+
+func (s *SQLiteStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("error reading blob: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+	INSERT OR REPLACE INTO blob_store (key, contents, size, created_at)
+	VALUES (?, ?, ?, ?)`,
+		key, contents, len(contents), time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error saving blob: %v", err)
+	}
+	return int64(len(contents)), nil
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var contents []byte
+	err := s.db.QueryRowContext(ctx, "SELECT contents FROM blob_store WHERE key = ?", key).Scan(&contents)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob: %v", err)
+	}
+	return bytesBlob{bytes.NewReader(contents)}, nil
+}
+
+// Delete removes the blob; deleting a missing blob is not an error
+func (s *SQLiteStore) Delete(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM blob_store WHERE key = ?", key); err != nil {
+		return fmt.Errorf("error deleting blob: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	info := BlobInfo{Key: key}
+	err := s.db.QueryRowContext(ctx, "SELECT size, created_at FROM blob_store WHERE key = ?", key).
+		Scan(&info.Size, &info.ModTime)
+	if err == sql.ErrNoRows {
+		return BlobInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, fmt.Errorf("error reading blob info: %v", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"webserver/internal/logger"
+	"webserver/pkg/config"
+)
+
+// ErrNotFound is returned when a blob does not exist in the store
+var ErrNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore is the interface every storage backend implements. Keys are
+// opaque strings generated by NewKey.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+}
+
+// Store is the backend selected at startup by InitStore
+var Store BlobStore
+
+// InitStore selects the blob store backend from the config
+func InitStore(cfg *config.Config, db *sql.DB) error {
+	if logger.Logger == nil {
+		return fmt.Errorf("logger is not initialized")
+	}
+
+	switch cfg.StorageBackend {
+	case "sqlite":
+		logger.LogInfo("Using SQLite blob storage")
+		store, err := NewSQLiteStore(db)
+		if err != nil {
+			return err
+		}
+		Store = store
+	case "fs":
+		logger.LogInfo("Using filesystem blob storage at %s", cfg.StoragePath)
+		store, err := NewFSStore(cfg.StoragePath)
+		if err != nil {
+			return err
+		}
+		Store = store
+	default:
+		return fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+	return nil
+}
+
+// NewKey generates a random storage key
+func NewKey() string {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// validKey reports whether key only holds characters produced by NewKey,
+// so it is safe to use as a file name.
+func validKey(key string) bool {
+	if len(key) < 2 {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
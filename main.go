@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"net/http"
+	"time"
 	"webserver/internal/database"
+	"webserver/internal/encryption"
 	"webserver/internal/handlers"
 	"webserver/internal/logger"
 	"webserver/internal/middleware"
+	"webserver/internal/models"
+	"webserver/internal/storage"
 	"webserver/pkg/config"
 )
 
 func main() {
 	devMode := flag.Bool("dev", false, "Run in development mode")
+	generateKey := flag.Bool("generate-key", false, "Print a new random master key and exit")
+	rotateMasterKey := flag.String("rotate-master-key", "", "Rewrap all data keys with the master key in this file and exit")
+	setQuota := flag.String("set-quota", "", "Set the storage quota of this user to -quota-bytes and -quota-files and exit")
+	quotaBytes := flag.Int64("quota-bytes", -1, "Byte limit for -set-quota, 0 for unlimited, -1 for the default")
+	quotaFiles := flag.Int64("quota-files", -1, "File limit for -set-quota, 0 for unlimited, -1 for the default")
+	resetTwoFactor := flag.String("reset-2fa", "", "Turn off two-factor authentication for this user and exit")
 	flag.Parse()
 
 	config.DevMode = *devMode
@@ -22,15 +35,88 @@ func main() {
 		logger.LogFatal("Failed to initialize logger: ", err)
 	}
 
+	if *generateKey {
+		key, err := encryption.NewDataKey()
+		if err != nil {
+			logger.LogFatal("Failed to generate key: %v", err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logger.LogFatal("Failed to load config: %v", err)
+	}
+	if err := encryption.Init(cfg.MasterKey); err != nil {
+		logger.LogFatal("Failed to initialize encryption: %v", err)
+	}
+
 	// Initialize the database
+	database.SetAPIKeySecret(cfg.APIKeySecret)
+	database.SetSessionTimeouts(cfg.SessionIdleTimeout, cfg.SessionMaxAge)
 	if err := database.InitDB(); err != nil {
 		logger.LogFatal("Failed to initialize the database: ", err)
 	}
+	if err := database.MigrateAPIKeys(); err != nil {
+		logger.LogFatal("Failed to hash API keys: %v", err)
+	}
+	if err := database.MigrateTOTPSecrets(); err != nil {
+		logger.LogFatal("Failed to encrypt TOTP secrets: %v", err)
+	}
+
+	if *rotateMasterKey != "" {
+		rotateKeys(*rotateMasterKey)
+		return
+	}
+	if *setQuota != "" {
+		maxBytes := sql.NullInt64{Int64: *quotaBytes, Valid: *quotaBytes >= 0}
+		maxFiles := sql.NullInt64{Int64: *quotaFiles, Valid: *quotaFiles >= 0}
+		if err := database.SetQuota(*setQuota, maxBytes, maxFiles); err != nil {
+			logger.LogFatal("Failed to set quota: %v", err)
+		}
+		fmt.Printf("Updated quota of %s\n", *setQuota)
+		return
+	}
+	if *resetTwoFactor != "" {
+		if err := database.ResetTwoFactor(*resetTwoFactor); err != nil {
+			logger.LogFatal("Failed to reset two-factor authentication: %v", err)
+		}
+		fmt.Printf("Turned off two-factor authentication for %s\n", *resetTwoFactor)
+		return
+	}
+
+	// Initialize the blob store and move any legacy file contents into it
+	if err := storage.InitStore(cfg, database.DB()); err != nil {
+		logger.LogFatal("Failed to initialize storage: %v", err)
+	}
+	if err := database.MigrateFileContents(storage.Store); err != nil {
+		logger.LogFatal("Failed to migrate file contents: %v", err)
+	}
+	if err := database.MigrateBlobs(storage.Store); err != nil {
+		logger.LogFatal("Failed to deduplicate stored files: %v", err)
+	}
+	if err := database.MigrateVersions(); err != nil {
+		logger.LogFatal("Failed to migrate file versions: %v", err)
+	}
+
+	handlers.Configure(cfg)
+
+	// Purge expired items from the trash in the background
+	if cfg.TrashRetention > 0 {
+		go handlers.PurgeTrash(context.Background(), time.Hour)
+	}
+	// Delete abandoned resumable uploads the same way
+	if cfg.TusUploadTTL > 0 {
+		go handlers.ExpireUploads(context.Background(), time.Hour)
+	}
 
 	mux := http.NewServeMux()
 
-	protected := func(handler http.HandlerFunc) http.Handler {
-		return middleware.LoggingMiddleware(middleware.RequireAPIKey(http.HandlerFunc(handler)))
+	// Routes are for admin API keys unless they list the other scopes
+	// allowed to use them
+	protected := func(handler http.HandlerFunc, scopes ...models.Scope) http.Handler {
+		return middleware.LoggingMiddleware(middleware.RequireAPIKey(middleware.RequireScope(handler, scopes...)))
 	}
 
 	// Login handlers
@@ -43,12 +129,75 @@ func main() {
 	mux.Handle("/login", middleware.LoggingMiddleware(http.HandlerFunc(handlers.LoginHandler)))
 	mux.Handle("/show_register", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ShowRegisterPage)))
 	mux.Handle("/register", middleware.LoggingMiddleware(http.HandlerFunc(handlers.RegisterHandler)))
+	mux.Handle("/oidc/login", middleware.LoggingMiddleware(http.HandlerFunc(handlers.OIDCLoginHandler)))
+	mux.Handle("/oidc/callback", middleware.LoggingMiddleware(http.HandlerFunc(handlers.OIDCCallbackHandler)))
+	mux.Handle("/verify", middleware.LoggingMiddleware(http.HandlerFunc(handlers.VerifyEmailHandler)))
+	mux.Handle("/show_forgot", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ShowForgotPage)))
+	mux.Handle("/forgot", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ForgotPasswordHandler)))
+	mux.Handle("/reset", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ResetPasswordPageHandler)))
+	mux.Handle("/reset/password", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ResetPasswordHandler)))
+	mux.Handle("/login/2fa", middleware.LoggingMiddleware(http.HandlerFunc(handlers.LoginTwoFactorHandler)))
+	mux.Handle("/logout", protected(handlers.LogoutHandler))
 
 	// API handlers
-	mux.Handle("/filepath", protected(handlers.FilePathHandler))
-	mux.Handle("/items", protected(handlers.ItemsHandler))
-	mux.Handle("/upload", protected(handlers.UploadHandler))
-	mux.Handle("/download", protected(handlers.DownloadHandler))
+	mux.Handle("/filepath", protected(handlers.FilePathHandler, models.ScopeRead))
+	mux.Handle("/items", protected(handlers.ItemsHandler, models.ScopeRead))
+	mux.Handle("/upload", protected(handlers.UploadHandler, models.ScopeUpload))
+	mux.Handle("/download", protected(handlers.DownloadHandler, models.ScopeRead))
+	mux.Handle("/download/", protected(handlers.DownloadHandler, models.ScopeRead))
+	mux.Handle("/download/zip", protected(handlers.DownloadArchiveHandler, models.ScopeRead))
+	mux.Handle("/usage", protected(handlers.UsageHandler, models.ScopeRead, models.ScopeUpload))
+	mux.Handle("/versions", protected(handlers.VersionsHandler, models.ScopeRead))
+	mux.Handle("/versions/restore", protected(handlers.RestoreVersionHandler))
+	mux.Handle("/versions/prune", protected(handlers.PruneVersionsHandler))
+	mux.Handle("/modal/create", protected(handlers.CreateFolderModalHandler))
+	mux.Handle("/modal/rename", protected(handlers.RenameModalHandler))
+	mux.Handle("/modal/move", protected(handlers.MoveModalHandler))
+	mux.Handle("/modal/copy", protected(handlers.CopyModalHandler))
+	mux.Handle("/folders/create", protected(handlers.CreateFolderHandler, models.ScopeUpload))
+	mux.Handle("/folders/rename", protected(handlers.RenameFolderHandler))
+	mux.Handle("/folders/move", protected(handlers.MoveFolderHandler))
+	mux.Handle("/files/rename", protected(handlers.RenameFileHandler))
+	mux.Handle("/files/move", protected(handlers.MoveFileHandler))
+	mux.Handle("/folders/copy", protected(handlers.CopyFolderHandler))
+	mux.Handle("/files/copy", protected(handlers.CopyFileHandler))
+	mux.Handle("/delete/file", protected(handlers.DeleteFileHandler))
+	mux.Handle("/delete/folder", protected(handlers.DeleteFolderHandler))
+	mux.Handle("/trash", protected(handlers.TrashHandler))
+	mux.Handle("/trash/restore", protected(handlers.RestoreTrashHandler))
+	mux.Handle("/trash/empty", protected(handlers.EmptyTrashHandler))
+	mux.Handle("/modal/share", protected(handlers.ShareModalHandler))
+	mux.Handle("/files/share", protected(handlers.CreateShareHandler))
+	mux.Handle("/shares", protected(handlers.SharesHandler))
+	mux.Handle("/shares/revoke", protected(handlers.RevokeShareHandler))
+	mux.Handle("/grants", protected(handlers.GrantsHandler))
+	mux.Handle("/grants/create", protected(handlers.CreateGrantHandler))
+	mux.Handle("/grants/revoke", protected(handlers.RevokeGrantHandler))
+	mux.Handle("/shared", protected(handlers.SharedHandler))
+	mux.Handle("/keys/get", protected(handlers.KeysHandler))
+	mux.Handle("/keys/create", protected(handlers.CreateKeyHandler))
+	mux.Handle("/keys/revoke", protected(handlers.RevokeKeyHandler))
+	mux.Handle("/2fa", protected(handlers.TwoFactorHandler))
+	mux.Handle("/2fa/setup", protected(handlers.StartTwoFactorHandler))
+	mux.Handle("/2fa/enable", protected(handlers.EnableTwoFactorHandler))
+	mux.Handle("/2fa/disable", protected(handlers.DisableTwoFactorHandler))
+	mux.Handle("/2fa/recovery", protected(handlers.RecoveryCodesHandler))
+	mux.Handle("/email", protected(handlers.EmailHandler))
+	mux.Handle("/email/change", protected(handlers.ChangeEmailHandler))
+	mux.Handle("/email/verify", protected(handlers.ResendVerificationHandler))
+	mux.Handle("/groups", protected(handlers.GroupsHandler))
+	mux.Handle("/groups/create", protected(handlers.CreateGroupHandler))
+	mux.Handle("/groups/members", protected(handlers.GroupMembersHandler))
+	mux.Handle("/groups/members/add", protected(handlers.AddGroupMemberHandler))
+	mux.Handle("/groups/members/remove", protected(handlers.RemoveGroupMemberHandler))
+
+	// Public share links
+	mux.Handle("/s/{token}", middleware.LoggingMiddleware(http.HandlerFunc(handlers.PublicShareHandler)))
+	mux.Handle("/s/{token}/download", middleware.LoggingMiddleware(http.HandlerFunc(handlers.ShareDownloadHandler)))
+
+	// Resumable uploads (tus protocol)
+	mux.Handle("OPTIONS /tus/", middleware.LoggingMiddleware(http.HandlerFunc(handlers.TusOptionsHandler)))
+	mux.Handle("/tus/", protected(handlers.TusHandler, models.ScopeUpload))
 
 	// apply recovery middleware
 	handler := middleware.RecoveryMiddleware(mux)
@@ -66,3 +215,29 @@ func main() {
 		logger.LogFatal("Failed to server http: ", err)
 	}
 }
+
+// rotateKeys rewraps every user's data key with the master key read from
+// newKeyFile. The current master key must still be configured so the data
+// keys can be unwrapped; file contents are not re-encrypted.
+func rotateKeys(newKeyFile string) {
+	if !encryption.Enabled() {
+		logger.LogFatal("MASTER_KEY or MASTER_KEY_FILE must hold the current master key")
+	}
+	newKey, err := config.ReadKeyFile(newKeyFile)
+	if err != nil {
+		logger.LogFatal("Failed to read new master key: %v", err)
+	}
+
+	count, err := database.RewrapDataKeys(encryption.KeyId(newKey), func(wrapped []byte) ([]byte, error) {
+		dataKey, err := encryption.UnwrapKey(wrapped)
+		if err != nil {
+			return nil, err
+		}
+		return encryption.WrapKeyWith(newKey, dataKey)
+	})
+	if err != nil {
+		logger.LogFatal("Failed to rotate master key: %v", err)
+	}
+	fmt.Printf("Rewrapped %d data keys with master key %s\n", count, encryption.KeyId(newKey))
+	fmt.Println("Update MASTER_KEY or MASTER_KEY_FILE to the new key before restarting the server")
+}
@@ -1,12 +1,171 @@
 package config
 
 import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Port string
 	Env  string
+
+	// StorageBackend selects where file contents are kept: "sqlite" or "fs"
+	StorageBackend string
+	// StoragePath is the root directory used by the "fs" backend
+	StoragePath string
+
+	// Compression is the encoding used for file contents at rest: "none",
+	// "gzip" or "zstd"
+	Compression string
+
+	// MasterKey wraps the per-user data keys that encrypt file contents.
+	// Encryption at rest is disabled when it is empty.
+	MasterKey []byte
+
+	// QuotaBytes and QuotaFiles are the storage limits of users without
+	// their own quota, 0 for no limit
+	QuotaBytes int64
+	QuotaFiles int64
+
+	// VersionsKeep is how many versions of a file to keep, 0 for all
+	VersionsKeep int
+	// VersionsMaxAge is how long old versions are kept, 0 for forever
+	VersionsMaxAge time.Duration
+
+	// TrashRetention is how long deleted items stay in the trash before
+	// they are purged, 0 to keep them until the trash is emptied
+	TrashRetention time.Duration
+
+	// ExtractMaxEntries, ExtractMaxBytes and ExtractMaxRatio limit the
+	// number of entries, total extracted size and compression ratio of
+	// archives uploaded for extraction
+	ExtractMaxEntries int
+	ExtractMaxBytes   int64
+	ExtractMaxRatio   int64
+
+	// APIKeySecret, when set, is mixed into the hashes of stored API keys
+	// with HMAC so that a copy of the database alone cannot be used to
+	// check guessed keys. Changing it invalidates keys hashed with it.
+	APIKeySecret []byte
+
+	// CookieSecure marks the session cookie Secure, so browsers only send
+	// it over HTTPS
+	CookieSecure bool
+	// SessionIdleTimeout and SessionMaxAge end browser sessions after that
+	// long without a request and that long after login
+	SessionIdleTimeout time.Duration
+	SessionMaxAge      time.Duration
+
+	// TOTPIssuer names this server in authenticator apps
+	TOTPIssuer string
+
+	// OIDCIssuer, OIDCClientID and OIDCClientSecret configure single sign-on
+	// with an OpenID Connect provider. It is off when OIDCIssuer is empty.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// OIDCRedirectURL is where the provider sends users back to. When
+	// empty it is PublicURL, or the address of the request, plus
+	// /oidc/callback.
+	OIDCRedirectURL string
+	OIDCScopes      []string
+	// OIDCUsernameClaim names the claim new users are named after
+	OIDCUsernameClaim string
+	// OIDCRoleClaim names the claim whose values OIDCRoleMap maps to roles
+	// in groups
+	OIDCRoleClaim string
+	OIDCRoleMap   []RoleMapping
+	// OIDCLinkExisting lets the first single sign-on of a provider account
+	// log in to an existing local account found by OIDCLinkClaim
+	OIDCLinkExisting bool
+	// OIDCLinkClaim names a claim the provider vouches for, rather than
+	// one users can edit. "email" is matched against verified addresses of
+	// local accounts, and only when email_verified is true; any other
+	// claim is matched against local account names.
+	OIDCLinkClaim string
+
+	// LDAPURL is the ldap:// or ldaps:// address of a directory to check
+	// passwords against. It is off when empty.
+	LDAPURL string
+	// LDAPStartTLS upgrades ldap:// connections with StartTLS
+	LDAPStartTLS bool
+	// LDAPCACert holds PEM certificates to trust for the directory instead
+	// of the system's, and LDAPInsecureSkipVerify turns checking off
+	LDAPCACert             []byte
+	LDAPInsecureSkipVerify bool
+	// LDAPBindDN and LDAPBindPassword are the account used to look users
+	// up, anonymous when LDAPBindDN is empty
+	LDAPBindDN       string
+	LDAPBindPassword string
+	// LDAPBaseDN is searched with LDAPUserFilter, where {username} stands
+	// for the name typed in, to find the user logging in
+	LDAPBaseDN     string
+	LDAPUserFilter string
+	// LDAPUsernameAttribute names the attribute local users are named after
+	LDAPUsernameAttribute string
+	// LDAPIDAttribute names the attribute that identifies an entry for
+	// good, such as entryUUID or objectGUID, which local users are linked
+	// to
+	LDAPIDAttribute string
+	// LDAPGroupBaseDN is searched with LDAPGroupFilter, where {dn} and
+	// {username} stand for the user, to find their groups. When
+	// LDAPGroupFilter is empty the user's memberOf attribute is used.
+	LDAPGroupBaseDN string
+	LDAPGroupFilter string
+	// LDAPRequiredGroup, when set, is a group users must be in to log in
+	LDAPRequiredGroup string
+	// LDAPRoleMap maps the user's groups to roles like OIDCRoleMap
+	LDAPRoleMap []RoleMapping
+	// LDAPLinkExisting lets the first directory login of a username that
+	// already has a local account log in to that account
+	LDAPLinkExisting bool
+
+	// PasswordLogin allows logging in and registering with passwords kept
+	// by this server
+	PasswordLogin bool
+
+	// SMTPHost is the mail server emails are sent through. When empty
+	// emails are written to the log instead and password reset is off.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	// SMTPFrom is the address emails are sent from
+	SMTPFrom string
+	// SMTPTLS is how the connection to the mail server is secured:
+	// "starttls", "tls" or "none"
+	SMTPTLS string
+
+	// RequireEmailVerification stops users who registered with an email
+	// address from logging in until they follow the link sent to it. It
+	// is on by default only with SMTPHost, as logged emails never arrive.
+	RequireEmailVerification bool
+	// EmailVerifyTTL and PasswordResetTTL are how long the links in
+	// verification and password reset emails work
+	EmailVerifyTTL   time.Duration
+	PasswordResetTTL time.Duration
+
+	// PublicURL is the address users reach the server at, used to build
+	// share links and the links in emails. When empty share links are
+	// taken from each request, but links in emails never are, since
+	// anyone can set a request's Host header.
+	PublicURL string
+
+	// TusUploadDir holds partially uploaded files for resumable uploads
+	TusUploadDir string
+	// TusMaxSize is the largest resumable upload accepted, 0 for no limit
+	TusMaxSize int64
+	// TusUploadTTL is how long an unfinished resumable upload is kept
+	// before it is deleted, 0 to keep it until it is finished or
+	// terminated
+	TusUploadTTL time.Duration
 }
 
 func LoadConfig() (*Config, error) {
@@ -20,12 +179,483 @@ func LoadConfig() (*Config, error) {
 		env = "development" // default environment
 	}
 
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "sqlite" // keep file contents in auth.db by default
+	}
+
+	storagePath := os.Getenv("STORAGE_PATH")
+	if storagePath == "" {
+		storagePath = "./data/blobs"
+	}
+
+	compression := os.Getenv("COMPRESSION")
+	if compression == "" {
+		compression = "none"
+	}
+	if compression != "none" && compression != "gzip" && compression != "zstd" {
+		return nil, fmt.Errorf("invalid COMPRESSION: %s", compression)
+	}
+
+	var masterKey []byte
+	if v := os.Getenv("MASTER_KEY"); v != "" {
+		key, err := ParseKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MASTER_KEY: %v", err)
+		}
+		masterKey = key
+	} else if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+		key, err := ReadKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MASTER_KEY_FILE: %v", err)
+		}
+		masterKey = key
+	}
+
+	var quotaBytes, quotaFiles int64
+	if v := os.Getenv("QUOTA_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid QUOTA_BYTES: %s", v)
+		}
+		quotaBytes = n
+	}
+	if v := os.Getenv("QUOTA_FILES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid QUOTA_FILES: %s", v)
+		}
+		quotaFiles = n
+	}
+
+	var versionsKeep int
+	if v := os.Getenv("VERSIONS_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid VERSIONS_KEEP: %s", v)
+		}
+		versionsKeep = n
+	}
+	var versionsMaxAge time.Duration
+	if v := os.Getenv("VERSIONS_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid VERSIONS_MAX_AGE: %s", v)
+		}
+		versionsMaxAge = d
+	}
+
+	trashRetention := 30 * 24 * time.Hour
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid TRASH_RETENTION: %s", v)
+		}
+		trashRetention = d
+	}
+
+	extractMaxEntries := 10000
+	if v := os.Getenv("EXTRACT_MAX_ENTRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid EXTRACT_MAX_ENTRIES: %s", v)
+		}
+		extractMaxEntries = n
+	}
+	extractMaxBytes := int64(1 << 30)
+	if v := os.Getenv("EXTRACT_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid EXTRACT_MAX_BYTES: %s", v)
+		}
+		extractMaxBytes = n
+	}
+	extractMaxRatio := int64(100)
+	if v := os.Getenv("EXTRACT_MAX_RATIO"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid EXTRACT_MAX_RATIO: %s", v)
+		}
+		extractMaxRatio = n
+	}
+
+	var apiKeySecret []byte
+	if v := os.Getenv("API_KEY_SECRET"); v != "" {
+		key, err := ParseKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_KEY_SECRET: %v", err)
+		}
+		apiKeySecret = key
+	} else if path := os.Getenv("API_KEY_SECRET_FILE"); path != "" {
+		key, err := ReadKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_KEY_SECRET_FILE: %v", err)
+		}
+		apiKeySecret = key
+	}
+
+	// Browsers do not send Secure cookies to http://localhost, so only
+	// development defaults to plain HTTP
+	cookieSecure := env != "development"
+	if v := os.Getenv("COOKIE_SECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid COOKIE_SECURE: %s", v)
+		}
+		cookieSecure = b
+	}
+	sessionIdleTimeout := 2 * time.Hour
+	if v := os.Getenv("SESSION_IDLE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_IDLE_TIMEOUT: %s", v)
+		}
+		sessionIdleTimeout = d
+	}
+	sessionMaxAge := 24 * time.Hour
+	if v := os.Getenv("SESSION_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_MAX_AGE: %s", v)
+		}
+		sessionMaxAge = d
+	}
+
+	totpIssuer := os.Getenv("TOTP_ISSUER")
+	if totpIssuer == "" {
+		totpIssuer = "Go Web Server"
+	}
+
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+
+	oidcIssuer := os.Getenv("OIDC_ISSUER")
+	oidcClientID := os.Getenv("OIDC_CLIENT_ID")
+	if oidcIssuer != "" && oidcClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+	oidcClientSecret := os.Getenv("OIDC_CLIENT_SECRET")
+	if path := os.Getenv("OIDC_CLIENT_SECRET_FILE"); oidcClientSecret == "" && path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OIDC_CLIENT_SECRET_FILE: %v", err)
+		}
+		oidcClientSecret = strings.TrimSpace(string(contents))
+	}
+	oidcScopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+	if len(oidcScopes) == 0 {
+		oidcScopes = []string{"openid", "profile", "email"}
+	}
+	oidcUsernameClaim := os.Getenv("OIDC_USERNAME_CLAIM")
+	if oidcUsernameClaim == "" {
+		oidcUsernameClaim = "preferred_username"
+	}
+	oidcRoleClaim := os.Getenv("OIDC_ROLE_CLAIM")
+	if oidcRoleClaim == "" {
+		oidcRoleClaim = "groups"
+	}
+	oidcRoleMap, err := ParseRoleMap(os.Getenv("OIDC_ROLE_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC_ROLE_MAP: %v", err)
+	}
+	var oidcLinkExisting bool
+	if v := os.Getenv("OIDC_LINK_EXISTING"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OIDC_LINK_EXISTING: %s", v)
+		}
+		oidcLinkExisting = b
+	}
+	oidcLinkClaim := os.Getenv("OIDC_LINK_CLAIM")
+	if oidcLinkClaim == "" {
+		oidcLinkClaim = "email"
+	}
+	passwordLogin := true
+	if v := os.Getenv("PASSWORD_LOGIN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PASSWORD_LOGIN: %s", v)
+		}
+		passwordLogin = b
+	}
+
+	ldapURL := os.Getenv("LDAP_URL")
+	var ldapStartTLS bool
+	if v := os.Getenv("LDAP_START_TLS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP_START_TLS: %s", v)
+		}
+		ldapStartTLS = b
+	}
+	var ldapInsecureSkipVerify bool
+	if v := os.Getenv("LDAP_TLS_INSECURE_SKIP_VERIFY"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP_TLS_INSECURE_SKIP_VERIFY: %s", v)
+		}
+		ldapInsecureSkipVerify = b
+	}
+	var ldapLinkExisting bool
+	if v := os.Getenv("LDAP_LINK_EXISTING"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP_LINK_EXISTING: %s", v)
+		}
+		ldapLinkExisting = b
+	}
+	var ldapCACert []byte
+	if path := os.Getenv("LDAP_TLS_CA_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP_TLS_CA_FILE: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("invalid LDAP_TLS_CA_FILE: no PEM certificates in %s", path)
+		}
+		ldapCACert = contents
+	}
+	ldapBindPassword := os.Getenv("LDAP_BIND_PASSWORD")
+	if path := os.Getenv("LDAP_BIND_PASSWORD_FILE"); ldapBindPassword == "" && path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP_BIND_PASSWORD_FILE: %v", err)
+		}
+		ldapBindPassword = strings.TrimSpace(string(contents))
+	}
+	ldapBaseDN := os.Getenv("LDAP_BASE_DN")
+	ldapUserFilter := os.Getenv("LDAP_USER_FILTER")
+	if ldapUserFilter == "" {
+		ldapUserFilter = "(uid={username})"
+	}
+	ldapUsernameAttribute := os.Getenv("LDAP_USERNAME_ATTRIBUTE")
+	if ldapUsernameAttribute == "" {
+		ldapUsernameAttribute = "uid"
+	}
+	ldapIDAttribute := os.Getenv("LDAP_ID_ATTRIBUTE")
+	if ldapIDAttribute == "" {
+		ldapIDAttribute = "entryUUID"
+	}
+	ldapGroupBaseDN := os.Getenv("LDAP_GROUP_BASE_DN")
+	if ldapGroupBaseDN == "" {
+		ldapGroupBaseDN = ldapBaseDN
+	}
+	ldapRoleMap, err := ParseRoleMap(os.Getenv("LDAP_ROLE_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP_ROLE_MAP: %v", err)
+	}
+	if ldapURL != "" {
+		u, err := url.Parse(ldapURL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return nil, fmt.Errorf("invalid LDAP_URL: %s", ldapURL)
+		}
+		if ldapStartTLS && u.Scheme == "ldaps" {
+			return nil, fmt.Errorf("LDAP_START_TLS is for ldap:// URLs, ldaps:// already uses TLS")
+		}
+		if ldapBaseDN == "" {
+			return nil, fmt.Errorf("LDAP_BASE_DN is required with LDAP_URL")
+		}
+		if !strings.Contains(ldapUserFilter, "{username}") {
+			return nil, fmt.Errorf("invalid LDAP_USER_FILTER: %s does not contain {username}", ldapUserFilter)
+		}
+	}
+
+	if !passwordLogin && oidcIssuer == "" && ldapURL == "" {
+		return nil, fmt.Errorf("PASSWORD_LOGIN can only be turned off with OIDC_ISSUER or LDAP_URL set")
+	}
+
+	smtpHost := os.Getenv("SMTP_HOST")
+	smtpTLS := os.Getenv("SMTP_TLS")
+	if smtpTLS == "" {
+		smtpTLS = "starttls"
+	}
+	if smtpTLS != "starttls" && smtpTLS != "tls" && smtpTLS != "none" {
+		return nil, fmt.Errorf("invalid SMTP_TLS: %s", smtpTLS)
+	}
+	smtpPort := os.Getenv("SMTP_PORT")
+	if smtpPort == "" {
+		smtpPort = "587"
+		if smtpTLS == "tls" {
+			smtpPort = "465"
+		}
+	}
+	smtpPassword := os.Getenv("SMTP_PASSWORD")
+	if path := os.Getenv("SMTP_PASSWORD_FILE"); smtpPassword == "" && path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PASSWORD_FILE: %v", err)
+		}
+		smtpPassword = strings.TrimSpace(string(contents))
+	}
+	smtpFrom := os.Getenv("SMTP_FROM")
+	if smtpHost != "" && smtpFrom == "" {
+		return nil, fmt.Errorf("SMTP_FROM is required with SMTP_HOST")
+	}
+	if smtpHost != "" && publicURL == "" {
+		return nil, fmt.Errorf("PUBLIC_URL is required with SMTP_HOST")
+	}
+	requireEmailVerification := smtpHost != ""
+	if v := os.Getenv("REQUIRE_EMAIL_VERIFICATION"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REQUIRE_EMAIL_VERIFICATION: %s", v)
+		}
+		requireEmailVerification = b
+	}
+	emailVerifyTTL := 24 * time.Hour
+	if v := os.Getenv("EMAIL_VERIFY_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid EMAIL_VERIFY_TTL: %s", v)
+		}
+		emailVerifyTTL = d
+	}
+	passwordResetTTL := time.Hour
+	if v := os.Getenv("PASSWORD_RESET_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PASSWORD_RESET_TTL: %s", v)
+		}
+		passwordResetTTL = d
+	}
+
+	tusUploadDir := os.Getenv("TUS_UPLOAD_DIR")
+	if tusUploadDir == "" {
+		tusUploadDir = "./data/uploads"
+	}
+
+	var tusMaxSize int64
+	if v := os.Getenv("TUS_MAX_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid TUS_MAX_SIZE: %s", v)
+		}
+		tusMaxSize = size
+	}
+	tusUploadTTL := 24 * time.Hour
+	if v := os.Getenv("TUS_UPLOAD_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid TUS_UPLOAD_TTL: %s", v)
+		}
+		tusUploadTTL = d
+	}
+
 	return &Config{
-		Port: port,
-		Env:  env,
+		Port:                     port,
+		Env:                      env,
+		StorageBackend:           storageBackend,
+		StoragePath:              storagePath,
+		Compression:              compression,
+		MasterKey:                masterKey,
+		QuotaBytes:               quotaBytes,
+		QuotaFiles:               quotaFiles,
+		VersionsKeep:             versionsKeep,
+		VersionsMaxAge:           versionsMaxAge,
+		TrashRetention:           trashRetention,
+		ExtractMaxEntries:        extractMaxEntries,
+		ExtractMaxBytes:          extractMaxBytes,
+		ExtractMaxRatio:          extractMaxRatio,
+		APIKeySecret:             apiKeySecret,
+		CookieSecure:             cookieSecure,
+		SessionIdleTimeout:       sessionIdleTimeout,
+		SessionMaxAge:            sessionMaxAge,
+		TOTPIssuer:               totpIssuer,
+		OIDCIssuer:               oidcIssuer,
+		OIDCClientID:             oidcClientID,
+		OIDCClientSecret:         oidcClientSecret,
+		OIDCRedirectURL:          os.Getenv("OIDC_REDIRECT_URL"),
+		OIDCScopes:               oidcScopes,
+		OIDCUsernameClaim:        oidcUsernameClaim,
+		OIDCRoleClaim:            oidcRoleClaim,
+		OIDCRoleMap:              oidcRoleMap,
+		OIDCLinkExisting:         oidcLinkExisting,
+		OIDCLinkClaim:            oidcLinkClaim,
+		LDAPURL:                  ldapURL,
+		LDAPStartTLS:             ldapStartTLS,
+		LDAPCACert:               ldapCACert,
+		LDAPInsecureSkipVerify:   ldapInsecureSkipVerify,
+		LDAPBindDN:               os.Getenv("LDAP_BIND_DN"),
+		LDAPBindPassword:         ldapBindPassword,
+		LDAPBaseDN:               ldapBaseDN,
+		LDAPUserFilter:           ldapUserFilter,
+		LDAPUsernameAttribute:    ldapUsernameAttribute,
+		LDAPIDAttribute:          ldapIDAttribute,
+		LDAPGroupBaseDN:          ldapGroupBaseDN,
+		LDAPGroupFilter:          os.Getenv("LDAP_GROUP_FILTER"),
+		LDAPRequiredGroup:        os.Getenv("LDAP_REQUIRED_GROUP"),
+		LDAPRoleMap:              ldapRoleMap,
+		LDAPLinkExisting:         ldapLinkExisting,
+		PasswordLogin:            passwordLogin,
+		SMTPHost:                 smtpHost,
+		SMTPPort:                 smtpPort,
+		SMTPUsername:             os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:             smtpPassword,
+		SMTPFrom:                 smtpFrom,
+		SMTPTLS:                  smtpTLS,
+		RequireEmailVerification: requireEmailVerification,
+		EmailVerifyTTL:           emailVerifyTTL,
+		PasswordResetTTL:         passwordResetTTL,
+		PublicURL:                publicURL,
+		TusUploadDir:             tusUploadDir,
+		TusMaxSize:               tusMaxSize,
+		TusUploadTTL:             tusUploadTTL,
 	}, nil
 }
 
+// RoleMapping gives users whose role claim or directory groups include
+// Value the role Role in the group called Group
+type RoleMapping struct {
+	Value string
+	Group string
+	Role  string
+}
+
+// ParseRoleMap parses a comma separated list of value=group:role entries,
+// such as "eng-leads=eng:owner,engineers=eng:editor"
+func ParseRoleMap(s string) ([]RoleMapping, error) {
+	var mappings []RoleMapping
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		value, target, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not value=group:role", entry)
+		}
+		group, role, ok := strings.Cut(target, ":")
+		if !ok || value == "" || group == "" {
+			return nil, fmt.Errorf("%q is not value=group:role", entry)
+		}
+		if role != "viewer" && role != "editor" && role != "owner" {
+			return nil, fmt.Errorf("unknown role %q in %q", role, entry)
+		}
+		mappings = append(mappings, RoleMapping{Value: value, Group: group, Role: role})
+	}
+	return mappings, nil
+}
+
+// ParseKey decodes a 32 byte key given as 64 hex characters or base64
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be 32 bytes encoded as hex or base64")
+}
+
+// ReadKeyFile reads a key in the format accepted by ParseKey from a file
+func ReadKeyFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(contents))
+}
+
 var DevMode bool
 var DevUser = struct {
 	Username string
@@ -1,11 +1,30 @@
-async function downloadFile(file_id) {
-  try {
-    const apiKey = document.querySelector("#key").value;
+async function downloadFile(file_id, version) {
+  const query = version ? `?version=${version}` : "";
+  await fetchDownload(`/download/${file_id}${query}`);
+}
 
-    const response = await fetch(`/download/${file_id}`, {
-      method: "GET",
-      headers: { access_token: apiKey },
-    });
+// Downloads a folder as a ZIP archive
+async function downloadFolder(folder_id) {
+  await fetchDownload(`/download/zip?folder_id=${folder_id}`);
+}
+
+// Downloads the items ticked in the file table as one ZIP archive
+async function downloadSelected() {
+  const params = new URLSearchParams();
+  document.querySelectorAll("#fileTable input.select:checked").forEach((box) => {
+    params.append(box.dataset.kind === "folder" ? "folder_id" : "file_id", box.value);
+  });
+  if (params.toString() === "") {
+    alertify.error("Select files or folders to download.");
+    return;
+  }
+  await fetchDownload(`/download/zip?${params}`);
+}
+
+async function fetchDownload(url) {
+  try {
+    // Same-origin requests send the session cookie
+    const response = await fetch(url, { method: "GET" });
 
     if (!response.ok) {
       throw new Error(`Error: ${response.statusText}`);
@@ -42,6 +61,9 @@ function copyToClipboard(input) {
   if (typeof input === "string") {
     textToCopy = input;
   } else if (input instanceof Event) {
+    if (!input.detail.successful) {
+      return;
+    }
     const response = input.detail.xhr.response;
     const data = JSON.parse(response);
     textToCopy = data.link;